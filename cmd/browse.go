@@ -0,0 +1,970 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/ceph/go-ceph/rbd"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the browse tree is /cephfs/<job>/<backup>/... and /rbd/<image>/<snapshot>/..., everything above a backup or
+// snapshot is generated, everything below it is served from a mount of it made on demand. Browse users can read
+// every backup and snapshot, so they are admins; nothing is scoped to a user's namespaces.
+var browsePrefix = "/browse"
+
+var (
+	metricBrowseMounts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cephback_browse_mounts",
+			Help: "The number of backups and snapshots mounted for browsing",
+		},
+	)
+	metricBrowseMountsReaped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_browse_mounts_reaped",
+			Help: "The number of browse mounts removed after being idle",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricBrowseMounts)
+	prometheus.MustRegister(metricBrowseMountsReaped)
+}
+
+// browseMount is a backup or snapshot opened for browsing
+type browseMount struct {
+	fs       webdav.FileSystem
+	mount    *SnapshotMount // nil for repository snapshots and generations
+	refs     int
+	lastUsed time.Time
+}
+
+var browseMounts = make(map[string]*browseMount)
+
+// browseMountsPending has the mounts being made, closed once they are done
+var browseMountsPending = make(map[string]chan struct{})
+var browseMountsMutex sync.Mutex
+
+// openBrowseMount returns the filesystem for a backup or snapshot, mounting it if needed. The returned func
+// must be called once the filesystem is no longer in use. Mounting is done outside browseMountsMutex, so that
+// a slow mount only holds up requests for the same backup or snapshot.
+func openBrowseMount(kind string, parent string, name string) (webdav.FileSystem, func(), error) {
+	key := kind + "/" + parent + "/" + name
+	browseMountsMutex.Lock()
+	defer browseMountsMutex.Unlock()
+
+	bm, ok := browseMounts[key]
+	for !ok {
+		pending, mounting := browseMountsPending[key]
+		if !mounting {
+			break
+		}
+		browseMountsMutex.Unlock()
+		<-pending
+		browseMountsMutex.Lock()
+		bm, ok = browseMounts[key]
+	}
+	if !ok {
+		done := make(chan struct{})
+		browseMountsPending[key] = done
+		browseMountsMutex.Unlock()
+		var err error
+		bm, err = newBrowseMount(kind, parent, name)
+		if err == nil && isShuttingDown() {
+			bm.close()
+			err = fmt.Errorf("interrupted by shutdown")
+		}
+		browseMountsMutex.Lock()
+		delete(browseMountsPending, key)
+		close(done)
+		if err != nil {
+			return nil, nil, err
+		}
+		browseMounts[key] = bm
+		metricBrowseMounts.Set(float64(len(browseMounts)))
+	}
+	bm.refs++
+	bm.lastUsed = time.Now()
+	return bm.fs, func() {
+		browseMountsMutex.Lock()
+		bm.refs--
+		bm.lastUsed = time.Now()
+		browseMountsMutex.Unlock()
+	}, nil
+}
+
+func newBrowseMount(kind string, parent string, name string) (*browseMount, error) {
+	image, snap := parent, name
+	root := ""
+	if kind == "cephfs" {
+		j, err := restoreJob(parent)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+		g, err := findGenerationByName(j, name)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+		if j.Engine == "repo" {
+			fs, err := newRepoFS(j, g.Name)
+			if err != nil {
+				return nil, err
+			}
+			return &browseMount{fs: fs}, nil
+		}
+		if j.Engine == "generations" {
+			dir, err := generationDir(j, g.Name)
+			if err != nil {
+				return nil, err
+			}
+			fs, err := newBrowseDir(dir)
+			if err != nil {
+				return nil, err
+			}
+			return &browseMount{fs: fs}, nil
+		}
+		if image = backupRbd(j); image == "" {
+			return nil, os.ErrNotExist
+		}
+		if root, err = filepath.Rel(j.BackupMount, j.Target); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := mountRbdSnapshot(image, snap)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := newBrowseDir(filepath.Join(m.Path, root))
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	return &browseMount{fs: fs, mount: m}, nil
+}
+
+func (bm *browseMount) close() {
+	if bm.mount != nil {
+		bm.mount.Close()
+	}
+	if c, ok := bm.fs.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// browseDir is a read-only webdav.Dir that refuses paths leading out of it through a symlink, as a backup may
+// hold links to anywhere on this host
+type browseDir string
+
+func newBrowseDir(root string) (browseDir, error) {
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	return browseDir(real), nil
+}
+
+// resolve returns the path of name below the root, following symlinks only while they stay below it
+func (d browseDir) resolve(name string) (string, error) {
+	root := string(d)
+	p := root
+	for _, c := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if c == "" {
+			continue
+		}
+		p = filepath.Join(p, c)
+		info, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if p, err = filepath.EvalSymlinks(p); err != nil {
+			return "", err
+		}
+		if p != root && !strings.HasPrefix(p, root+"/") {
+			return "", os.ErrPermission
+		}
+	}
+	return p, nil
+}
+
+func (d browseDir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (d browseDir) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (d browseDir) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (d browseDir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	p, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (d browseDir) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+// reapBrowseMounts removes mounts nobody has used for browse-idle-timeout
+func reapBrowseMounts(all bool) {
+	browseMountsMutex.Lock()
+	defer browseMountsMutex.Unlock()
+	for key, bm := range browseMounts {
+		if !all && (bm.refs > 0 || time.Since(bm.lastUsed) < browseIdleTimeout) {
+			continue
+		}
+		logger.Infof("Closing browse mount %s", key)
+		bm.close()
+		delete(browseMounts, key)
+		if !all {
+			metricBrowseMountsReaped.Inc()
+		}
+	}
+	metricBrowseMounts.Set(float64(len(browseMounts)))
+}
+
+// closeBrowseMounts removes every browse mount, on shutdown
+func closeBrowseMounts() {
+	reapBrowseMounts(true)
+}
+
+func startBrowseReaper() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			reapBrowseMounts(false)
+		}
+	}()
+}
+
+// browseFS is the read-only webdav filesystem of every backup and snapshot
+type browseFS struct{}
+
+func (b browseFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (b browseFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (b browseFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+// split returns the kind, parent and backup or snapshot name of a path and the rest of it below that
+func (b browseFS) split(name string) (parts []string, rest string) {
+	parts = strings.SplitN(strings.Trim(path.Clean("/"+name), "/"), "/", 4)
+	if parts[0] == "" {
+		parts = nil
+	}
+	if len(parts) == 4 {
+		rest = "/" + parts[3]
+		parts = parts[:3]
+	} else {
+		rest = "/"
+	}
+	return parts, rest
+}
+
+// list returns the generated entries of a directory above the backups and snapshots
+func (b browseFS) list(parts []string) ([]string, error) {
+	switch len(parts) {
+	case 0:
+		return []string{"cephfs", "rbd"}, nil
+	case 1:
+		var names []string
+		if parts[0] == "cephfs" {
+			for _, j := range cephfsJobs {
+				names = append(names, j.Name)
+			}
+			return names, nil
+		} else if parts[0] == "rbd" {
+			if err := CephConnInit(); err != nil {
+				return nil, err
+			}
+			images, err := rbd.GetImageNames(iocx)
+			if err != nil {
+				return nil, err
+			}
+			for _, i := range images {
+				if !stringInSlice(i, imageExclude) {
+					names = append(names, i)
+				}
+			}
+			return names, nil
+		}
+	case 2:
+		var names []string
+		if parts[0] == "cephfs" {
+			j, err := restoreJob(parts[1])
+			if err != nil {
+				return nil, os.ErrNotExist
+			}
+			gens, err := cephfsGenerations(j)
+			if err != nil {
+				return nil, err
+			}
+			for _, g := range gens {
+				names = append(names, g.Name)
+			}
+			return names, nil
+		} else if parts[0] == "rbd" && !stringInSlice(parts[1], imageExclude) {
+			if err := CephConnInit(); err != nil {
+				return nil, err
+			}
+			for _, s := range getSnapshots(parts[1]) {
+				if matchSnapName(s.Name, rbdSnapshotRegex) {
+					names = append(names, s.Name)
+				}
+			}
+			return names, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (b browseFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	parts, rest := b.split(name)
+	if len(parts) < 3 {
+		entries, err := b.list(parts)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) > 0 {
+			parent, _ := b.list(parts[:len(parts)-1])
+			if !stringInSlice(parts[len(parts)-1], parent) {
+				return nil, os.ErrNotExist
+			}
+		}
+		return newVirtualDir(path.Base("/"+strings.Join(parts, "/")), entries), nil
+	}
+
+	if parts[0] != "cephfs" && parts[0] != "rbd" {
+		return nil, os.ErrNotExist
+	}
+	if parent, err := b.list(parts[:2]); err != nil || !stringInSlice(parts[2], parent) {
+		return nil, os.ErrNotExist
+	}
+	if rest == "/" {
+		return &backupRootDir{ctx: ctx, parts: parts}, nil
+	}
+	fs, release, err := openBrowseMount(parts[0], parts[1], parts[2])
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.OpenFile(ctx, rest, os.O_RDONLY, 0)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingFile{File: f, release: release}, nil
+}
+
+// Stat asks the filesystem of a backup or snapshot rather than opening the file, as opening a file of a repository
+// restores it
+func (b browseFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	parts, rest := b.split(name)
+	if len(parts) < 3 || rest == "/" {
+		f, err := b.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.Stat()
+	}
+	if parts[0] != "cephfs" && parts[0] != "rbd" {
+		return nil, os.ErrNotExist
+	}
+	if parent, err := b.list(parts[:2]); err != nil || !stringInSlice(parts[2], parent) {
+		return nil, os.ErrNotExist
+	}
+	fs, release, err := openBrowseMount(parts[0], parts[1], parts[2])
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return fs.Stat(ctx, rest)
+}
+
+// backupRootDir is the top directory of a backup or snapshot. It is only mounted once it is listed, so that
+// listing the backups of a job or the snapshots of an image doesn't mount every one of them.
+type backupRootDir struct {
+	ctx   context.Context
+	parts []string
+	f     webdav.File
+}
+
+func (d *backupRootDir) Stat() (os.FileInfo, error) {
+	return staticFileInfo{name: d.parts[2], mode: os.ModeDir | 0555}, nil
+}
+
+func (d *backupRootDir) Readdir(count int) ([]os.FileInfo, error) {
+	if d.f == nil {
+		fs, release, err := openBrowseMount(d.parts[0], d.parts[1], d.parts[2])
+		if err != nil {
+			return nil, err
+		}
+		f, err := fs.OpenFile(d.ctx, "/", os.O_RDONLY, 0)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		d.f = &releasingFile{File: f, release: release}
+	}
+	return d.f.Readdir(count)
+}
+
+func (d *backupRootDir) Close() error {
+	if d.f != nil {
+		return d.f.Close()
+	}
+	return nil
+}
+
+func (d *backupRootDir) Read(p []byte) (int, error)                   { return 0, fmt.Errorf("is a directory") }
+func (d *backupRootDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *backupRootDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+
+// releasingFile releases the mount it is on when it is closed
+type releasingFile struct {
+	webdav.File
+	release func()
+	once    sync.Once
+}
+
+func (f *releasingFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.release)
+	return err
+}
+
+func (f *releasingFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// staticFileInfo is the FileInfo of a generated directory or a repository node
+type staticFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i staticFileInfo) Name() string       { return i.name }
+func (i staticFileInfo) Size() int64        { return i.size }
+func (i staticFileInfo) Mode() os.FileMode  { return i.mode }
+func (i staticFileInfo) ModTime() time.Time { return i.modTime }
+func (i staticFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i staticFileInfo) Sys() interface{}   { return nil }
+
+// ContentType lets webdav give the type of a repository file without reading it, which would restore it
+func (i staticFileInfo) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(filepath.Ext(i.name)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// virtualDir is a generated directory
+type virtualDir struct {
+	info    os.FileInfo
+	entries []os.FileInfo
+	pos     int
+}
+
+func newVirtualDir(name string, entries []string) *virtualDir {
+	d := &virtualDir{info: staticFileInfo{name: name, mode: os.ModeDir | 0555}}
+	sort.Strings(entries)
+	for _, e := range entries {
+		d.entries = append(d.entries, staticFileInfo{name: e, mode: os.ModeDir | 0555})
+	}
+	return d
+}
+
+func (d *virtualDir) Close() error                                 { return nil }
+func (d *virtualDir) Read(p []byte) (int, error)                   { return 0, fmt.Errorf("is a directory") }
+func (d *virtualDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *virtualDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (d *virtualDir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+
+func (d *virtualDir) Readdir(count int) ([]os.FileInfo, error) {
+	if count <= 0 {
+		rest := d.entries[d.pos:]
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if d.pos >= len(d.entries) {
+		return nil, io.EOF
+	}
+	end := d.pos + count
+	if end > len(d.entries) {
+		end = len(d.entries)
+	}
+	rest := d.entries[d.pos:end]
+	d.pos = end
+	return rest, nil
+}
+
+// repoFS is the read-only webdav filesystem of a repository snapshot. Files are restored to a temporary file
+// when opened, so that they can be served with seeking.
+type repoFS struct {
+	repo     *Repository
+	nodes    map[string]*RepoNode
+	children map[string][]string
+}
+
+func newRepoFS(j *CephFSJob, id string) (*repoFS, error) {
+	repo, err := openRepository(j.Repository)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := repo.findSnapshot(j.Name, id)
+	if err != nil {
+		return nil, err
+	}
+	fs := &repoFS{
+		repo:     repo,
+		nodes:    map[string]*RepoNode{"": {Type: "dir", Mode: os.ModeDir | 0555, MTime: snap.Time}},
+		children: make(map[string][]string),
+	}
+	err = repo.walkTree(snap, func(n *RepoNode) error {
+		if n.Path == "" || n.Path == "." {
+			fs.nodes[""] = n
+			return nil
+		}
+		fs.nodes[n.Path] = n
+		parent := filepath.Dir(n.Path)
+		if parent == "." {
+			parent = ""
+		}
+		fs.children[parent] = append(fs.children[parent], n.Path)
+		return nil
+	})
+	return fs, err
+}
+
+func (fs *repoFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *repoFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs *repoFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs *repoFS) node(name string) (*RepoNode, error) {
+	n, ok := fs.nodes[strings.Trim(path.Clean("/"+name), "/")]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return n, nil
+}
+
+func repoNodeInfo(n *RepoNode) os.FileInfo {
+	mode := n.Mode.Perm()
+	switch n.Type {
+	case "dir":
+		mode |= os.ModeDir
+	case "symlink":
+		mode |= os.ModeSymlink
+	}
+	return staticFileInfo{name: filepath.Base("/" + n.Path), size: n.Size, mode: mode, modTime: n.MTime}
+}
+
+func (fs *repoFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	n, err := fs.node(name)
+	if err != nil {
+		return nil, err
+	}
+	return repoNodeInfo(n), nil
+}
+
+func (fs *repoFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	n, err := fs.node(name)
+	if err != nil {
+		return nil, err
+	}
+	if n.Type == "dir" {
+		d := &virtualDir{info: repoNodeInfo(n)}
+		for _, c := range fs.children[strings.Trim(path.Clean("/"+name), "/")] {
+			d.entries = append(d.entries, repoNodeInfo(fs.nodes[c]))
+		}
+		return d, nil
+	}
+
+	return &repoFile{fs: fs, node: n, info: repoNodeInfo(n)}, nil
+}
+
+// repoFile is a repository file, restored to a temporary file on its first read and removed once closed. Listing
+// and PROPFIND open every entry, which must not restore them.
+type repoFile struct {
+	fs   *repoFS
+	node *RepoNode
+	info os.FileInfo
+	tmp  *os.File
+}
+
+func (f *repoFile) restore() error {
+	if f.tmp != nil {
+		return nil
+	}
+	tmp, err := ioutil.TempFile("", "cephback-browse-")
+	if err != nil {
+		return err
+	}
+	os.Remove(tmp.Name())
+	if f.node.Type == "file" {
+		if err := f.fs.repo.writeChunks(tmp, f.node.Chunks); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return err
+	}
+	f.tmp = tmp
+	return nil
+}
+
+func (f *repoFile) Read(p []byte) (int, error) {
+	if err := f.restore(); err != nil {
+		return 0, err
+	}
+	return f.tmp.Read(p)
+}
+
+func (f *repoFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.restore(); err != nil {
+		return 0, err
+	}
+	return f.tmp.Seek(offset, whence)
+}
+
+func (f *repoFile) Close() error {
+	if f.tmp != nil {
+		return f.tmp.Close()
+	}
+	return nil
+}
+
+func (f *repoFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *repoFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, fmt.Errorf("not a directory")
+}
+
+func (f *repoFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// readBrowseUsers reads browse-auth-file, which holds "user:bcrypt hash of password" lines as written by
+// htpasswd -nB
+func readBrowseUsers(file string) (map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: '%s' is not a user:hash line", file, line)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s: the password of %s is not a bcrypt hash", file, fields[0])
+		}
+		users[fields[0]] = []byte(fields[1])
+	}
+	return users, scanner.Err()
+}
+
+// browseUsers caches browse-auth-file until it changes
+var browseUsers struct {
+	sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string][]byte
+	// verified holds when each user, hash and password that passed bcrypt was last checked
+	verified map[[sha256.Size]byte]time.Time
+}
+
+// how long a verified password is let through without bcrypt
+var browseAuthCacheTime = 5 * time.Minute
+
+// browseBcrypt limits how many bcrypt compares run at once, so clients guessing passwords can't take all the CPU
+var browseBcrypt = make(chan struct{}, 2)
+
+// cachedBrowseUsers returns the users of browse-auth-file, only reading it again once its mtime or size changes
+func cachedBrowseUsers() (map[string][]byte, error) {
+	info, err := os.Stat(browseAuthFile)
+	if err != nil {
+		return nil, err
+	}
+	browseUsers.Lock()
+	defer browseUsers.Unlock()
+	if browseUsers.users != nil && info.ModTime().Equal(browseUsers.modTime) && info.Size() == browseUsers.size {
+		return browseUsers.users, nil
+	}
+	users, err := readBrowseUsers(browseAuthFile)
+	if err != nil {
+		return nil, err
+	}
+	browseUsers.users, browseUsers.modTime, browseUsers.size = users, info.ModTime(), info.Size()
+	browseUsers.verified = make(map[[sha256.Size]byte]time.Time)
+	return users, nil
+}
+
+// browseAuth checks HTTP basic auth against browse-auth-file. Basic auth sends the password in the clear, so
+// /browse/ must only be reached over TLS, such as the edge terminated route of the OpenShift template.
+func browseAuth(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	users, err := cachedBrowseUsers()
+	if err != nil {
+		logger.Errorf("Unable to read browse auth file: %s", err.Error())
+		return false
+	}
+	hash, ok := users[user]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + string(hash) + "\x00" + pass))
+	browseUsers.Lock()
+	checked, ok := browseUsers.verified[key]
+	browseUsers.Unlock()
+	if ok && time.Since(checked) < browseAuthCacheTime {
+		return true
+	}
+
+	browseBcrypt <- struct{}{}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(pass))
+	<-browseBcrypt
+	if err != nil {
+		return false
+	}
+	browseUsers.Lock()
+	for k, t := range browseUsers.verified {
+		if time.Since(t) >= browseAuthCacheTime {
+			delete(browseUsers.verified, k)
+		}
+	}
+	browseUsers.verified[key] = time.Now()
+	browseUsers.Unlock()
+	return true
+}
+
+// browseAuthorized answers a request that browsing is disabled for or whose user is unknown, and tells if it may
+// go on
+func browseAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if !browseEnabled {
+		http.NotFound(w, r)
+		return false
+	}
+	if !browseAuth(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cephback"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// browseTar streams a directory as a tar archive
+func browseTar(w http.ResponseWriter, r *http.Request, fs browseFS, name string) {
+	// everything above a backup or snapshot would mean mounting all of them
+	if parts, _ := fs.split(name); len(parts) < 3 {
+		http.Error(w, "Choose a backup or snapshot to download", http.StatusBadRequest)
+		return
+	}
+	info, err := fs.Stat(r.Context(), name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	base := path.Base("/" + strings.Trim(name, "/"))
+	if base == "/" {
+		base = "browse"
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", base+".tar"))
+
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	var add func(p string, rel string, info os.FileInfo) error
+	add = func(p string, rel string, info os.FileInfo) error {
+		if r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		f, err := fs.OpenFile(r.Context(), p, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if info.IsDir() {
+			hdr.Name += "/"
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			entries, err := f.Readdir(0)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if err := add(path.Join(p, e.Name()), path.Join(rel, e.Name()), e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			// links and special files are left out, their targets are not resolvable through the browse tree
+			return nil
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, f, info.Size())
+		return err
+	}
+	if err := add(name, base, info); err != nil {
+		logger.Errorf("Tar download of %s failed: %s", name, err.Error())
+	}
+}
+
+// httpBrowse serves every CephFS backup and RBD snapshot as a read-only WebDAV tree. A GET of a directory with
+// ?tar downloads it as a tar archive.
+func httpBrowse() http.Handler {
+	fs := browseFS{}
+	dav := &webdav.Handler{
+		Prefix:     browsePrefix,
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				logger.Debugf("Browse %s %s: %s", r.Method, r.URL.Path, err.Error())
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !browseAuthorized(w, r) {
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		default:
+			http.Error(w, "Backups are read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		// a PROPFIND without a depth is infinite, and would mount and walk every backup and snapshot
+		if depth := r.Header.Get("Depth"); r.Method == "PROPFIND" && depth != "0" && depth != "1" {
+			http.Error(w, "Only PROPFIND with Depth 0 or 1 is supported", http.StatusForbidden)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, browsePrefix)
+		if _, ok := r.URL.Query()["tar"]; ok && r.Method == "GET" {
+			browseTar(w, r, fs, name)
+			return
+		}
+		// directories are listed as html for browsers, webdav clients use PROPFIND
+		if r.Method == "GET" {
+			if info, err := fs.Stat(r.Context(), name); err == nil && info.IsDir() {
+				browseIndex(w, r, fs, name)
+				return
+			}
+		}
+		dav.ServeHTTP(w, r)
+	})
+}
+
+// browseIndex lists a directory as html with links to its entries and a tar download
+func browseIndex(w http.ResponseWriter, r *http.Request, fs browseFS, name string) {
+	f, err := fs.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	entries, err := f.Readdir(0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	base := strings.TrimSuffix(browsePrefix+"/"+strings.Trim(name, "/"), "/")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	link := (&url.URL{Path: base}).String()
+	fmt.Fprintf(w, "<html><body><h1>%s</h1>\n", htmlEscape(base))
+	if parts, _ := fs.split(name); len(parts) == 3 {
+		fmt.Fprintf(w, "<p><a href=\"%s/?tar\">Download as tar</a></p>\n", htmlEscape(link))
+	}
+	fmt.Fprintln(w, "<ul>")
+	for _, e := range entries {
+		suffix := ""
+		if e.IsDir() {
+			suffix = "/"
+		}
+		fmt.Fprintf(w, "<li><a href=\"%s/%s%s\">%s%s</a> %d %s</li>\n", htmlEscape(link), htmlEscape(url.PathEscape(e.Name())), suffix,
+			htmlEscape(e.Name()), suffix, e.Size(), e.ModTime().Format(time.RFC3339))
+	}
+	fmt.Fprintln(w, "</ul></body></html>")
+}
+
+var htmlReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&#34;", "'", "&#39;")
+
+func htmlEscape(s string) string {
+	return htmlReplacer.Replace(s)
+}
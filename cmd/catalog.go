@@ -0,0 +1,603 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// the catalog is a bolt database with a bucket of path versions, keyed by path relative to the job's source,
+// and a bucket of the generations that were catalogued
+var catalogPathsBucket = []byte("paths")
+var catalogGenerationsBucket = []byte("generations")
+var catalogMetaBucket = []byte("meta")
+
+// how many paths are written per transaction, to keep memory bounded on large trees
+var catalogBatchSize = 10000
+
+var catalogSearchJob string
+var catalogSearchLimit int
+
+var (
+	metricCatalogPaths = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_catalog_paths",
+			Help: "The number of paths in the last catalogued CephFS backup",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCatalogNewVersions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_catalog_new_versions",
+			Help: "The number of new path versions recorded for the last catalogued CephFS backup",
+		},
+		[]string{"cephfs_job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCatalogPaths)
+	prometheus.MustRegister(metricCatalogNewVersions)
+}
+
+// CatalogVersion is a version of a path and the range of catalogued generations it was unchanged in
+type CatalogVersion struct {
+	Size      int64     `json:"size"`
+	MTime     time.Time `json:"mtime"`
+	Hash      string    `json:"hash,omitempty"`
+	First     string    `json:"first"`
+	FirstTime time.Time `json:"first_time"`
+	Last      string    `json:"last"`
+	LastTime  time.Time `json:"last_time"`
+}
+
+// CatalogResult is a path version found by a search, with the generations still available to restore it from
+type CatalogResult struct {
+	Path        string   `json:"path"`
+	Generations []string `json:"generations"`
+	CatalogVersion
+}
+
+// catalogFile is where the job's catalog is kept, next to the success file
+func catalogFile(j *CephFSJob) string {
+	return j.SuccessFile + ".catalog"
+}
+
+func openCatalog(j *CephFSJob, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(catalogFile(j), 0600, &bolt.Options{Timeout: time.Minute, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open catalog %s: %s", catalogFile(j), err.Error())
+	}
+	return db, nil
+}
+
+// updateCatalog runs f in a read-write transaction. The catalog is opened for each update rather than for a whole
+// walk, as bolt locks the file exclusively while it is open read-write and searches would wait for the walk.
+func updateCatalog(j *CephFSJob, f func(tx *bolt.Tx) error) error {
+	db, err := openCatalog(j, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(f)
+}
+
+// catalogProgress is kept in the meta bucket while a generation is being catalogued. Batches are committed as the
+// walk goes, so if it is interrupted the versions it added or extended are rolled back before the next one.
+type catalogProgress struct {
+	Generation   string    `json:"generation"`
+	Previous     string    `json:"previous"`
+	PreviousTime time.Time `json:"previous_time"`
+}
+
+var catalogProgressKey = []byte("inprogress")
+
+// rollbackCatalog undoes the batches of an interrupted catalogGeneration: versions it added are dropped and
+// versions it extended end at the previous generation again
+func rollbackCatalog(j *CephFSJob) error {
+	var p catalogProgress
+	err := updateCatalog(j, func(tx *bolt.Tx) error {
+		data := tx.Bucket(catalogMetaBucket).Get(catalogProgressKey)
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &p)
+	})
+	if err != nil || p.Generation == "" {
+		return err
+	}
+	logger.Warnf("Rolling back the interrupted cataloguing of CephFS job %s backup %s", j.Name, p.Generation)
+	var next []byte
+	for {
+		done := true
+		err := updateCatalog(j, func(tx *bolt.Tx) error {
+			b := tx.Bucket(catalogPathsBucket)
+			changed := map[string][]CatalogVersion{}
+			c := b.Cursor()
+			k, v := c.First()
+			if next != nil {
+				k, v = c.Seek(next)
+			}
+			for n := 0; k != nil; k, v = c.Next() {
+				if n >= catalogBatchSize {
+					next = append([]byte{}, k...)
+					done = false
+					break
+				}
+				n++
+				var vs []CatalogVersion
+				if err := json.Unmarshal(v, &vs); err != nil {
+					return err
+				}
+				last := len(vs) - 1
+				if last < 0 || vs[last].Last != p.Generation {
+					continue
+				}
+				if vs[last].First == p.Generation {
+					vs = vs[:last]
+				} else {
+					vs[last].Last, vs[last].LastTime = p.Previous, p.PreviousTime
+				}
+				changed[string(k)] = vs
+			}
+			// the bucket can't be changed while the cursor walks it
+			for path, vs := range changed {
+				if len(vs) == 0 {
+					if err := b.Delete([]byte(path)); err != nil {
+						return err
+					}
+					continue
+				}
+				data, err := json.Marshal(vs)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(path), data); err != nil {
+					return err
+				}
+			}
+			if !done {
+				return nil
+			}
+			return tx.Bucket(catalogMetaBucket).Delete(catalogProgressKey)
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// catalogEntry is a file in a generation being catalogued
+type catalogEntry struct {
+	Path  string
+	Size  int64
+	MTime time.Time
+	Hash  string
+}
+
+// catalogGeneration records every file of a generation that was just taken. A path's latest version is extended
+// to this generation if it is unchanged since the previous one, otherwise a new version is added.
+func catalogGeneration(j *CephFSJob, g *BackupGeneration) error {
+	err := updateCatalog(j, func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{catalogPathsBucket, catalogGenerationsBucket, catalogMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := rollbackCatalog(j); err != nil {
+		return err
+	}
+	var previous string
+	err = updateCatalog(j, func(tx *bolt.Tx) error {
+		if done := tx.Bucket(catalogGenerationsBucket).Get([]byte(g.Name)); done != nil {
+			return fmt.Errorf("generation already catalogued")
+		}
+		p := catalogProgress{Generation: g.Name, Previous: string(tx.Bucket(catalogMetaBucket).Get([]byte("last")))}
+		if data := tx.Bucket(catalogGenerationsBucket).Get([]byte(p.Previous)); data != nil {
+			var prev struct {
+				Time time.Time `json:"time"`
+			}
+			if err := json.Unmarshal(data, &prev); err != nil {
+				return err
+			}
+			p.PreviousTime = prev.Time
+		}
+		previous = p.Previous
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(catalogMetaBucket).Put(catalogProgressKey, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	var batch []catalogEntry
+	paths, versions := 0, 0
+	flush := func() error {
+		return updateCatalog(j, func(tx *bolt.Tx) error {
+			b := tx.Bucket(catalogPathsBucket)
+			for _, e := range batch {
+				var vs []CatalogVersion
+				if data := b.Get([]byte(e.Path)); data != nil {
+					if err := json.Unmarshal(data, &vs); err != nil {
+						return err
+					}
+				}
+				if n := len(vs) - 1; n >= 0 && vs[n].Last == previous && vs[n].Size == e.Size && vs[n].MTime.Equal(e.MTime) && vs[n].Hash == e.Hash {
+					vs[n].Last, vs[n].LastTime = g.Name, g.Time
+				} else {
+					vs = append(vs, CatalogVersion{Size: e.Size, MTime: e.MTime, Hash: e.Hash, First: g.Name, FirstTime: g.Time, Last: g.Name, LastTime: g.Time})
+					versions++
+				}
+				data, err := json.Marshal(vs)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(e.Path), data); err != nil {
+					return err
+				}
+			}
+			batch = batch[:0]
+			return nil
+		})
+	}
+	add := func(e catalogEntry) error {
+		paths++
+		batch = append(batch, e)
+		if len(batch) >= catalogBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	if err := walkGeneration(j, g, add); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	err = updateCatalog(j, func(tx *bolt.Tx) error {
+		data, _ := json.Marshal(map[string]interface{}{"time": g.Time, "paths": paths})
+		if err := tx.Bucket(catalogGenerationsBucket).Put([]byte(g.Name), data); err != nil {
+			return err
+		}
+		if err := tx.Bucket(catalogMetaBucket).Put([]byte("last"), []byte(g.Name)); err != nil {
+			return err
+		}
+		return tx.Bucket(catalogMetaBucket).Delete(catalogProgressKey)
+	})
+	logger.Infof("Catalogued %d paths of CephFS job %s backup %s, %d new versions", paths, j.Name, g.Name, versions)
+	metricCatalogPaths.WithLabelValues(j.Name).Set(float64(paths))
+	metricCatalogNewVersions.WithLabelValues(j.Name).Set(float64(versions))
+	return err
+}
+
+// walkGeneration calls f for every file in a generation. A repository snapshot is read from its tree, other
+// generations from the backup target, which for an RBD still matches the snapshot just taken of it.
+func walkGeneration(j *CephFSJob, g *BackupGeneration, f func(e catalogEntry) error) error {
+	if j.Engine == "repo" {
+		repo, err := openRepository(j.Repository)
+		if err != nil {
+			return err
+		}
+		snap, err := repo.findSnapshot(j.Name, g.Name)
+		if err != nil {
+			return err
+		}
+		return repo.walkTree(snap, func(n *RepoNode) error {
+			if n.Type != "file" {
+				return nil
+			}
+			e := catalogEntry{Path: n.Path, Size: n.Size, MTime: n.MTime}
+			if cephfsCatalogHash {
+				// the chunk ids already identify the content
+				h := sha256.Sum256([]byte(strings.Join(n.Chunks, ",")))
+				e.Hash = hex.EncodeToString(h[:])
+			}
+			return f(e)
+		})
+	}
+
+	root := j.Target
+	if j.Engine == "generations" {
+		root = filepath.Join(j.Target, g.Name)
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if isShuttingDown() {
+			return fmt.Errorf("interrupted by shutdown")
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		e := catalogEntry{Path: rel, Size: info.Size(), MTime: info.ModTime()}
+		if cephfsCatalogHash {
+			if e.Hash, err = hashFile(path); err != nil {
+				logger.Warnf("Unable to hash %s for the catalog: %s", path, err.Error())
+			}
+		}
+		return f(e)
+	})
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// catalogRun catalogues the newest generation of a job if it was taken after the run started
+func catalogRun(j *CephFSJob, started time.Time) {
+	gens, err := cephfsGenerations(j)
+	if err != nil {
+		logger.Errorf("Unable to catalog CephFS job %s: %s", j.Name, err.Error())
+		return
+	}
+	if len(gens) == 0 || gens[len(gens)-1].Time.Before(started.Truncate(time.Minute)) {
+		logger.Infof("No new backup of CephFS job %s to catalog", j.Name)
+		return
+	}
+	if err := catalogGeneration(j, gens[len(gens)-1]); err != nil {
+		logger.Errorf("Unable to catalog CephFS job %s backup %s: %s", j.Name, gens[len(gens)-1].Name, err.Error())
+	}
+	if err := pruneCatalog(j, gens); err != nil {
+		logger.Errorf("Unable to prune the catalog of CephFS job %s: %s", j.Name, err.Error())
+	}
+}
+
+// catalogVersionKept tells if a version was unchanged in any of the generations still kept
+func catalogVersionKept(ver CatalogVersion, gens []*BackupGeneration) bool {
+	for _, g := range gens {
+		if !g.Time.Before(ver.FirstTime) && !g.Time.After(ver.LastTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneCatalog drops the versions of paths that no kept generation holds any more, and the paths left without
+// versions. It works through the paths a batch at a time, so searches are only held up for one batch.
+func pruneCatalog(j *CephFSJob, gens []*BackupGeneration) error {
+	kept := map[string]bool{}
+	for _, g := range gens {
+		kept[g.Name] = true
+	}
+	var next []byte
+	versions, paths := 0, 0
+	for {
+		done := true
+		err := updateCatalog(j, func(tx *bolt.Tx) error {
+			b := tx.Bucket(catalogPathsBucket)
+			if b == nil {
+				return nil
+			}
+			changed := map[string][]CatalogVersion{}
+			c := b.Cursor()
+			k, v := c.First()
+			if next != nil {
+				k, v = c.Seek(next)
+			}
+			for n := 0; k != nil; k, v = c.Next() {
+				if n >= catalogBatchSize {
+					next = append([]byte{}, k...)
+					done = false
+					break
+				}
+				n++
+				var vs []CatalogVersion
+				if err := json.Unmarshal(v, &vs); err != nil {
+					return err
+				}
+				keep := vs[:0]
+				for _, ver := range vs {
+					if catalogVersionKept(ver, gens) {
+						keep = append(keep, ver)
+					}
+				}
+				if len(keep) < len(vs) {
+					versions += len(vs) - len(keep)
+					changed[string(k)] = keep
+				}
+			}
+			// the bucket can't be changed while the cursor walks it
+			for path, vs := range changed {
+				if len(vs) == 0 {
+					paths++
+					if err := b.Delete([]byte(path)); err != nil {
+						return err
+					}
+					continue
+				}
+				data, err := json.Marshal(vs)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(path), data); err != nil {
+					return err
+				}
+			}
+			if !done {
+				return nil
+			}
+			gb := tx.Bucket(catalogGenerationsBucket)
+			var expired [][]byte
+			gb.ForEach(func(k, v []byte) error {
+				if !kept[string(k)] {
+					expired = append(expired, append([]byte{}, k...))
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := gb.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+	if versions > 0 {
+		logger.Infof("Pruned %d path versions and %d paths of expired backups from the catalog of CephFS job %s", versions, paths, j.Name)
+	}
+	return nil
+}
+
+// catalogMatch matches a path against a search: a glob against the path or its base name, otherwise a substring
+func catalogMatch(pattern string, path string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		ok, _ := filepath.Match(pattern, filepath.Base(path))
+		return ok
+	}
+	return strings.Contains(path, pattern)
+}
+
+// searchCatalog returns up to limit path versions matching a pattern, with the generations each can still be
+// restored from
+func searchCatalog(j *CephFSJob, pattern string, limit int) ([]CatalogResult, error) {
+	if _, err := os.Stat(catalogFile(j)); os.IsNotExist(err) {
+		return nil, fmt.Errorf("CephFS job %s has no catalog yet", j.Name)
+	}
+	gens, err := cephfsGenerations(j)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openCatalog(j, true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	results := []CatalogResult{}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(catalogPathsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if len(results) >= limit || !catalogMatch(pattern, string(k)) {
+				return nil
+			}
+			var vs []CatalogVersion
+			if err := json.Unmarshal(v, &vs); err != nil {
+				return err
+			}
+			for _, ver := range vs {
+				r := CatalogResult{Path: string(k), Generations: []string{}, CatalogVersion: ver}
+				for _, g := range gens {
+					if !g.Time.Before(ver.FirstTime) && !g.Time.After(ver.LastTime) {
+						r.Generations = append(r.Generations, g.Name)
+					}
+				}
+				// versions of expired backups until the catalog is next pruned
+				if len(r.Generations) == 0 {
+					continue
+				}
+				results = append(results, r)
+			}
+			return nil
+		})
+	})
+	return results, err
+}
+
+// httpCatalog searches a catalog. Paths and file names are as sensitive as the backups, so it needs the same
+// users as /browse/.
+func httpCatalog(w http.ResponseWriter, r *http.Request) {
+	if !browseAuthorized(w, r) {
+		return
+	}
+	j, err := restoreJob(r.URL.Query().Get("job"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	results, err := searchCatalog(j, q, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+var catalogCmd = &cobra.Command{
+	Use:   "catalog",
+	Short: "Search the catalog of files in CephFS backups",
+}
+
+var catalogSearchCmd = &cobra.Command{
+	Use:   "search <pattern>",
+	Short: "Find the versions of paths matching a glob or substring, and the backups holding them",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		j, err := restoreJob(catalogSearchJob)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		results, err := searchCatalog(j, args[0], catalogSearchLimit)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tSIZE\tMTIME\tFIRST SEEN\tLAST SEEN\tBACKUPS")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", r.Path, r.Size, r.MTime.Format(time.RFC3339),
+				r.FirstTime.Format(time.RFC3339), r.LastTime.Format(time.RFC3339), strings.Join(r.Generations, ","))
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	catalogCmd.PersistentFlags().StringVar(&catalogSearchJob, "job", "", "CephFS job name, needed when there is more than one job")
+	catalogSearchCmd.Flags().IntVar(&catalogSearchLimit, "limit", 100, "Maximum number of paths to return")
+	catalogCmd.AddCommand(catalogSearchCmd)
+	cephfsCmd.AddCommand(catalogCmd)
+}
@@ -2,48 +2,72 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/alexflint/go-filemutex"
 	"github.com/prometheus/client_golang/prometheus"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sync"
 	"time"
 )
 
 var cephFSSnapshotRegex = "cephfs_[0-9]{4}-[0-9]{2}-[0-9]{2}_[0-9]{2}:[0-9]{2}"
-var cephFSLastSuccess time.Time
 var rsyncLogFileFormat = "2006-01-02_15:04"
 
 var (
-	metricCephFSSnapshotsCreated = prometheus.NewCounter(
+	metricCephFSSnapshotsCreated = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "cephback_cephfs_snapshots_created",
 			Help: "The number of snapshots created",
 		},
+		[]string{"cephfs_job"},
 	)
-	metricCephFSSnapshotsDeleted = prometheus.NewCounter(
+	metricCephFSSnapshotsDeleted = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "cephback_cephfs_snapshots_deleted",
 			Help: "The number of snapshots deleted",
 		},
+		[]string{"cephfs_job"},
 	)
-	metricRsyncPerformed = prometheus.NewCounter(
+	metricRsyncPerformed = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "cephback_cephfs_rsync_performed",
 			Help: "How many rsyncs we have performed",
 		},
+		[]string{"cephfs_job"},
 	)
-	metricCephFSRsyncLastSuccess = prometheus.NewGauge(
+	metricCephFSRsyncLastSuccess = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "cephback_cephfs_rsync_last_success",
 			Help: "The epoch timestamp of the last successful CephFS rsync",
 		},
+		[]string{"cephfs_job"},
 	)
-	metricCephFSRsyncRunning = prometheus.NewGauge(
+	metricCephFSRsyncRunning = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "cephback_cephfs_rsync_running",
 			Help: "Whether the CephFS rsync is running",
 		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncInterrupted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cephback_cephfs_rsync_interrupted",
+			Help: "How many rsyncs were interrupted by a shutdown",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSNativeSnapshotsCreated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_cephfs_native_snapshots_created",
+			Help: "The number of native CephFS snapshots created as an rsync source",
+		},
+	)
+	metricCephFSNativeSnapshotsPruned = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_cephfs_native_snapshots_pruned",
+			Help: "The number of orphaned native CephFS snapshots removed",
+		},
 	)
 	metricCephFSSpaceUsed = prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{
@@ -51,18 +75,6 @@ var (
 			Help: "Number of bytes used on CephFS",
 		}, func() float64 { return float64(cephfsSpaceUsed(cephfsMount)) },
 	)
-	metricCephFSBackupRBDSpaceUsed = prometheus.NewGaugeFunc(
-		prometheus.GaugeOpts{
-			Name: "cephback_cephfs_backup_rbd_used_bytes",
-			Help: "Number of bytes used on the CephFS backup RBD",
-		}, func() float64 { return float64(DiskUsage(backupMount).Used) },
-	)
-	metricCephFSBackupRBDSpaceFree = prometheus.NewGaugeFunc(
-		prometheus.GaugeOpts{
-			Name: "cephback_cephfs_backup_rbd_free_bytes",
-			Help: "Number of bytes free on the CephFS backup RBD",
-		}, func() float64 { return float64(DiskUsage(backupMount).Free) },
-	)
 )
 
 func init() {
@@ -71,36 +83,33 @@ func init() {
 	prometheus.MustRegister(metricRsyncPerformed)
 	prometheus.MustRegister(metricCephFSRsyncLastSuccess)
 	prometheus.MustRegister(metricCephFSRsyncRunning)
+	prometheus.MustRegister(metricCephFSRsyncInterrupted)
+	prometheus.MustRegister(metricCephFSNativeSnapshotsCreated)
+	prometheus.MustRegister(metricCephFSNativeSnapshotsPruned)
 	prometheus.MustRegister(metricCephFSSpaceUsed)
-	prometheus.MustRegister(metricCephFSBackupRBDSpaceUsed)
-	prometheus.MustRegister(metricCephFSBackupRBDSpaceFree)
 }
 
-func cephfsSpaceUsed(path string) int64 {
-	dir, err := os.Open(path)
-	if err != nil {
-		logger.Errorf("Unable to read CephFS directory to get space used: %s", err.Error())
-		return 0
-	}
-	fi, err := dir.Stat()
+// cephfsSpaceUsed returns the bytes stored below a CephFS directory, from its recursive ceph.dir.rbytes
+func cephfsSpaceUsed(path string) uint64 {
+	stats, err := cephfsDirStats(path)
 	if err != nil {
-		logger.Errorf("Unable to stat CephFS directory to get space used: %s", err.Error())
+		logger.Errorf("Unable to get CephFS space used: %s", err.Error())
 		return 0
 	}
-	return fi.Size()
+	return stats.Bytes
 }
 
-func pruneRsyncLogs() bool {
-	// iterate through rsync logs and remove older than 7 days
+func pruneRsyncLogs(j *CephFSJob) bool {
+	// iterate through rsync logs and remove older than the job's snapshot retention
 
-	files, err := ioutil.ReadDir(backupMount)
+	files, err := ioutil.ReadDir(j.BackupMount)
 	if err != nil {
-		logger.Errorf("Error reading %s directory:%s", backupMount, err.Error())
+		logger.Errorf("Error reading %s directory:%s", j.BackupMount, err.Error())
 		return false
 	}
 
+	re := regexp.MustCompile("^" + regexp.QuoteMeta(j.LogPrefix) + "([0-9]{4}-[0-9]{2}-[0-9]{2}_[0-9]{2}:[0-9]{2})\\.log(\\.json|\\.enc)?$")
 	for _, file := range files {
-		re := regexp.MustCompile("rsync_([0-9]{4}-[0-9]{2}-[0-9]{2}_[0-9]{2}:[0-9]{2})\\.log")
 		timestamp := re.FindStringSubmatch(file.Name())
 		if timestamp == nil {
 			continue
@@ -111,8 +120,8 @@ func pruneRsyncLogs() bool {
 			continue
 		}
 
-		if time.Since(age) > cephfsSnapAgeMax {
-			filepath := fmt.Sprintf("%s/%s", backupMount, file.Name())
+		if time.Since(age) > j.SnapAgeMax {
+			filepath := fmt.Sprintf("%s/%s", j.BackupMount, file.Name())
 			err = os.Remove(filepath)
 			if err == nil {
 				logger.Infof("Deleted log file %s", filepath)
@@ -124,11 +133,171 @@ func pruneRsyncLogs() bool {
 	return true
 }
 
-func processCephFS() bool {
+// recordRsyncInterrupted appends a note to the rsync log so that a run killed by a shutdown is not mistaken for a complete one
+func recordRsyncInterrupted(j *CephFSJob, logFileName string) {
+	metricCephFSRsyncInterrupted.WithLabelValues(j.Name).Inc()
+	logger.Warnf("Rsync for CephFS job %s interrupted by shutdown, see %s", j.Name, logFileName)
+	f, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Errorf("Unable to record rsync interruption in %s: %s", logFileName, err.Error())
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s cephback: rsync interrupted by shutdown, backup is incomplete\n", time.Now().Format("2006/01/02 15:04:05"))
+}
+
+// CephFSSource is a directory to rsync and where in the backup it goes, Key is its path relative to the job's source.
+// LinkDest is the same directory in the previous generation to hard-link unchanged files against, if any.
+type CephFSSource struct {
+	Key      string
+	Src      string
+	Dst      string
+	LinkDest string
+}
+
+// cephfsSources returns what to copy for a job, taking native CephFS snapshots first if they are enabled.
+// The returned func removes the snapshots again and must always be called.
+func cephfsSources(j *CephFSJob) ([]CephFSSource, func(), error) {
+	if !cephfsSnapshots {
+		return []CephFSSource{{Src: j.SourcePath(), Dst: j.Target}}, func() {}, nil
+	}
+
+	snaps, err := createCephFSSnapshots(j, time.Now())
+	cleanup := func() { removeCephFSSnapshots(snaps) }
+	if err != nil {
+		return nil, cleanup, err
+	}
+	var sources []CephFSSource
+	for _, s := range snaps {
+		rel, _ := filepath.Rel(j.Source, s.Dir)
+		if rel == "." {
+			rel = ""
+		}
+		sources = append(sources, CephFSSource{Key: rel, Src: s.Path(), Dst: filepath.Join(j.Target, rel)})
+	}
+	return sources, cleanup, nil
+}
+
+// rsyncCephFS copies the job's source into its target, from native CephFS snapshots if they are enabled,
+// and returns true if every rsync succeeded. If linkDest is set unchanged files are hard-linked against it.
+func rsyncCephFS(j *CephFSJob, logFileName string, linkDest string) bool {
+	sources, cleanup, err := cephfsSources(j)
+	defer cleanup()
+	if err != nil {
+		logger.Errorf("Skipping rsync for CephFS job %s: %s", j.Name, err.Error())
+		return false
+	}
+	if linkDest != "" {
+		for i := range sources {
+			sources[i].LinkDest = filepath.Join(linkDest, sources[i].Key)
+		}
+	}
+	if !guardCephFS(j, sources) {
+		return false
+	}
+
+	var tasks []rsyncTask
+	for _, src := range sources {
+		t, err := rsyncTasks(src, j.ShardDepth)
+		if err != nil {
+			logger.Errorf("Skipping rsync for CephFS job %s: %s", j.Name, err.Error())
+			return false
+		}
+		tasks = append(tasks, t...)
+	}
+
+	var rctimes map[string]string
+	if j.RctimeSkip {
+		tasks, rctimes = skipUnchangedTasks(j, tasks)
+	}
+
+	failed := runRsyncTasks(j, tasks, logFileName)
+	if j.RctimeSkip && !isShuttingDown() {
+		recordRctimes(j, rctimes, failed)
+	}
+	return len(failed) == 0 && !isShuttingDown()
+}
+
+// cephfsLastSuccess returns the time of the job's last successful rsync, from the success file timestamp
+func cephfsLastSuccess(j *CephFSJob) time.Time {
+	if successFile, err := os.Stat(j.SuccessFile); err == nil {
+		return successFile.ModTime()
+	}
+	return time.Time{} // epoch 0
+}
+
+func touchSuccessFile(path string) {
+	var _, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		var file, err = os.Create(path)
+		if err != nil {
+			logger.Error("Rsync success file could not be created", err.Error())
+			return
+		}
+		file.Close()
+	} else {
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); err != nil {
+			logger.Error("There was an error updating the rsync success file timestamp:", err.Error())
+		}
+	}
+}
+
+// backupMountLocks serialise the RBD snapshot of a backup mount with the rsyncs of every job writing to it,
+// including jobs without an RBD of their own, so a snapshot never holds half a run
+var backupMountLocks = make(map[string]*sync.RWMutex)
+var backupMountLocksMutex sync.Mutex
+
+func backupMountLock(mount string) *sync.RWMutex {
+	backupMountLocksMutex.Lock()
+	defer backupMountLocksMutex.Unlock()
+	l, ok := backupMountLocks[mount]
+	if !ok {
+		l = &sync.RWMutex{}
+		backupMountLocks[mount] = l
+	}
+	return l
+}
+
+// rbdSnapPolicy returns the snapshot settings for the job's RBD. Every job with the same RBD shares its snapshots,
+// so the most conservative settings among them apply: the shortest snapshot interval, the longest age and the
+// highest count.
+func rbdSnapPolicy(j *CephFSJob) (ageMin time.Duration, ageMax time.Duration, countMin int) {
+	ageMin, ageMax, countMin = j.SnapAgeMin, j.SnapAgeMax, j.SnapCountMin
+	for _, o := range cephfsJobs {
+		if o.RbdName != j.RbdName {
+			continue
+		}
+		if o.SnapAgeMin < ageMin {
+			ageMin = o.SnapAgeMin
+		}
+		if o.SnapAgeMax > ageMax {
+			ageMax = o.SnapAgeMax
+		}
+		if o.SnapCountMin > countMin {
+			countMin = o.SnapCountMin
+		}
+	}
+	return ageMin, ageMax, countMin
+}
+
+func processCephFSJob(j *CephFSJob) bool {
 
 	CephConnInit()
 	var bail bool = false
 
+	logger.Infof("Processing CephFS job %s", j.Name)
+
+	if cephfsRbdManage && j.RbdName != "" {
+		if err := ensureBackupRbd(j); err != nil {
+			logger.Errorf("Unable to prepare backup RBD for CephFS job %s: %s", j.Name, err.Error())
+			// copying anyway could leave plain copies wherever the backup mount points to
+			if encryptionKeys != nil && j.Engine != "repo" {
+				return false
+			}
+		}
+	}
+
 	cephfsMounted, err := mounted(cephfsMount)
 	if err != nil {
 		logger.Error("CephFS mount check error:", err.Error())
@@ -139,76 +308,127 @@ func processCephFS() bool {
 		bail = true
 	}
 
-	backupMounted, err := mounted(backupMount)
+	backupMounted, err := mounted(j.BackupMount)
 	if err != nil {
 		logger.Error("Backup mount check error:", err.Error())
 		bail = true
 	}
 	if !backupMounted {
-		logger.Errorf("CephFS not mounted at %s", backupMount)
+		logger.Errorf("Backup not mounted at %s", j.BackupMount)
 		bail = true
 	}
 
 	if bail {
-		logger.Error("CephFS backup process failed due to mount errors")
+		logger.Errorf("CephFS job %s failed due to mount errors", j.Name)
 		return false
 	}
 
-	// look for last rsync success file timestamp /backup/last_success
-
-	if successFile, err := os.Stat(cephfsSuccessFile); err == nil {
-		cephFSLastSuccess = successFile.ModTime()
-	} else {
-		cephFSLastSuccess = time.Time{} // epoch 0
+	if guardBlocked(j) {
+		checkGuardHealth(j)
+		logger.Errorf("Skipping CephFS job %s, it was stopped by the mass-deletion guard and needs 'cephback cephfs guard ack'", j.Name)
+		return false
 	}
-	metricCephFSRsyncLastSuccess.Set(float64(cephFSLastSuccess.Unix()))
 
-	if time.Since(cephFSLastSuccess) > rsyncCephfsInterval {
-		m, err := filemutex.New(cephfsRsyncLock)
+	// look for last rsync success file timestamp
+	lastSuccess := cephfsLastSuccess(j)
+	metricCephFSRsyncLastSuccess.WithLabelValues(j.Name).Set(float64(lastSuccess.Unix()))
+
+	var succeeded bool
+	var started time.Time
+	mountLock := backupMountLock(j.BackupMount)
+	ran := time.Since(lastSuccess) > j.RsyncInterval
+	if ran {
+		lock, err := acquireLock(j.LockFile, cephfsRsyncLockWait)
 		if err != nil {
-			logger.Error("Rsync lock file could not created")
+			logger.Errorf("Skipping rsync for CephFS job %s: %s", j.Name, err.Error())
+			metricCephFSRsyncLockBusy.WithLabelValues(j.Name).Inc()
+			return false
 		}
+		mountLock.RLock()
 
-		m.Lock() // Will block until lock can be acquired - should consider whether to use the non-blocking method
+		metricCephFSRsyncRunning.WithLabelValues(j.Name).Set(1.0)
 
-		metricCephFSRsyncRunning.Set(1.0)
+		logFileName := fmt.Sprintf("%s/%s%s.log", j.BackupMount, j.LogPrefix, time.Now().Format(rsyncLogFileFormat))
 
-		logFileName := fmt.Sprintf("%s/rsync_%s.log", backupMount, time.Now().Format(rsyncLogFileFormat))
-
-		var cmdArgs []string
-		cmdArgs = append(cmdArgs, cephfsRsyncArgs...)
-		cmdArgs = append(cmdArgs, []string{
-			fmt.Sprintf("--log-file=%s", logFileName),
-			fmt.Sprintf("%s/", cephfsMount),
-			fmt.Sprintf("%s/backup/", backupMount),
-		}...)
+		var rsyncOk bool
+		report := &RsyncReport{}
+		started = time.Now()
+		switch j.Engine {
+		case "repo":
+			rsyncOk = backupCephFSToRepo(j, report)
+		case "generations":
+			rsyncOk = rsyncGeneration(j, logFileName)
+		default:
+			rsyncOk = rsyncCephFS(j, logFileName, "")
+		}
+		if isShuttingDown() {
+			recordRsyncInterrupted(j, logFileName)
+		} else if rsyncOk {
+			metricRsyncPerformed.WithLabelValues(j.Name).Inc()
+			touchSuccessFile(j.SuccessFile)
+			succeeded = true
+			clearGuardTrip(j)
+		}
+		metricCephFSRsyncRunning.WithLabelValues(j.Name).Set(0.0)
 
-		if execHelper("rsync", cmdArgs, cephfsRsyncValidExitCodes) {
-			metricRsyncPerformed.Inc()
-			// touch success file
-			var _, err = os.Stat(cephfsSuccessFile)
-			if os.IsNotExist(err) {
-				var file, err = os.Create(cephfsSuccessFile)
-				if err != nil {
-					logger.Error("Rsync success file could not be created", err.Error())
-				}
-				file.Close()
-			} else {
-				now := time.Now()
-				if err := os.Chtimes(cephfsSuccessFile, now, now); err != nil {
-					logger.Error("There was an error updating the rsync success file timestamp:", err.Error())
-				}
+		// the report is parsed from the log, so before it is encrypted
+		reportRsyncRun(j, logFileName, started, rsyncOk, report)
+		if _, err := os.Stat(logFileName); err == nil {
+			if err := sealFile(logFileName); err != nil {
+				logger.Errorf("Unable to encrypt rsync log %s: %s", logFileName, err.Error())
 			}
 		}
-		metricCephFSRsyncRunning.Set(0.0)
 
-		m.Unlock()
+		mountLock.RUnlock()
+		lock.release()
 	}
 
-	metricCephFSSnapshotsCreated.Add(float64(createSnap(cephfsRbdName, cephfsSnapAgeMin, true)))
-	metricCephFSSnapshotsDeleted.Add(float64(deleteSnap(cephfsRbdName, cephfsSnapAgeMax, cephfsSnapCountMin)))
+	if isShuttingDown() {
+		logger.Info("Skipping CephFS snapshot since we are shutting down")
+		return false
+	}
+	if guardBlocked(j) {
+		logger.Infof("Skipping CephFS snapshot and retention for job %s until the guard is acknowledged", j.Name)
+		return false
+	}
+
+	switch j.Engine {
+	case "repo":
+		pruneRepo(j)
+	case "generations":
+		pruneGenerations(j)
+	}
 
-	pruneRsyncLogs()
+	// jobs without an RBD of their own are covered by the snapshots of the job that owns the backup RBD,
+	// repo and generations jobs keep their own history
+	if j.RbdName != "" {
+		ageMin, ageMax, countMin := rbdSnapPolicy(j)
+		snapsAllowed := true
+		if poolHardLimitPct > 0 {
+			_, snapsAllowed = checkPoolBudget()
+		}
+		if snapsAllowed {
+			// waits for the rsyncs of every job writing to the mount, so only held while the snapshot is taken
+			mountLock.Lock()
+			metricCephFSSnapshotsCreated.WithLabelValues(j.Name).Add(float64(createSnap(j.RbdName, ageMin, j.BackupMount)))
+			mountLock.Unlock()
+		} else {
+			logger.Errorf("Skipping snapshot of %s for CephFS job %s, pool %s is above its hard limit", j.RbdName, j.Name, cephPool)
+		}
+		// the throttle may wait a long time, and deleting snapshots does not touch the mount
+		p := newDeletionPass("cephfs")
+		metricCephFSSnapshotsDeleted.WithLabelValues(j.Name).Add(float64(deleteSnap(j.RbdName, ageMax, countMin, p)))
+		p.done()
+	}
+
+	if succeeded && cephfsCatalog {
+		catalogRun(j, started)
+	}
+
+	pruneRsyncLogs(j)
+	if ran {
+		recordCapacity(j)
+	}
 
 	return true
 }
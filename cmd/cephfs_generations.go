@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// a generation is a directory under the job's target named after the time its run started, the latest symlink
+// points to the newest complete one and a run in progress writes to a .partial directory
+var generationsLatest = "latest"
+var generationsPartialSuffix = ".partial"
+var generationNameRegex = regexp.MustCompile(rbdSnapshotRegex)
+
+var (
+	metricCephFSGenerations = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_generations",
+			Help: "The number of complete generations kept for a generations engine CephFS job",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSGenerationsPruned = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cephback_cephfs_generations_pruned",
+			Help: "The number of generations removed by retention",
+		},
+		[]string{"cephfs_job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCephFSGenerations)
+	prometheus.MustRegister(metricCephFSGenerationsPruned)
+}
+
+// listGenerations returns the names of the job's complete generations, oldest first
+func listGenerations(j *CephFSJob) ([]string, error) {
+	entries, err := ioutil.ReadDir(j.Target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && generationNameRegex.MatchString(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// latestGeneration returns the name of the generation the latest symlink points to, or "" if there is none yet
+func latestGeneration(j *CephFSJob) string {
+	target, err := os.Readlink(filepath.Join(j.Target, generationsLatest))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// backupRoot returns the directory holding the job's latest complete backup
+func backupRoot(j *CephFSJob) string {
+	if j.Engine == "generations" {
+		return filepath.Join(j.Target, latestGeneration(j))
+	}
+	return j.Target
+}
+
+// rsyncGeneration copies the job's source into a new generation, hard-linking files unchanged since the latest
+// one, and points latest at it once every rsync has succeeded
+func rsyncGeneration(j *CephFSJob, logFileName string) bool {
+	name := time.Now().Format(layout)
+	dir := filepath.Join(j.Target, name)
+	partial := dir + generationsPartialSuffix
+	if _, err := os.Stat(dir); err == nil {
+		logger.Errorf("Generation %s of CephFS job %s already exists", dir, j.Name)
+		return false
+	}
+	if err := os.MkdirAll(j.Target, 0755); err != nil {
+		logger.Errorf("Unable to create %s: %s", j.Target, err.Error())
+		return false
+	}
+
+	// a partial generation left by a failed run is reused, so that what it copied is not copied again
+	entries, _ := ioutil.ReadDir(j.Target)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), generationsPartialSuffix) || e.Name() == filepath.Base(partial) {
+			continue
+		}
+		old := filepath.Join(j.Target, e.Name())
+		if _, err := os.Stat(partial); os.IsNotExist(err) {
+			logger.Infof("Continuing partial generation %s as %s", old, partial)
+			if err := os.Rename(old, partial); err == nil {
+				continue
+			}
+		}
+		logger.Infof("Removing partial generation %s", old)
+		os.RemoveAll(old)
+	}
+
+	linkDest := ""
+	if latest := latestGeneration(j); latest != "" {
+		linkDest = filepath.Join(j.Target, latest)
+	}
+	gj := *j
+	gj.Target = partial
+	if !rsyncCephFS(&gj, logFileName, linkDest) {
+		return false
+	}
+
+	if err := os.Rename(partial, dir); err != nil {
+		logger.Errorf("Unable to complete generation %s: %s", dir, err.Error())
+		return false
+	}
+	tmp := filepath.Join(j.Target, "."+generationsLatest+".tmp")
+	os.Remove(tmp)
+	if err := os.Symlink(name, tmp); err != nil {
+		logger.Errorf("Unable to point %s at generation %s: %s", generationsLatest, name, err.Error())
+		return false
+	}
+	if err := os.Rename(tmp, filepath.Join(j.Target, generationsLatest)); err != nil {
+		logger.Errorf("Unable to point %s at generation %s: %s", generationsLatest, name, err.Error())
+		return false
+	}
+	logger.Infof("Generation %s of CephFS job %s complete", name, j.Name)
+	return true
+}
+
+// pruneGenerations removes generations older than the job's snap-age-max, keeping at least snap-count-min and
+// never the one latest points to
+func pruneGenerations(j *CephFSJob) {
+	names, err := listGenerations(j)
+	if err != nil {
+		logger.Errorf("Unable to list generations of CephFS job %s: %s", j.Name, err.Error())
+		return
+	}
+	latest := latestGeneration(j)
+	remaining := len(names)
+	for _, name := range names {
+		if remaining <= j.SnapCountMin {
+			break
+		}
+		t, err := time.ParseInLocation(layout, name, time.Local)
+		if err != nil || name == latest || time.Since(t) <= j.SnapAgeMax {
+			continue
+		}
+		dir := filepath.Join(j.Target, name)
+		logger.Infof("Removing generation %s of CephFS job %s", dir, j.Name)
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Errorf("Unable to remove generation %s: %s", dir, err.Error())
+			continue
+		}
+		remaining--
+		metricCephFSGenerationsPruned.WithLabelValues(j.Name).Inc()
+	}
+	metricCephFSGenerations.WithLabelValues(j.Name).Set(float64(remaining))
+}
+
+// generationDir returns the directory of a generation, checking it is one
+func generationDir(j *CephFSJob, name string) (string, error) {
+	if !generationNameRegex.MatchString(name) {
+		return "", fmt.Errorf("%s is not a generation of CephFS job %s", name, j.Name)
+	}
+	return filepath.Join(j.Target, name), nil
+}
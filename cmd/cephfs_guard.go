@@ -0,0 +1,411 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/ceph/go-ceph/rbd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var guardJobName string
+var guardRemoveSnapshot bool
+
+// protective snapshots are named so that retention, which only matches plain timestamps, never removes them
+var guardSnapshotPrefix = "guard_"
+
+var (
+	metricCephFSGuardTripped = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_guard_tripped",
+			Help: "Whether a CephFS job is stopped by the mass-deletion guard until it is acknowledged",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSGuardDeletes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_guard_files_deleted",
+			Help: "The number of files the last CephFS rsync dry run would have deleted from the backup",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSGuardChangedBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_guard_changed_bytes",
+			Help: "The number of bytes the last CephFS rsync dry run would have transferred",
+		},
+		[]string{"cephfs_job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCephFSGuardTripped)
+	prometheus.MustRegister(metricCephFSGuardDeletes)
+	prometheus.MustRegister(metricCephFSGuardChangedBytes)
+}
+
+// GuardTrip records a CephFS run stopped by the mass-deletion guard, it is stored next to the success file
+// and the job does nothing until it is acknowledged
+type GuardTrip struct {
+	Job                  string    `json:"job"`
+	Tripped              time.Time `json:"tripped"`
+	Reasons              []string  `json:"reasons"`
+	FilesDeleted         int64     `json:"files_deleted"`
+	TransferredBytes     int64     `json:"transferred_bytes"`
+	PrevFilesDeleted     int64     `json:"prev_files_deleted"`
+	PrevTransferredBytes int64     `json:"prev_transferred_bytes"`
+	Image                string    `json:"image,omitempty"`
+	Snapshot             string    `json:"snapshot,omitempty"`
+	Acknowledged         bool      `json:"acknowledged"`
+	AcknowledgedTime     time.Time `json:"acknowledged_time,omitempty"`
+}
+
+func guardFile(j *CephFSJob) string {
+	return j.SuccessFile + ".guard"
+}
+
+// readGuardTrip returns the job's guard trip, or nil if the guard has not tripped
+func readGuardTrip(j *CephFSJob) (*GuardTrip, error) {
+	if _, err := os.Stat(guardFile(j)); os.IsNotExist(err) {
+		return nil, nil
+	}
+	t := &GuardTrip{}
+	if err := readState(guardFile(j), t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// guardLimit is the most a dry run may show before the guard trips: the larger of the minimum and
+// factor times what the previous successful run did
+func guardLimit(min int64, factor float64, prev int64) int64 {
+	if limit := int64(factor * float64(prev)); limit > min {
+		return limit
+	}
+	return min
+}
+
+// dryRunRsync runs rsync with --dry-run over the same shards and on as many workers as the run itself, and sums
+// the deletions and changes it would make
+func dryRunRsync(j *CephFSJob, sources []CephFSSource) (*RsyncReport, error) {
+	r := &RsyncReport{Job: j.Name, Started: time.Now()}
+	var tasks []rsyncTask
+	for _, src := range sources {
+		t, err := rsyncTasks(src, j.ShardDepth)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t...)
+	}
+
+	var wg sync.WaitGroup
+	var reportMutex sync.Mutex
+	var firstErr error
+	queue := make(chan rsyncTask)
+	workers := j.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				stdout, err := dryRunRsyncTask(j, t)
+				reportMutex.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				for _, line := range strings.Split(stdout, "\n") {
+					if kv := strings.SplitN(line, ": ", 2); len(kv) == 2 {
+						addRsyncStat(r, kv[0], kv[1])
+					}
+				}
+				reportMutex.Unlock()
+			}
+		}()
+	}
+	for _, t := range tasks {
+		reportMutex.Lock()
+		stop := firstErr != nil
+		reportMutex.Unlock()
+		if stop || isShuttingDown() {
+			break
+		}
+		queue <- t
+	}
+	close(queue)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if isShuttingDown() {
+		return nil, fmt.Errorf("interrupted by shutdown")
+	}
+	r.Finished = time.Now()
+	r.DurationSeconds = r.Finished.Sub(r.Started).Seconds()
+	return r, nil
+}
+
+// dryRunRsyncTask runs rsync with --dry-run for one shard and returns its output
+func dryRunRsyncTask(j *CephFSJob, t rsyncTask) (string, error) {
+	// a new generation is compared with the one before it, not with its empty directory
+	dst := t.Dst
+	if t.LinkDest != "" {
+		dst = t.LinkDest
+	}
+	var cmdArgs []string
+	cmdArgs = append(cmdArgs, j.RsyncArgs...)
+	if !t.Recursive {
+		cmdArgs = append(cmdArgs, "--no-recursive", "--dirs")
+	}
+	cmdArgs = append(cmdArgs, []string{
+		"--dry-run",
+		"--stats",
+		"--no-human-readable",
+		fmt.Sprintf("%s/", t.Src),
+		fmt.Sprintf("%s/", dst),
+	}...)
+	exitCode, stdout, err := execCommand("rsync", cmdArgs)
+	if !validExitCode(exitCode, j.RsyncValidExitCodes) {
+		if err != nil {
+			return "", fmt.Errorf("rsync dry run of %s returned an error: %s", t.Src, err.Error())
+		}
+		return "", fmt.Errorf("rsync dry run of %s returned exit code %d", t.Src, exitCode)
+	}
+	return stdout, nil
+}
+
+// guardCephFS runs a dry run of the rsync and compares it with the job's previous successful run. If it would
+// delete or change too much the guard trips: it returns false, protects the current backup with a snapshot and
+// stops the job until someone acknowledges the trip.
+func guardCephFS(j *CephFSJob, sources []CephFSSource) bool {
+	if !cephfsGuard {
+		return true
+	}
+	if t, err := readGuardTrip(j); err != nil {
+		logger.Errorf("Unable to read guard state of CephFS job %s: %s", j.Name, err.Error())
+		return false
+	} else if t != nil && t.Acknowledged {
+		logger.Warnf("Skipping mass-deletion guard for CephFS job %s, acknowledged at %s", j.Name, t.AcknowledgedTime)
+		return true
+	}
+
+	prev, err := latestRsyncReport(j)
+	if err != nil {
+		logger.Errorf("Unable to read previous rsync report of CephFS job %s: %s", j.Name, err.Error())
+		return false
+	}
+	if prev == nil {
+		logger.Infof("Skipping mass-deletion guard for CephFS job %s, there is no previous successful run to compare with", j.Name)
+		return true
+	}
+
+	logger.Infof("Running rsync dry run for CephFS job %s", j.Name)
+	dry, err := dryRunRsync(j, sources)
+	if err != nil {
+		logger.Errorf("Mass-deletion guard for CephFS job %s failed: %s", j.Name, err.Error())
+		return false
+	}
+	metricCephFSGuardDeletes.WithLabelValues(j.Name).Set(float64(dry.FilesDeleted))
+	metricCephFSGuardChangedBytes.WithLabelValues(j.Name).Set(float64(dry.TransferredBytes))
+
+	var reasons []string
+	if cephfsGuardDeletesMin > 0 {
+		if limit := guardLimit(cephfsGuardDeletesMin, cephfsGuardDeletesFactor, prev.FilesDeleted); dry.FilesDeleted > limit {
+			reasons = append(reasons, fmt.Sprintf("%d files would be deleted, limit %d (previous run deleted %d)", dry.FilesDeleted, limit, prev.FilesDeleted))
+		}
+	}
+	if cephfsGuardChangedMin > 0 {
+		if limit := guardLimit(int64(cephfsGuardChangedMin), cephfsGuardChangedFactor, prev.TransferredBytes); dry.TransferredBytes > limit {
+			reasons = append(reasons, fmt.Sprintf("%d bytes would be transferred, limit %d (previous run transferred %d)", dry.TransferredBytes, limit, prev.TransferredBytes))
+		}
+	}
+	if len(reasons) == 0 {
+		logger.Infof("Mass-deletion guard passed for CephFS job %s: %d files to delete, %d bytes to transfer", j.Name, dry.FilesDeleted, dry.TransferredBytes)
+		return true
+	}
+
+	t := &GuardTrip{
+		Job:                  j.Name,
+		Tripped:              time.Now(),
+		Reasons:              reasons,
+		FilesDeleted:         dry.FilesDeleted,
+		TransferredBytes:     dry.TransferredBytes,
+		PrevFilesDeleted:     prev.FilesDeleted,
+		PrevTransferredBytes: prev.TransferredBytes,
+	}
+	if image := backupRbd(j); image != "" {
+		if snap, err := createGuardSnap(image, j.BackupMount); err != nil {
+			logger.Errorf("Unable to take protective snapshot of %s for CephFS job %s: %s", image, j.Name, err.Error())
+		} else {
+			t.Image = image
+			t.Snapshot = snap
+		}
+	}
+	if err := writeState(guardFile(j), t); err != nil {
+		logger.Errorf("Unable to write guard state of CephFS job %s: %s", j.Name, err.Error())
+	}
+	checkGuardHealth(j)
+	logger.Errorf("Mass-deletion guard stopped CephFS job %s: %s. Check the source, then run 'cephback cephfs guard ack --job %s'",
+		j.Name, strings.Join(reasons, "; "), j.Name)
+	return false
+}
+
+// createGuardSnap takes and protects a snapshot of the backup RBD, with the filesystem on it frozen
+func createGuardSnap(imageName string, freezeMount string) (string, error) {
+	snapName := guardSnapshotPrefix + time.Now().Format(layout)
+	logger.Infof("Creating protective snapshot %s@%s", imageName, snapName)
+
+	if !freezeFS(freezeMount) {
+		return "", fmt.Errorf("Unable to freeze %s", freezeMount)
+	}
+	img := rbd.GetImage(iocx, imageName)
+	if err := img.Open(); err != nil {
+		thawFS(freezeMount)
+		return "", err
+	}
+	defer img.Close()
+	s, err := img.CreateSnapshot(snapName)
+	thawFS(freezeMount)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Protect(); err != nil {
+		return snapName, fmt.Errorf("Snapshot %s@%s created but not protected: %s", imageName, snapName, err.Error())
+	}
+	return snapName, nil
+}
+
+// removeGuardSnap unprotects and removes a protective snapshot
+func removeGuardSnap(imageName string, snapName string) error {
+	img := rbd.GetImage(iocx, imageName)
+	if err := img.Open(); err != nil {
+		return err
+	}
+	defer img.Close()
+	s := img.GetSnapshot(snapName)
+	if protected, _ := s.IsProtected(); protected {
+		if err := s.Unprotect(); err != nil {
+			return err
+		}
+	}
+	return s.Remove()
+}
+
+// checkGuardHealth marks the job critical while it is stopped by the guard
+func checkGuardHealth(j *CephFSJob) {
+	t, err := readGuardTrip(j)
+	if err != nil {
+		logger.Errorf("Unable to read guard state of CephFS job %s: %s", j.Name, err.Error())
+		return
+	}
+	if t == nil || t.Acknowledged {
+		metricCephFSGuardTripped.WithLabelValues(j.Name).Set(0)
+		health.Set("cephfs-guard-"+j.Name, "")
+		return
+	}
+	metricCephFSGuardTripped.WithLabelValues(j.Name).Set(1)
+	msg := fmt.Sprintf("CRITICAL: CephFS job %s stopped by the mass-deletion guard at %s: %s", j.Name, t.Tripped.Format(time.RFC3339), strings.Join(t.Reasons, "; "))
+	if t.Snapshot != "" {
+		msg += fmt.Sprintf(", backup protected by snapshot %s@%s", t.Image, t.Snapshot)
+	}
+	health.Set("cephfs-guard-"+j.Name, msg)
+}
+
+// guardBlocked returns true if the job is stopped by an unacknowledged guard trip
+func guardBlocked(j *CephFSJob) bool {
+	t, err := readGuardTrip(j)
+	if err != nil {
+		logger.Errorf("Unable to read guard state of CephFS job %s: %s", j.Name, err.Error())
+		return true
+	}
+	return t != nil && !t.Acknowledged
+}
+
+// clearGuardTrip removes an acknowledged trip once a run has succeeded
+func clearGuardTrip(j *CephFSJob) {
+	if err := os.Remove(guardFile(j)); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Unable to remove guard state of CephFS job %s: %s", j.Name, err.Error())
+	}
+	checkGuardHealth(j)
+}
+
+var guardCmd = &cobra.Command{
+	Use:   "guard",
+	Short: "Work with CephFS jobs stopped by the mass-deletion guard",
+}
+
+var guardStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether a CephFS job is stopped by the mass-deletion guard and why",
+	Run: func(cmd *cobra.Command, args []string) {
+		j, err := restoreJob(guardJobName)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		t, err := readGuardTrip(j)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		if t == nil {
+			fmt.Printf("CephFS job %s is not stopped by the guard\n", j.Name)
+			return
+		}
+		fmt.Printf("CephFS job %s stopped by the guard at %s\n", j.Name, t.Tripped.Format(time.RFC3339))
+		for _, r := range t.Reasons {
+			fmt.Printf("  %s\n", r)
+		}
+		if t.Snapshot != "" {
+			fmt.Printf("Protective snapshot: %s@%s\n", t.Image, t.Snapshot)
+		}
+		if t.Acknowledged {
+			fmt.Printf("Acknowledged at %s, the next run will proceed\n", t.AcknowledgedTime.Format(time.RFC3339))
+		}
+	},
+}
+
+var guardAckCmd = &cobra.Command{
+	Use:   "ack",
+	Short: "Let a CephFS job stopped by the mass-deletion guard run, mirroring the deletions into the backup",
+	Run: func(cmd *cobra.Command, args []string) {
+		j, err := restoreJob(guardJobName)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		t, err := readGuardTrip(j)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		if t == nil {
+			logger.Fatalf("CephFS job %s is not stopped by the guard", j.Name)
+		}
+		if guardRemoveSnapshot && t.Snapshot != "" {
+			if err := CephConnInit(); err != nil {
+				logger.Fatal(err.Error())
+			}
+			if err := removeGuardSnap(t.Image, t.Snapshot); err != nil {
+				logger.Fatalf("Unable to remove protective snapshot %s@%s: %s", t.Image, t.Snapshot, err.Error())
+			}
+			logger.Infof("Removed protective snapshot %s@%s", t.Image, t.Snapshot)
+			t.Snapshot = ""
+		}
+		t.Acknowledged = true
+		t.AcknowledgedTime = time.Now()
+		if err := writeState(guardFile(j), t); err != nil {
+			logger.Fatal(err.Error())
+		}
+		logger.Infof("Acknowledged guard trip of CephFS job %s, its next run will proceed", j.Name)
+	},
+}
+
+func init() {
+	guardCmd.PersistentFlags().StringVar(&guardJobName, "job", "", "CephFS job name, needed when there is more than one job")
+	guardAckCmd.Flags().BoolVar(&guardRemoveSnapshot, "remove-snapshot", false, "Also remove the protective snapshot taken when the guard tripped")
+	guardCmd.AddCommand(guardStatusCmd)
+	guardCmd.AddCommand(guardAckCmd)
+	cephfsCmd.AddCommand(guardCmd)
+}
@@ -0,0 +1,321 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron"
+	"github.com/spf13/viper"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cephfsJobNameRegex = regexp.MustCompile("^[a-z0-9][a-z0-9-]*$")
+
+// CephFSJob is a named CephFS backup with its own source, target, schedule and retention
+type CephFSJob struct {
+	Name                string
+	Source              string // relative to cephfs-mount
+	BackupMount         string
+	Target              string // where rsync writes to, below BackupMount
+	RbdName             string // snapshotted after each run, the RBD mounted at BackupMount
+	RsyncArgs           []string
+	RsyncValidExitCodes []int
+	Schedule            string
+	RsyncInterval       time.Duration
+	SnapCountMin        int
+	SnapAgeMin          time.Duration
+	SnapAgeMax          time.Duration
+	SuccessFile         string
+	LockFile            string
+	LogPrefix           string
+	SnapshotDirs        []string // relative to Source
+	ShardDepth          int
+	Workers             int
+	RctimeSkip          bool
+	Engine              string // rsync, repo to back up into a deduplicating repository, or generations of hard-linked copies
+	Repository          string
+}
+
+// checkEngine checks the job's engine is known and its settings work with it
+func (j *CephFSJob) checkEngine() error {
+	switch j.Engine {
+	case "rsync", "repo":
+	case "generations":
+		// shards skipped as unchanged would be missing from the new generation
+		if j.RctimeSkip {
+			return fmt.Errorf("rctime-skip cannot be used with the generations engine")
+		}
+	default:
+		return fmt.Errorf("engine '%s' must be rsync, repo or generations", j.Engine)
+	}
+	return nil
+}
+
+// SourcePath returns the absolute path of the job's source on CephFS
+func (j *CephFSJob) SourcePath() string {
+	return filepath.Join(cephfsMount, j.Source)
+}
+
+// cephfsJobConfig is a job as it appears in the cephfs-jobs config, unset fields take the global setting
+type cephfsJobConfig struct {
+	Name                string   `mapstructure:"name"`
+	Source              string   `mapstructure:"source"`
+	BackupMount         string   `mapstructure:"backup-mount"`
+	Target              string   `mapstructure:"target"`
+	RbdName             string   `mapstructure:"rbd-name"`
+	RsyncArgs           []string `mapstructure:"rsync-args"`
+	RsyncValidExitCodes []string `mapstructure:"rsync-valid-exit-codes"`
+	Schedule            string   `mapstructure:"schedule"`
+	RsyncInterval       string   `mapstructure:"rsync-interval"`
+	SnapCountMin        *int     `mapstructure:"snap-count-min"`
+	SnapAgeMin          string   `mapstructure:"snap-age-min"`
+	SnapAgeMax          string   `mapstructure:"snap-age-max"`
+	SuccessFile         string   `mapstructure:"success-file"`
+	LockFile            string   `mapstructure:"lock-file"`
+	SnapshotDirs        []string `mapstructure:"snapshot-dirs"`
+	ShardDepth          *int     `mapstructure:"shard-depth"`
+	Workers             *int     `mapstructure:"rsync-workers"`
+	RctimeSkip          *bool    `mapstructure:"rctime-skip"`
+	Engine              string   `mapstructure:"engine"`
+	Repository          string   `mapstructure:"repository"`
+}
+
+// cephfsJobsSettingParser builds the CephFS jobs from the cephfs-jobs setting. If none are configured a single
+// job named default is built from the global cephfs settings, which backs up the whole of cephfs-mount as before.
+func cephfsJobsSettingParser() (jobs []*CephFSJob, errs []error) {
+	var raw []cephfsJobConfig
+	if err := viper.UnmarshalKey("cephfs-jobs", &raw); err != nil {
+		return nil, []error{fmt.Errorf("Unable to parse 'cephfs-jobs' setting: %s", err.Error())}
+	}
+
+	if len(raw) == 0 {
+		snapshotDirs, _ := relativeDirsSettingParser("cephfs-snapshot-dirs")
+		j := &CephFSJob{
+			Name:         "default",
+			BackupMount:  viper.GetString("backup-mount"),
+			Target:       filepath.Join(viper.GetString("backup-mount"), "backup"),
+			RbdName:      viper.GetString("cephfs-rbd-name"),
+			RsyncArgs:    viper.GetStringSlice("cephfs-rsync-args"),
+			Schedule:     viper.GetString("cephfs-interval"),
+			SnapCountMin: viper.GetInt("cephfs-snap-count-min"),
+			SuccessFile:  viper.GetString("cephfs-success-file"),
+			LockFile:     viper.GetString("cephfs-rsync-lock"),
+			LogPrefix:    "rsync_",
+			SnapshotDirs: snapshotDirs,
+		}
+		j.RsyncValidExitCodes, _ = exitCodesSettingParser("cephfs-rsync-valid-exit-codes")
+		j.RsyncInterval, _ = durationSettingParser("cephfs-rsync-interval")
+		j.SnapAgeMin, _ = durationSettingParser("cephfs-snap-age-min")
+		j.SnapAgeMax, _ = durationSettingParser("cephfs-snap-age-max")
+		j.ShardDepth = viper.GetInt("cephfs-rsync-shard-depth")
+		if j.ShardDepth < 0 {
+			errs = append(errs, fmt.Errorf("Unable to parse 'cephfs-rsync-shard-depth' setting: %d must not be negative", j.ShardDepth))
+		}
+		j.Workers = viper.GetInt("cephfs-rsync-workers")
+		if j.Workers < 1 {
+			errs = append(errs, fmt.Errorf("Unable to parse 'cephfs-rsync-workers' setting: %d must be at least 1", j.Workers))
+		}
+		j.RctimeSkip = viper.GetBool("cephfs-rctime-skip")
+		j.Engine = viper.GetString("cephfs-engine")
+		j.Repository = filepath.Join(j.BackupMount, filepath.Clean("/"+viper.GetString("cephfs-repository")))
+		if err := j.checkEngine(); err != nil {
+			errs = append(errs, fmt.Errorf("Unable to parse 'cephfs-engine' setting: %s", err.Error()))
+		}
+		if len(errs) > 0 {
+			return nil, errs
+		}
+		return []*CephFSJob{j}, nil
+	}
+
+	names := make(map[string]bool)
+	for i, r := range raw {
+		j, jobErrs := parseCephFSJob(r)
+		for _, e := range jobErrs {
+			errs = append(errs, fmt.Errorf("Unable to parse 'cephfs-jobs' setting, job %d (%s): %s", i, r.Name, e.Error()))
+		}
+		if j == nil {
+			continue
+		}
+		if names[j.Name] {
+			errs = append(errs, fmt.Errorf("Unable to parse 'cephfs-jobs' setting: job name %s is used more than once", j.Name))
+		}
+		names[j.Name] = true
+		jobs = append(jobs, j)
+	}
+	return jobs, errs
+}
+
+func parseCephFSJob(r cephfsJobConfig) (*CephFSJob, []error) {
+	var errs []error
+
+	if !cephfsJobNameRegex.MatchString(r.Name) {
+		return nil, []error{fmt.Errorf("name '%s' must be lower case letters, numbers and dashes", r.Name)}
+	}
+
+	j := &CephFSJob{
+		Name:        r.Name,
+		Source:      filepath.Clean("/" + r.Source)[1:],
+		BackupMount: r.BackupMount,
+		RbdName:     r.RbdName,
+		RsyncArgs:   r.RsyncArgs,
+		Schedule:    r.Schedule,
+		SuccessFile: r.SuccessFile,
+		LockFile:    r.LockFile,
+		LogPrefix:   fmt.Sprintf("rsync_%s_", r.Name),
+	}
+	if j.BackupMount == "" {
+		j.BackupMount = viper.GetString("backup-mount")
+	}
+	if !filepath.IsAbs(j.BackupMount) {
+		errs = append(errs, fmt.Errorf("backup-mount '%s' is not an absolute path", j.BackupMount))
+	}
+	if r.Target == "" {
+		j.Target = filepath.Join(j.BackupMount, "backup", j.Name)
+	} else {
+		j.Target = filepath.Join(j.BackupMount, filepath.Clean("/"+r.Target))
+	}
+	if j.RbdName == "" {
+		j.RbdName = viper.GetString("cephfs-rbd-name")
+	}
+	if len(j.RsyncArgs) == 0 {
+		j.RsyncArgs = viper.GetStringSlice("cephfs-rsync-args")
+	}
+	if len(r.RsyncValidExitCodes) == 0 {
+		j.RsyncValidExitCodes, _ = exitCodesSettingParser("cephfs-rsync-valid-exit-codes")
+	} else {
+		for _, c := range r.RsyncValidExitCodes {
+			val, err := strconv.Atoi(c)
+			if err != nil || val < 0 || val > 255 {
+				errs = append(errs, fmt.Errorf("rsync-valid-exit-codes '%s' is not a valid exit code", c))
+				continue
+			}
+			j.RsyncValidExitCodes = append(j.RsyncValidExitCodes, val)
+		}
+	}
+	if j.Schedule == "" {
+		j.Schedule = viper.GetString("cephfs-interval")
+	}
+	if _, err := cron.Parse(j.Schedule); err != nil {
+		errs = append(errs, fmt.Errorf("schedule '%s': %s", j.Schedule, err.Error()))
+	}
+	if r.SnapCountMin == nil {
+		j.SnapCountMin = viper.GetInt("cephfs-snap-count-min")
+	} else {
+		j.SnapCountMin = *r.SnapCountMin
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		def   string
+		dest  *time.Duration
+	}{
+		{"rsync-interval", r.RsyncInterval, "cephfs-rsync-interval", &j.RsyncInterval},
+		{"snap-age-min", r.SnapAgeMin, "cephfs-snap-age-min", &j.SnapAgeMin},
+		{"snap-age-max", r.SnapAgeMax, "cephfs-snap-age-max", &j.SnapAgeMax},
+	} {
+		value := d.value
+		if value == "" {
+			value = viper.GetString(d.def)
+		}
+		td, err := time.ParseDuration(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s '%s': %s", d.name, value, err.Error()))
+		}
+		*d.dest = td
+	}
+	j.ShardDepth = viper.GetInt("cephfs-rsync-shard-depth")
+	if r.ShardDepth != nil {
+		j.ShardDepth = *r.ShardDepth
+	}
+	if j.ShardDepth < 0 {
+		errs = append(errs, fmt.Errorf("shard-depth %d must not be negative", j.ShardDepth))
+	}
+	j.Workers = viper.GetInt("cephfs-rsync-workers")
+	if r.Workers != nil {
+		j.Workers = *r.Workers
+	}
+	if j.Workers < 1 {
+		errs = append(errs, fmt.Errorf("rsync-workers %d must be at least 1", j.Workers))
+	}
+	j.RctimeSkip = viper.GetBool("cephfs-rctime-skip")
+	if r.RctimeSkip != nil {
+		j.RctimeSkip = *r.RctimeSkip
+	}
+	j.Engine = r.Engine
+	if j.Engine == "" {
+		j.Engine = viper.GetString("cephfs-engine")
+	}
+	if err := j.checkEngine(); err != nil {
+		errs = append(errs, err)
+	}
+	// the repository or generations keep the history, unless an RBD to snapshot was asked for explicitly
+	if j.Engine != "rsync" && r.RbdName == "" {
+		j.RbdName = ""
+	}
+	j.Repository = r.Repository
+	if j.Repository == "" {
+		j.Repository = viper.GetString("cephfs-repository")
+	}
+	j.Repository = filepath.Join(j.BackupMount, filepath.Clean("/"+j.Repository))
+	if j.SuccessFile == "" {
+		j.SuccessFile = filepath.Join(j.BackupMount, fmt.Sprintf("rsync_success_%s", j.Name))
+	}
+	if j.LockFile == "" {
+		j.LockFile = filepath.Join(j.BackupMount, fmt.Sprintf("rsync_%s.lock", j.Name))
+	}
+	for _, d := range r.SnapshotDirs {
+		d = filepath.Clean(d)
+		if filepath.IsAbs(d) || d == ".." || strings.HasPrefix(d, "../") {
+			errs = append(errs, fmt.Errorf("snapshot-dirs '%s' must be a relative path below the source", d))
+			continue
+		}
+		j.SnapshotDirs = append(j.SnapshotDirs, d)
+	}
+	return j, errs
+}
+
+// cephfsJobCollector reports metrics read from each job's backup mount and lock file when scraped
+type cephfsJobCollector struct {
+	backupUsed *prometheus.Desc
+	backupFree *prometheus.Desc
+	lockHeld   *prometheus.Desc
+	lockAge    *prometheus.Desc
+}
+
+func newCephFSJobCollector() *cephfsJobCollector {
+	return &cephfsJobCollector{
+		backupUsed: prometheus.NewDesc("cephback_cephfs_backup_rbd_used_bytes", "Number of bytes used on the CephFS backup RBD", []string{"cephfs_job"}, nil),
+		backupFree: prometheus.NewDesc("cephback_cephfs_backup_rbd_free_bytes", "Number of bytes free on the CephFS backup RBD", []string{"cephfs_job"}, nil),
+		lockHeld:   prometheus.NewDesc("cephback_cephfs_rsync_lock_held", "1 if the CephFS rsync lock is held", []string{"cephfs_job"}, nil),
+		lockAge:    prometheus.NewDesc("cephback_cephfs_rsync_lock_age_seconds", "How long the CephFS rsync lock has been held", []string{"cephfs_job"}, nil),
+	}
+}
+
+func (c *cephfsJobCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.backupUsed
+	ch <- c.backupFree
+	ch <- c.lockHeld
+	ch <- c.lockAge
+}
+
+func (c *cephfsJobCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, j := range cephfsJobs {
+		disk := DiskUsage(j.BackupMount)
+		ch <- prometheus.MustNewConstMetric(c.backupUsed, prometheus.GaugeValue, float64(disk.Used), j.Name)
+		ch <- prometheus.MustNewConstMetric(c.backupFree, prometheus.GaugeValue, float64(disk.Free), j.Name)
+		held, age := 0.0, 0.0
+		if info, err := lockHolder(j.LockFile); err == nil && info != nil {
+			held = 1
+			age = time.Since(info.Started).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(c.lockHeld, prometheus.GaugeValue, held, j.Name)
+		ch <- prometheus.MustNewConstMetric(c.lockAge, prometheus.GaugeValue, age, j.Name)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(newCephFSJobCollector())
+}
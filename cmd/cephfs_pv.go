@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	metricBoundCephFSPVFound = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cephback_bound_cephfs_pv_found",
+			Help: "The number of bound CephFS persistent volumes found",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricBoundCephFSPVFound)
+}
+
+// CephFSPvBackup is a CephFS persistent volume together with the job that backs it up
+type CephFSPvBackup struct {
+	CephFSPv
+	Job *CephFSJob
+}
+
+// jobs for the CephFS PVs found by the last discovery
+var cephfsPvBackups []CephFSPvBackup
+var cephfsPvBackupsMutex sync.Mutex
+
+// set while processCephFSPvs runs, a run that is still going makes the next one skip rather than stack up
+var cephfsPvRunning bool
+
+// cephfsPvJobName turns a PV name into a job name, PV names may contain dots which job names may not
+func cephfsPvJobName(pvName string) string {
+	return "pv-" + strings.Replace(strings.ToLower(pvName), ".", "-", -1)
+}
+
+// cephfsPvJob builds the backup job for a PV. PV jobs take the global cephfs settings and have no RBD of their own,
+// their history comes from the snapshots of the backup RBD taken by the regular CephFS jobs.
+func cephfsPvJob(pv CephFSPv) (*CephFSJob, error) {
+	rel, err := filepath.Rel(cephfsMountRoot, filepath.Clean(pv.Path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, fmt.Errorf("PV %s path %s is not below the CephFS mount root %s", pv.Name, pv.Path, cephfsMountRoot)
+	}
+	// a PV of the whole filesystem would back up every other PV and job again
+	if rel == "." {
+		return nil, fmt.Errorf("PV %s path %s is the CephFS mount root", pv.Name, pv.Path)
+	}
+	name := cephfsPvJobName(pv.Name)
+	j, errs := parseCephFSJob(cephfsJobConfig{
+		Name:   name,
+		Source: rel,
+		Target: filepath.Join(cephfsPvTarget, pv.Name),
+	})
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	j.RbdName = ""
+	return j, nil
+}
+
+// discoverCephFSPvs finds the bound CephFS PVs and builds a job for each of them
+func discoverCephFSPvs() ([]CephFSPvBackup, error) {
+	pvs, err := getCephFSPvs("Bound")
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Found %d bound CephFS persistent volumes in the cluster", len(pvs))
+	metricBoundCephFSPVFound.Set(float64(len(pvs)))
+
+	var backups []CephFSPvBackup
+	for _, pv := range pvs {
+		j, err := cephfsPvJob(pv)
+		if err != nil {
+			logger.Errorf("Skipping CephFS PV: %s", err.Error())
+			continue
+		}
+		backups = append(backups, CephFSPvBackup{CephFSPv: pv, Job: j})
+	}
+	if len(backups) > 0 && !backupMountSnapshotted(backups[0].Job.BackupMount) {
+		logger.Warnf("No CephFS job snapshots the RBD at %s, CephFS PV backups there only keep their latest copy", backups[0].Job.BackupMount)
+	}
+
+	cephfsPvBackupsMutex.Lock()
+	cephfsPvBackups = backups
+	cephfsPvBackupsMutex.Unlock()
+	return backups, nil
+}
+
+// backupMountSnapshotted returns whether any CephFS job snapshots the RBD mounted at a backup mount
+func backupMountSnapshotted(mount string) bool {
+	for _, j := range cephfsJobs {
+		if j.BackupMount == mount && j.RbdName != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// processCephFSPvs backs up each bound CephFS PV as its own unit. The PV jobs write to the backup mount of the
+// regular jobs and their history is the snapshots those take, which wait for any PV rsync to finish.
+func processCephFSPvs() {
+	cephfsPvBackupsMutex.Lock()
+	if cephfsPvRunning {
+		cephfsPvBackupsMutex.Unlock()
+		logger.Warn("Skipping CephFS PV backups, the previous run is still going")
+		return
+	}
+	cephfsPvRunning = true
+	cephfsPvBackupsMutex.Unlock()
+	defer func() {
+		cephfsPvBackupsMutex.Lock()
+		cephfsPvRunning = false
+		cephfsPvBackupsMutex.Unlock()
+	}()
+
+	backups, err := discoverCephFSPvs()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	for _, b := range backups {
+		if isShuttingDown() {
+			return
+		}
+		processCephFSJob(b.Job)
+	}
+}
+
+// checkCephFSPvHealth flags every PV whose last successful rsync is older than its rsync interval plus 20%
+func checkCephFSPvHealth() {
+	cephfsPvBackupsMutex.Lock()
+	backups := cephfsPvBackups
+	cephfsPvBackupsMutex.Unlock()
+
+	var unhealthy []string
+	for _, b := range backups {
+		threshold := time.Duration(b.Job.RsyncInterval * 120 / 100) // add 20%
+		if time.Since(cephfsLastSuccess(b.Job)) > threshold {
+			unhealthy = append(unhealthy, b.Name)
+		}
+	}
+	if len(unhealthy) == 0 {
+		health.Set("cephfs-pv", "")
+		return
+	}
+	msg := fmt.Sprintf("Successful rsync not found for %d CephFS PVs: %s", len(unhealthy), strings.Join(unhealthy, " "))
+	health.Set("cephfs-pv", msg)
+	logger.Infof(msg)
+}
+
+// CephFSPvStatus is the backup state of a CephFS PV as reported by the API
+type CephFSPvStatus struct {
+	CephFSPv
+	Job         string    `json:"job"`
+	Source      string    `json:"source"`
+	RestorePath string    `json:"restorePath"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	Healthy     bool      `json:"healthy"`
+}
+
+func httpCephFSPvs(w http.ResponseWriter, r *http.Request) {
+	cephfsPvBackupsMutex.Lock()
+	backups := cephfsPvBackups
+	cephfsPvBackupsMutex.Unlock()
+
+	statuses := []CephFSPvStatus{}
+	for _, b := range backups {
+		lastSuccess := cephfsLastSuccess(b.Job)
+		statuses = append(statuses, CephFSPvStatus{
+			CephFSPv:    b.CephFSPv,
+			Job:         b.Job.Name,
+			Source:      b.Job.SourcePath(),
+			RestorePath: b.Job.Target,
+			LastSuccess: lastSuccess,
+			Healthy:     time.Since(lastSuccess) <= time.Duration(b.Job.RsyncInterval*120/100),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,442 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ceph/go-ceph/rbd"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	metricCephFSBackupRbdGrown = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cephback_cephfs_backup_rbd_grown",
+			Help: "How many times the CephFS backup RBD was grown because it was running out of space",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSBackupRbdAtMax = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_backup_rbd_at_max_size",
+			Help: "Whether the CephFS backup RBD needs to grow but has reached cephfs-rbd-max-size",
+		},
+		[]string{"cephfs_job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCephFSBackupRbdGrown)
+	prometheus.MustRegister(metricCephFSBackupRbdAtMax)
+}
+
+// rbdCommand runs the rbd CLI as the ceph user against the configured pool, for what go-ceph cannot do such as
+// mapping images, and returns its stdout
+func rbdCommand(args ...string) (string, error) {
+	exitCode, stdout, err := execCommand("rbd", append([]string{"--id", cephUser, "--pool", cephPool}, args...))
+	if err != nil {
+		return stdout, err
+	}
+	if exitCode != 0 {
+		return stdout, fmt.Errorf("rbd %s exited with %d", args[0], exitCode)
+	}
+	return stdout, nil
+}
+
+// rbdMapping is an entry of rbd showmapped
+type rbdMapping struct {
+	Pool   string `json:"pool"`
+	Name   string `json:"name"`
+	Snap   string `json:"snap"`
+	Device string `json:"device"`
+}
+
+// rbdMappedDevice returns the device an image (or image snapshot if snap is set) is mapped to, or "" if it is not mapped
+func rbdMappedDevice(name string, snap string) (string, error) {
+	out, err := rbdCommand("showmapped", "--format", "json")
+	if err != nil {
+		return "", err
+	}
+	// older releases key the mappings by id, newer ones return a list
+	var mappings []rbdMapping
+	if err := json.Unmarshal([]byte(out), &mappings); err != nil {
+		byID := make(map[string]rbdMapping)
+		if err := json.Unmarshal([]byte(out), &byID); err != nil {
+			return "", fmt.Errorf("Unable to parse rbd showmapped output: %s", err.Error())
+		}
+		for _, m := range byID {
+			mappings = append(mappings, m)
+		}
+	}
+	if snap == "" {
+		snap = "-"
+	}
+	for _, m := range mappings {
+		if m.Pool == cephPool && m.Name == name && m.Snap == snap {
+			return m.Device, nil
+		}
+	}
+	return "", nil
+}
+
+// rbdMap maps an image, or an image snapshot if snap is set, unless it is already mapped and returns the device.
+// Snapshots are always mapped read-only.
+func rbdMap(name string, snap string, readOnly bool) (string, error) {
+	dev, err := rbdMappedDevice(name, snap)
+	if err != nil || dev != "" {
+		return dev, err
+	}
+	spec := name
+	args := []string{"map"}
+	if snap != "" {
+		spec = name + "@" + snap
+		readOnly = true
+	}
+	if readOnly {
+		args = append(args, "--read-only")
+	}
+	out, err := rbdCommand(append(args, spec)...)
+	if err != nil {
+		return "", fmt.Errorf("Unable to map %s: %s", spec, err.Error())
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// rbdExists checks whether an image exists in the pool
+func rbdExists(name string) (bool, error) {
+	names, err := rbd.GetImageNames(iocx)
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if n == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ensureBackupRbd creates the job's backup RBD if it is missing, then maps and mounts it at the job's backup mount
+// and grows it if it is running out of space
+func ensureBackupRbd(j *CephFSJob) error {
+	if err := CephConnInit(); err != nil {
+		return err
+	}
+	exists, err := rbdExists(j.RbdName)
+	if err != nil {
+		return fmt.Errorf("Unable to list images: %s", err.Error())
+	}
+	if !exists {
+		logger.Infof("Creating backup RBD %s/%s for CephFS job %s", cephPool, j.RbdName, j.Name)
+		args := []string{"create", j.RbdName, "--size", fmt.Sprintf("%dM", cephfsRbdSize>>20)}
+		for _, f := range cephfsRbdFeatures {
+			args = append(args, "--image-feature", f)
+		}
+		if _, err := rbdCommand(args...); err != nil {
+			return fmt.Errorf("Unable to create backup RBD %s: %s", j.RbdName, err.Error())
+		}
+	}
+
+	dev, err := rbdMap(j.RbdName, "", false)
+	if err != nil {
+		return err
+	}
+	if dev, err = openBackupLuks(j, dev); err != nil {
+		return err
+	}
+
+	// blkid exits with 2 when it finds no filesystem at all, anything else is left alone
+	exitCode, _, err := execCommand("blkid", []string{"-o", "value", "-s", "TYPE", dev})
+	if err != nil {
+		return err
+	}
+	if exitCode == 2 {
+		logger.Warnf("No filesystem on %s (%s), creating %s", dev, j.RbdName, cephfsRbdFs)
+		if !execHelper("mkfs."+cephfsRbdFs, []string{dev}, []int{0}) {
+			return fmt.Errorf("Unable to create filesystem on %s", dev)
+		}
+	}
+
+	isMounted, err := mounted(j.BackupMount)
+	if err != nil {
+		return err
+	}
+	if !isMounted {
+		if err := os.MkdirAll(j.BackupMount, 0755); err != nil {
+			return err
+		}
+		if !execHelper("mount", []string{dev, j.BackupMount}, []int{0}) {
+			return fmt.Errorf("Unable to mount %s at %s", dev, j.BackupMount)
+		}
+	}
+
+	return growBackupRbd(j, dev)
+}
+
+// growBackupRbd resizes the job's backup RBD and grows its filesystem online when free space drops below
+// cephfs-rbd-grow-free-pct, up to cephfs-rbd-max-size
+func growBackupRbd(j *CephFSJob, dev string) error {
+	disk := DiskUsage(j.BackupMount)
+	if disk.All == 0 || float64(disk.Free)*100/float64(disk.All) >= float64(cephfsRbdGrowFreePct) {
+		metricCephFSBackupRbdAtMax.WithLabelValues(j.Name).Set(0.0)
+		return nil
+	}
+
+	img := rbd.GetImage(iocx, j.RbdName)
+	if err := img.Open(); err != nil {
+		return err
+	}
+	defer img.Close()
+	size, err := img.GetSize()
+	if err != nil {
+		return err
+	}
+	if size >= cephfsRbdMaxSize {
+		metricCephFSBackupRbdAtMax.WithLabelValues(j.Name).Set(1.0)
+		return fmt.Errorf("Backup RBD %s has %d bytes free but is already at the maximum size of %d bytes", j.RbdName, disk.Free, cephfsRbdMaxSize)
+	}
+	newSize := size + cephfsRbdGrowStep
+	if newSize > cephfsRbdMaxSize {
+		newSize = cephfsRbdMaxSize
+	}
+
+	logger.Infof("Growing backup RBD %s from %d to %d bytes, %d bytes free", j.RbdName, size, newSize, disk.Free)
+	if err := img.Resize(newSize); err != nil {
+		return fmt.Errorf("Unable to resize %s: %s", j.RbdName, err.Error())
+	}
+	if isMapperDevice(dev) {
+		if err := luksResize(luksName(j.RbdName)); err != nil {
+			return err
+		}
+	}
+	grown := false
+	if cephfsRbdFs == "xfs" {
+		grown = execHelper("xfs_growfs", []string{j.BackupMount}, []int{0})
+	} else {
+		grown = execHelper("resize2fs", []string{dev}, []int{0})
+	}
+	if !grown {
+		return fmt.Errorf("Resized %s but could not grow its filesystem", j.RbdName)
+	}
+	metricCephFSBackupRbdGrown.WithLabelValues(j.Name).Inc()
+	return nil
+}
+
+// rbdDuEntry is an image or snapshot line of rbd du, Snapshot is empty for the image head
+type rbdDuEntry struct {
+	Name            string `json:"name"`
+	Snapshot        string `json:"snapshot"`
+	ProvisionedSize uint64 `json:"provisioned_size"`
+	UsedSize        uint64 `json:"used_size"`
+}
+
+// rbdDu is the output of rbd du. The used size of a snapshot is what was written between the previous snapshot
+// and it, and the used size of the head what was written since the newest snapshot, so neither is what deleting a
+// snapshot would free. The total is everything the image and its snapshots use together.
+type rbdDu struct {
+	Images        []rbdDuEntry `json:"images"`
+	TotalUsedSize uint64       `json:"total_used_size"`
+}
+
+// rbdDiskUsage returns the space used by an image and each of its snapshots
+func rbdDiskUsage(name string) (*rbdDu, error) {
+	out, err := rbdCommand("du", "--format", "json", name)
+	if err != nil {
+		return nil, err
+	}
+	du := &rbdDu{}
+	if err := json.Unmarshal([]byte(out), du); err != nil {
+		return nil, fmt.Errorf("Unable to parse rbd du output for %s: %s", name, err.Error())
+	}
+	return du, nil
+}
+
+// rbdFastDiff tells if an image has a valid fast-diff map, without which rbd du reads every object of it
+func rbdFastDiff(name string) (bool, error) {
+	out, err := rbdCommand("info", "--format", "json", name)
+	if err != nil {
+		return false, err
+	}
+	var info struct {
+		Features []string `json:"features"`
+		Flags    []string `json:"flags"`
+	}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return false, fmt.Errorf("Unable to parse rbd info output for %s: %s", name, err.Error())
+	}
+	return stringInSlice("fast-diff", info.Features) && !stringInSlice("fast diff invalid", info.Flags), nil
+}
+
+// snapChildren returns the names of the clones of a snapshot
+func snapChildren(image string, snap string) ([]string, error) {
+	out, err := rbdCommand("children", image+"@"+snap)
+	if err != nil {
+		return nil, err
+	}
+	var children []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			children = append(children, line[strings.LastIndex(line, "/")+1:])
+		}
+	}
+	return children, nil
+}
+
+// isMountClone tells if an image is a clone made by mountRbdSnapshot
+func isMountClone(image string, clone string) bool {
+	return strings.HasPrefix(clone, image+"_restore_")
+}
+
+// mountProtected tells if a protected snapshot is only protected for the clones of other snapshot mounts, which
+// then share the protection: whichever closes last unprotects it
+func mountProtected(image string, snap string) bool {
+	if snapPinned(image, snap) {
+		return false
+	}
+	children, err := snapChildren(image, snap)
+	if err != nil || len(children) == 0 {
+		return false
+	}
+	for _, c := range children {
+		if !isMountClone(image, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// SnapshotMount is a read-only mount of a clone of an RBD snapshot
+type SnapshotMount struct {
+	Image     string
+	Snap      string
+	Clone     string
+	Device    string
+	Crypt     string
+	Path      string
+	protected bool
+}
+
+// mountRbdSnapshot clones an RBD snapshot, maps the clone read-only and mounts it in a temporary directory.
+// Close must be called to remove it all again.
+func mountRbdSnapshot(image string, snap string) (m *SnapshotMount, err error) {
+	if err := CephConnInit(); err != nil {
+		return nil, err
+	}
+	m = &SnapshotMount{
+		Image: image,
+		Snap:  snap,
+		Clone: fmt.Sprintf("%s_restore_%s_%d", image, strings.NewReplacer(":", "", "-", "").Replace(snap), time.Now().UnixNano()),
+	}
+	defer func() {
+		if err != nil {
+			m.Close()
+		}
+	}()
+
+	// cloning needs the snapshot protected, it is only unprotected again if it was protected for mounts, and then
+	// only once no clone is left and it is not pinned
+	img := rbd.GetImage(iocx, image)
+	if err := img.Open(); err != nil {
+		return nil, err
+	}
+	s := img.GetSnapshot(snap)
+	isProtected, err := s.IsProtected()
+	if err == nil && !isProtected {
+		if err = s.Protect(); err == nil {
+			m.protected = true
+		}
+	} else if err == nil {
+		m.protected = mountProtected(image, snap)
+	}
+	img.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to protect %s@%s: %s", image, snap, err.Error())
+	}
+
+	if _, err := rbdCommand("clone", image+"@"+snap, m.Clone); err != nil {
+		m.Clone = ""
+		return nil, fmt.Errorf("Unable to clone %s@%s: %s", image, snap, err.Error())
+	}
+	if m.Device, err = rbdMap(m.Clone, "", true); err != nil {
+		return nil, err
+	}
+	dev := m.Device
+	if encrypted, err := isLuks(m.Device); err != nil {
+		return nil, err
+	} else if encrypted {
+		m.Crypt = luksName(m.Clone)
+		if dev, err = luksOpen(m.Device, m.Crypt, true); err != nil {
+			m.Crypt = ""
+			return nil, err
+		}
+	}
+	if m.Path, err = ioutil.TempDir("", "cephback-"+m.Clone+"-"); err != nil {
+		return nil, err
+	}
+
+	// the clone has the same filesystem UUID as the mounted backup, and a read-only device cannot replay a log
+	options := "ro,noload"
+	if _, fsType, _ := execCommand("blkid", []string{"-o", "value", "-s", "TYPE", dev}); strings.TrimSpace(fsType) == "xfs" {
+		options = "ro,norecovery,nouuid"
+	}
+	if !execHelper("mount", []string{"-o", options, dev, m.Path}, []int{0}) {
+		os.Remove(m.Path)
+		m.Path = ""
+		return nil, fmt.Errorf("Unable to mount %s@%s", image, snap)
+	}
+	logger.Infof("Mounted %s@%s read-only at %s", image, snap, m.Path)
+	return m, nil
+}
+
+// Close unmounts, unmaps and removes the clone, logging anything left behind
+func (m *SnapshotMount) Close() error {
+	var failed []string
+	if m.Path != "" {
+		if execHelper("umount", []string{m.Path}, []int{0}) {
+			os.Remove(m.Path)
+		} else {
+			failed = append(failed, "unmount "+m.Path)
+		}
+	}
+	if m.Crypt != "" {
+		if err := luksClose(m.Crypt); err != nil {
+			failed = append(failed, "close "+m.Crypt)
+		}
+	}
+	if m.Device != "" {
+		if _, err := rbdCommand("unmap", m.Device); err != nil {
+			failed = append(failed, "unmap "+m.Device)
+		}
+	}
+	if m.Clone != "" {
+		if _, err := rbdCommand("rm", m.Clone); err != nil {
+			failed = append(failed, "remove "+m.Clone)
+		}
+	}
+	if m.protected {
+		if children, err := snapChildren(m.Image, m.Snap); err != nil {
+			failed = append(failed, "list clones of "+m.Image+"@"+m.Snap)
+		} else if len(children) > 0 {
+			logger.Infof("Leaving %s@%s protected, it still has clones: %s", m.Image, m.Snap, strings.Join(children, ", "))
+		} else if snapPinned(m.Image, m.Snap) {
+			logger.Infof("Leaving %s@%s protected, it is pinned", m.Image, m.Snap)
+		} else {
+			img := rbd.GetImage(iocx, m.Image)
+			if err := img.Open(); err == nil {
+				if err := img.GetSnapshot(m.Snap).Unprotect(); err != nil {
+					failed = append(failed, "unprotect "+m.Image+"@"+m.Snap)
+				}
+				img.Close()
+			}
+		}
+	}
+	if len(failed) > 0 {
+		err := fmt.Errorf("Unable to clean up after mounting %s@%s: %s", m.Image, m.Snap, strings.Join(failed, ", "))
+		logger.Error(err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricCephFSRsyncShardsSkipped = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_shards_skipped",
+			Help: "The number of rsync shards skipped in the last CephFS run because their rctime had not changed",
+		},
+		[]string{"cephfs_job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCephFSRsyncShardsSkipped)
+}
+
+// rctimeStateFile is where the rctime of each shard at its last successful rsync is kept, next to the success file
+func rctimeStateFile(j *CephFSJob) string {
+	return j.SuccessFile + ".rctime"
+}
+
+// readRctime returns the recursive ctime CephFS keeps for a directory, which changes whenever anything below it does
+func readRctime(path string) (string, error) {
+	return getXattr(path, "ceph.dir.rctime")
+}
+
+// skipUnchangedTasks drops the recursive tasks whose rctime matches the one recorded at their last successful rsync.
+// It returns the tasks to run and the current rctime of every recursive task, to be recorded once the run is done.
+func skipUnchangedTasks(j *CephFSJob, tasks []rsyncTask) (run []rsyncTask, rctimes map[string]string) {
+	recorded := make(map[string]string)
+	if err := readState(rctimeStateFile(j), &recorded); err != nil {
+		logger.Errorf("Unable to read rctime state for CephFS job %s, copying everything: %s", j.Name, err.Error())
+	}
+
+	rctimes = make(map[string]string)
+	skipped := 0
+	for _, t := range tasks {
+		if !t.Recursive {
+			run = append(run, t)
+			continue
+		}
+		rctime, err := readRctime(t.Src)
+		if err != nil {
+			logger.Errorf("%s, copying %s", err.Error(), t.Src)
+			run = append(run, t)
+			continue
+		}
+		rctimes[t.Key] = rctime
+		if prev, ok := recorded[t.Key]; ok && prev == rctime {
+			logger.Debugf("Skipping unchanged %s for CephFS job %s (rctime %s)", t.Src, j.Name, rctime)
+			skipped++
+			continue
+		}
+		run = append(run, t)
+	}
+	logger.Infof("CephFS job %s: %d of %d shards unchanged since the last backup", j.Name, skipped, len(tasks))
+	metricCephFSRsyncShardsSkipped.WithLabelValues(j.Name).Set(float64(skipped))
+	return run, rctimes
+}
+
+// recordRctimes stores the rctimes read before the run for every shard that did not fail. Shards that no longer
+// exist are dropped, and failed shards are left out so they are copied again next time.
+func recordRctimes(j *CephFSJob, rctimes map[string]string, failed []rsyncTask) {
+	for _, t := range failed {
+		delete(rctimes, t.Key)
+	}
+	if err := writeState(rctimeStateFile(j), rctimes); err != nil {
+		logger.Errorf("Unable to record rctime state for CephFS job %s: %s", j.Name, err.Error())
+	}
+}
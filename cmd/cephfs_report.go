@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix of the --stats lines each rsync appends to the run's log
+var rsyncStatsPrefix = "cephback-stats: "
+
+// each rsync attempt's part of the run's log starts with this prefix and the attempt's source
+var rsyncAttemptPrefix = "cephback-shard: "
+
+// a line rsync writes to its log file: timestamp, pid and message
+var rsyncLogLineRegex = regexp.MustCompile(`^[0-9]{4}/[0-9]{2}/[0-9]{2} [0-9:]{8} \[[0-9]+\] (.*)$`)
+
+// the first quoted path in an rsync error or warning
+var rsyncQuotedPathRegex = regexp.MustCompile(`"([^"]+)"`)
+
+var (
+	metricCephFSRsyncFilesTransferred = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_files_transferred",
+			Help: "The number of files transferred by the last CephFS rsync",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncFilesDeleted = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_files_deleted",
+			Help: "The number of files deleted from the backup by the last CephFS rsync",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncFilesFailed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_files_failed",
+			Help: "The number of files the last CephFS rsync failed to copy",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncFilesVanished = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_files_vanished",
+			Help: "The number of files that vanished during the last CephFS rsync",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncTotalBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_total_bytes",
+			Help: "The total size of the files in the last CephFS rsync",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncSentBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_sent_bytes",
+			Help: "The number of bytes sent by the last CephFS rsync",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncBytesPerSecond = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_bytes_per_second",
+			Help: "The transfer speed of the last CephFS rsync",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_duration_seconds",
+			Help: "How long the last CephFS rsync took",
+		},
+		[]string{"cephfs_job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCephFSRsyncFilesTransferred)
+	prometheus.MustRegister(metricCephFSRsyncFilesDeleted)
+	prometheus.MustRegister(metricCephFSRsyncFilesFailed)
+	prometheus.MustRegister(metricCephFSRsyncFilesVanished)
+	prometheus.MustRegister(metricCephFSRsyncTotalBytes)
+	prometheus.MustRegister(metricCephFSRsyncSentBytes)
+	prometheus.MustRegister(metricCephFSRsyncBytesPerSecond)
+	prometheus.MustRegister(metricCephFSRsyncDuration)
+}
+
+// RsyncReport summarises a CephFS rsync run from its log, it is stored as JSON next to the log
+type RsyncReport struct {
+	Job              string    `json:"job"`
+	Started          time.Time `json:"started"`
+	Finished         time.Time `json:"finished"`
+	DurationSeconds  float64   `json:"duration_seconds"`
+	Success          bool      `json:"success"`
+	Interrupted      bool      `json:"interrupted"`
+	Files            int64     `json:"files"`
+	FilesCreated     int64     `json:"files_created"`
+	FilesTransferred int64     `json:"files_transferred"`
+	FilesDeleted     int64     `json:"files_deleted"`
+	FilesFailed      int64     `json:"files_failed"`
+	TotalBytes       int64     `json:"total_bytes"`
+	TransferredBytes int64     `json:"transferred_bytes"`
+	SentBytes        int64     `json:"sent_bytes"`
+	ReceivedBytes    int64     `json:"received_bytes"`
+	BytesPerSecond   float64   `json:"bytes_per_second"`
+	Vanished         []string  `json:"vanished,omitempty"`
+	Failed           []string  `json:"failed,omitempty"`
+	DirsFailed       []string  `json:"dirs_failed,omitempty"`
+}
+
+// rsyncReportFile is where the report for a log is stored
+func rsyncReportFile(logFileName string) string {
+	return logFileName + ".json"
+}
+
+// serialises appends to a run's log by the parallel rsync shards
+var rsyncLogMutex sync.Mutex
+
+// appendRsyncAttempt adds what one rsync attempt logged, followed by its --stats output, to the run's log. The
+// stats lines are prefixed so they can be told apart from the lines rsync logs itself.
+func appendRsyncAttempt(logFileName string, src string, attemptLog string, stdout string) {
+	var b bytes.Buffer
+	b.WriteString(rsyncAttemptPrefix + src + "\n")
+	if data, err := ioutil.ReadFile(attemptLog); err == nil {
+		b.Write(data)
+	}
+	for _, line := range strings.Split(stdout, "\n") {
+		if strings.Contains(line, ": ") && !strings.HasPrefix(line, "rsync") {
+			b.WriteString(rsyncStatsPrefix + line + "\n")
+		}
+	}
+
+	rsyncLogMutex.Lock()
+	defer rsyncLogMutex.Unlock()
+	f, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Errorf("Unable to add rsync log for %s to %s: %s", src, logFileName, err.Error())
+		return
+	}
+	defer f.Close()
+	f.Write(b.Bytes())
+}
+
+// parseRsyncNumber parses a number from the --stats output such as "1,234 (reg: 1,000, dir: 234)" or "1,234 bytes"
+func parseRsyncNumber(s string) int64 {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0
+	}
+	n, _ := strconv.ParseInt(strings.Replace(fields[0], ",", "", -1), 10, 64)
+	return n
+}
+
+// addRsyncStat adds the value of one line of --stats output to a report
+func addRsyncStat(r *RsyncReport, key string, value string) {
+	n := parseRsyncNumber(value)
+	switch key {
+	case "Number of files":
+		r.Files += n
+	case "Number of created files":
+		r.FilesCreated += n
+	case "Number of deleted files":
+		r.FilesDeleted += n
+	case "Number of regular files transferred":
+		r.FilesTransferred += n
+	case "Total file size":
+		r.TotalBytes += n
+	case "Total transferred file size":
+		r.TransferredBytes += n
+	case "Total bytes sent":
+		r.SentBytes += n
+	case "Total bytes received":
+		r.ReceivedBytes += n
+	}
+}
+
+// parseRsyncLog adds the counts and paths from an rsync log, and the stats appended to it, to a report.
+// Only the last attempt of each shard counts, their stats are summed and the paths merged.
+func parseRsyncLog(logFileName string, r *RsyncReport) error {
+	f, err := os.Open(logFileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	attempts := make(map[string]*RsyncReport)
+	var order []string
+	current := &RsyncReport{}
+	attempts[""] = current
+	order = append(order, "")
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, rsyncAttemptPrefix) {
+			src := strings.TrimPrefix(line, rsyncAttemptPrefix)
+			if _, ok := attempts[src]; !ok {
+				order = append(order, src)
+			}
+			current = &RsyncReport{}
+			attempts[src] = current
+			continue
+		}
+		if strings.HasPrefix(line, rsyncStatsPrefix) {
+			kv := strings.SplitN(strings.TrimPrefix(line, rsyncStatsPrefix), ": ", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			addRsyncStat(current, kv[0], kv[1])
+			continue
+		}
+
+		m := rsyncLogLineRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		msg := m[1]
+		p := rsyncQuotedPathRegex.FindStringSubmatch(msg)
+		if p == nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(msg, "file has vanished: "):
+			current.Vanished = append(current.Vanished, p[1])
+		case strings.HasPrefix(msg, "rsync: connection"):
+		case strings.HasPrefix(msg, "rsync: opendir ") || strings.Contains(msg, "mkdir ") || strings.HasSuffix(p[1], "/"):
+			current.DirsFailed = append(current.DirsFailed, p[1])
+		case strings.HasPrefix(msg, "rsync: "):
+			current.Failed = append(current.Failed, p[1])
+		}
+	}
+
+	vanished := make(map[string]bool)
+	failed := make(map[string]bool)
+	dirsFailed := make(map[string]bool)
+	for _, src := range order {
+		a := attempts[src]
+		r.Files += a.Files
+		r.FilesCreated += a.FilesCreated
+		r.FilesDeleted += a.FilesDeleted
+		r.FilesTransferred += a.FilesTransferred
+		r.TotalBytes += a.TotalBytes
+		r.TransferredBytes += a.TransferredBytes
+		r.SentBytes += a.SentBytes
+		r.ReceivedBytes += a.ReceivedBytes
+		r.Vanished = appendUnique(r.Vanished, a.Vanished, vanished)
+		r.Failed = appendUnique(r.Failed, a.Failed, failed)
+		r.DirsFailed = appendUnique(r.DirsFailed, a.DirsFailed, dirsFailed)
+	}
+	r.FilesFailed = int64(len(r.Failed))
+	return scanner.Err()
+}
+
+// appendUnique appends the paths not in seen yet to list
+func appendUnique(list []string, paths []string, seen map[string]bool) []string {
+	for _, p := range paths {
+		if !seen[p] {
+			seen[p] = true
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// reportRsyncRun writes the report for a CephFS run next to its log and exports it as the last run's metrics.
+// The counts of an rsync run are parsed from its log, the repo engine fills them in as it backs up.
+func reportRsyncRun(j *CephFSJob, logFileName string, started time.Time, success bool, r *RsyncReport) {
+	r.Job = j.Name
+	r.Started = started
+	r.Finished = time.Now()
+	r.Success = success
+	r.Interrupted = isShuttingDown()
+	r.DurationSeconds = r.Finished.Sub(r.Started).Seconds()
+	if j.Engine != "repo" {
+		if err := parseRsyncLog(logFileName, r); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("Unable to parse rsync log %s: %s", logFileName, err.Error())
+		}
+	}
+	if r.DurationSeconds > 0 {
+		r.BytesPerSecond = float64(r.SentBytes+r.ReceivedBytes) / r.DurationSeconds
+	}
+
+	if err := writeState(rsyncReportFile(logFileName), r); err != nil {
+		logger.Errorf("Unable to write rsync report for CephFS job %s: %s", j.Name, err.Error())
+	}
+	logger.Infof("CephFS job %s rsync: %d files transferred, %d deleted, %d failed, %d vanished, %d bytes sent in %.0fs",
+		j.Name, r.FilesTransferred, r.FilesDeleted, r.FilesFailed, len(r.Vanished), r.SentBytes, r.DurationSeconds)
+
+	metricCephFSRsyncFilesTransferred.WithLabelValues(j.Name).Set(float64(r.FilesTransferred))
+	metricCephFSRsyncFilesDeleted.WithLabelValues(j.Name).Set(float64(r.FilesDeleted))
+	metricCephFSRsyncFilesFailed.WithLabelValues(j.Name).Set(float64(r.FilesFailed))
+	metricCephFSRsyncFilesVanished.WithLabelValues(j.Name).Set(float64(len(r.Vanished)))
+	metricCephFSRsyncTotalBytes.WithLabelValues(j.Name).Set(float64(r.TotalBytes))
+	metricCephFSRsyncSentBytes.WithLabelValues(j.Name).Set(float64(r.SentBytes))
+	metricCephFSRsyncBytesPerSecond.WithLabelValues(j.Name).Set(r.BytesPerSecond)
+	metricCephFSRsyncDuration.WithLabelValues(j.Name).Set(r.DurationSeconds)
+}
+
+// latestRsyncReport returns the report of the job's newest successful rsync, or nil if it has none
+func latestRsyncReport(j *CephFSJob) (*RsyncReport, error) {
+	files, err := ioutil.ReadDir(j.BackupMount)
+	if err != nil {
+		return nil, err
+	}
+	re := regexp.MustCompile("^" + regexp.QuoteMeta(j.LogPrefix) + "[0-9]{4}-[0-9]{2}-[0-9]{2}_[0-9]{2}:[0-9]{2}\\.log\\.json$")
+	var names []string
+	for _, f := range files {
+		if re.MatchString(f.Name()) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		r := &RsyncReport{}
+		if err := readState(filepath.Join(j.BackupMount, name), r); err != nil {
+			logger.Errorf("Unable to read rsync report %s: %s", name, err.Error())
+			continue
+		}
+		if r.Success && !r.Interrupted {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
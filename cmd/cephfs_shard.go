@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	metricCephFSRsyncShards = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_shards",
+			Help: "The number of rsyncs the last CephFS run was split into",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncShardsFailed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_rsync_shards_failed",
+			Help: "The number of rsyncs that still failed after retries in the last CephFS run",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncShardRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cephback_cephfs_rsync_shard_retries",
+			Help: "The number of times a failed rsync shard was retried",
+		},
+		[]string{"cephfs_job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCephFSRsyncShards)
+	prometheus.MustRegister(metricCephFSRsyncShardsFailed)
+	prometheus.MustRegister(metricCephFSRsyncShardRetries)
+}
+
+// rsyncTask is a single rsync of part of a source. Key is the path relative to the job's source.
+// Tasks which are not recursive only copy the files in a directory and delete entries removed from it.
+type rsyncTask struct {
+	Key       string
+	Src       string
+	Dst       string
+	LinkDest  string
+	Recursive bool
+}
+
+// rsyncTasks splits a source into shards. Directories depth levels down are copied recursively, each in its own
+// rsync, and every directory above them gets a non-recursive pass. A depth of 0 copies the source in one rsync.
+func rsyncTasks(src CephFSSource, depth int) (tasks []rsyncTask, err error) {
+	level := []string{""}
+	for d := 0; d < depth; d++ {
+		var next []string
+		for _, rel := range level {
+			tasks = append(tasks, shardTask(src, rel, false))
+			entries, err := ioutil.ReadDir(filepath.Join(src.Src, rel))
+			if err != nil {
+				return nil, fmt.Errorf("Unable to list %s for sharding: %s", filepath.Join(src.Src, rel), err.Error())
+			}
+			for _, e := range entries {
+				// symlinks to directories are copied as links by the pass above
+				if e.IsDir() {
+					next = append(next, filepath.Join(rel, e.Name()))
+				}
+			}
+		}
+		level = next
+	}
+	for _, rel := range level {
+		tasks = append(tasks, shardTask(src, rel, true))
+	}
+	return tasks, nil
+}
+
+func shardTask(src CephFSSource, rel string, recursive bool) rsyncTask {
+	t := rsyncTask{
+		Key:       filepath.Join(src.Key, rel),
+		Src:       filepath.Join(src.Src, rel),
+		Dst:       filepath.Join(src.Dst, rel),
+		Recursive: recursive,
+	}
+	if src.LinkDest != "" {
+		t.LinkDest = filepath.Join(src.LinkDest, rel)
+	}
+	return t
+}
+
+// runRsyncTask runs the rsync for a task and returns true if it exited with one of the job's valid exit codes
+func runRsyncTask(j *CephFSJob, t rsyncTask, logFileName string) bool {
+	if err := os.MkdirAll(filepath.Dir(t.Dst), 0755); err != nil {
+		logger.Errorf("Unable to create rsync destination %s: %s", t.Dst, err.Error())
+		return false
+	}
+
+	// each attempt logs on its own and is added to the run's log as a whole, so a retried shard can be told apart
+	attempt, err := ioutil.TempFile(filepath.Dir(logFileName), filepath.Base(logFileName)+".shard")
+	if err != nil {
+		logger.Errorf("Unable to create rsync log for %s: %s", t.Src, err.Error())
+		return false
+	}
+	attempt.Close()
+	defer os.Remove(attempt.Name())
+
+	var cmdArgs []string
+	cmdArgs = append(cmdArgs, j.RsyncArgs...)
+	if !t.Recursive {
+		cmdArgs = append(cmdArgs, "--no-recursive", "--dirs")
+	}
+	if t.LinkDest != "" {
+		cmdArgs = append(cmdArgs, fmt.Sprintf("--link-dest=%s", t.LinkDest))
+	}
+	cmdArgs = append(cmdArgs, []string{
+		"--stats",
+		"--no-human-readable",
+		fmt.Sprintf("--log-file=%s", attempt.Name()),
+		fmt.Sprintf("%s/", t.Src),
+		fmt.Sprintf("%s/", t.Dst),
+	}...)
+
+	exitCode, stdout, err := execCommand("rsync", cmdArgs)
+	appendRsyncAttempt(logFileName, t.Src, attempt.Name(), stdout)
+	if !validExitCode(exitCode, j.RsyncValidExitCodes) {
+		if err != nil {
+			logger.Errorf("rsync of %s returned an error: %s", t.Src, err.Error())
+		} else {
+			logger.Errorf("rsync of %s returned exit code %d", t.Src, exitCode)
+		}
+		return false
+	}
+	return true
+}
+
+// runRsyncTasks runs the non-recursive tasks in order, so that parent directories exist, then the recursive
+// tasks on the job's worker pool. Failed tasks of either kind are retried on their own and any that still fail
+// are returned.
+func runRsyncTasks(j *CephFSJob, tasks []rsyncTask, logFileName string) (failed []rsyncTask) {
+	metricCephFSRsyncShards.WithLabelValues(j.Name).Set(float64(len(tasks)))
+
+	var ordered, recursive []rsyncTask
+	for _, t := range tasks {
+		if t.Recursive {
+			recursive = append(recursive, t)
+		} else {
+			ordered = append(ordered, t)
+		}
+	}
+
+	for attempt := 0; attempt <= cephfsRsyncShardRetries && len(ordered)+len(recursive) > 0 && !isShuttingDown(); attempt++ {
+		if attempt > 0 {
+			logger.Warnf("Retrying %d failed rsync shards for CephFS job %s, attempt %d", len(ordered)+len(recursive), j.Name, attempt)
+			metricCephFSRsyncShardRetries.WithLabelValues(j.Name).Add(float64(len(ordered) + len(recursive)))
+		}
+		var orderedFailed []rsyncTask
+		for _, t := range ordered {
+			if !runRsyncTask(j, t, logFileName) {
+				orderedFailed = append(orderedFailed, t)
+			}
+		}
+		ordered = orderedFailed
+		recursive = runRsyncPool(j, recursive, logFileName)
+	}
+	failed = append(ordered, recursive...)
+
+	for _, t := range failed {
+		logger.Errorf("Rsync shard %s for CephFS job %s failed", t.Src, j.Name)
+	}
+	metricCephFSRsyncShardsFailed.WithLabelValues(j.Name).Set(float64(len(failed)))
+	return failed
+}
+
+// runRsyncPool runs tasks on up to j.Workers rsyncs at a time and returns the tasks that failed
+func runRsyncPool(j *CephFSJob, tasks []rsyncTask, logFileName string) (failed []rsyncTask) {
+	var wg sync.WaitGroup
+	var failedMutex sync.Mutex
+	queue := make(chan rsyncTask)
+
+	workers := j.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				if !runRsyncTask(j, t, logFileName) {
+					failedMutex.Lock()
+					failed = append(failed, t)
+					failedMutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i, t := range tasks {
+		if isShuttingDown() {
+			// tasks that never ran count as failed
+			failedMutex.Lock()
+			failed = append(failed, tasks[i:]...)
+			failedMutex.Unlock()
+			break
+		}
+		queue <- t
+	}
+	close(queue)
+	wg.Wait()
+	return failed
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// native CephFS snapshots taken by cephback are directories in .snap named cephback_<job>_<time>, so that jobs
+// snapshotting the same directory can tell their snapshots apart
+func cephfsNativeSnapRegex(jobName string) *regexp.Regexp {
+	return regexp.MustCompile("^cephback_" + regexp.QuoteMeta(jobName) + "_[0-9]{4}-[0-9]{2}-[0-9]{2}_[0-9]{2}:[0-9]{2}$")
+}
+
+// CephFSSnapshot is a native CephFS snapshot of a directory, Dir is relative to the CephFS mount
+type CephFSSnapshot struct {
+	Dir  string
+	Name string
+}
+
+// Path returns the read-only view of the directory as it was when the snapshot was taken
+func (s CephFSSnapshot) Path() string {
+	return filepath.Join(cephfsMount, s.Dir, ".snap", s.Name)
+}
+
+// cephfsSnapshotDirs returns the directories to snapshot for a job relative to the CephFS mount, the job's source if none are configured
+func cephfsSnapshotDirs(j *CephFSJob) (dirs []string) {
+	if len(j.SnapshotDirs) == 0 {
+		return []string{j.Source}
+	}
+	for _, d := range j.SnapshotDirs {
+		dirs = append(dirs, filepath.Join(j.Source, d))
+	}
+	return dirs
+}
+
+// createCephFSSnapshots snapshots each of the job's directories by creating a directory in its .snap.
+// Snapshots created before an error are still returned so that the caller can remove them.
+func createCephFSSnapshots(j *CephFSJob, t time.Time) (snaps []CephFSSnapshot, err error) {
+	name := "cephback_" + j.Name + "_" + t.Format(layout)
+	for _, dir := range cephfsSnapshotDirs(j) {
+		// a snapshot of this job still in .snap was left by a run of it that died, the caller holds the job's
+		// rsync lock so no other run of it can be using one
+		pruneCephFSSnapshots(j, dir)
+
+		snap := CephFSSnapshot{Dir: dir, Name: name}
+		logger.Infof("Creating CephFS snapshot %s", snap.Path())
+		if err := os.Mkdir(snap.Path(), 0755); err != nil {
+			return snaps, fmt.Errorf("Error creating CephFS snapshot %s: %s", snap.Path(), err.Error())
+		}
+		metricCephFSNativeSnapshotsCreated.Inc()
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+func removeCephFSSnapshots(snaps []CephFSSnapshot) {
+	for _, snap := range snaps {
+		logger.Infof("Removing CephFS snapshot %s", snap.Path())
+		if err := os.Remove(snap.Path()); err != nil {
+			logger.Errorf("Error removing CephFS snapshot %s: %s", snap.Path(), err.Error())
+		}
+	}
+}
+
+// pruneCephFSSnapshots removes the job's snapshots of a directory, returning the number removed. Snapshots of
+// other jobs are left alone, they may be in use by a run of that job.
+func pruneCephFSSnapshots(j *CephFSJob, dir string) (pruned int) {
+	own := cephfsNativeSnapRegex(j.Name)
+	snapDir := filepath.Join(cephfsMount, dir, ".snap")
+	entries, err := ioutil.ReadDir(snapDir)
+	if err != nil {
+		logger.Errorf("Error reading CephFS snapshots in %s: %s", snapDir, err.Error())
+		return 0
+	}
+	for _, e := range entries {
+		if !own.MatchString(e.Name()) {
+			continue
+		}
+		p := filepath.Join(snapDir, e.Name())
+		logger.Warnf("Removing orphaned CephFS snapshot %s", p)
+		if err := os.Remove(p); err != nil {
+			logger.Errorf("Error removing orphaned CephFS snapshot %s: %s", p, err.Error())
+			continue
+		}
+		metricCephFSNativeSnapshotsPruned.Inc()
+		pruned++
+	}
+	return pruned
+}
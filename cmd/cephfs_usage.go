@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CephFSDirStats are the recursive statistics CephFS keeps for every directory
+type CephFSDirStats struct {
+	Bytes   uint64
+	Files   uint64
+	Subdirs uint64
+}
+
+// cephfsDirStats reads the ceph.dir.rbytes, rfiles and rsubdirs virtual xattrs of a directory
+func cephfsDirStats(path string) (stats CephFSDirStats, err error) {
+	for name, v := range map[string]*uint64{"ceph.dir.rbytes": &stats.Bytes, "ceph.dir.rfiles": &stats.Files, "ceph.dir.rsubdirs": &stats.Subdirs} {
+		s, err := getXattr(path, name)
+		if err != nil {
+			return stats, err
+		}
+		if *v, err = strconv.ParseUint(strings.TrimSpace(s), 10, 64); err != nil {
+			return stats, fmt.Errorf("Unable to parse %s of %s: %s", name, path, err.Error())
+		}
+	}
+	return stats, nil
+}
+
+var (
+	metricCephFSFiles = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_files",
+			Help: "Number of files on CephFS",
+		}, func() float64 { s, _ := cephfsDirStats(cephfsMount); return float64(s.Files) },
+	)
+	metricCephFSSubdirs = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "cephback_cephfs_subdirs",
+			Help: "Number of directories on CephFS",
+		}, func() float64 { s, _ := cephfsDirStats(cephfsMount); return float64(s.Subdirs) },
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCephFSFiles)
+	prometheus.MustRegister(metricCephFSSubdirs)
+	prometheus.MustRegister(newCephFSUsageCollector())
+}
+
+// usageStateFile is where the bytes in the job's last backup are kept per directory, next to the success file
+func usageStateFile(j *CephFSJob) string {
+	return j.SuccessFile + ".usage"
+}
+
+// usageDirs returns the directories exactly depth levels below root, relative to it
+func usageDirs(root string, depth int) ([]string, error) {
+	dirs := []string{""}
+	for d := 0; d < depth; d++ {
+		var next []string
+		for _, dir := range dirs {
+			entries, err := ioutil.ReadDir(filepath.Join(root, dir))
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.IsDir() {
+					next = append(next, filepath.Join(dir, e.Name()))
+				}
+			}
+		}
+		dirs = next
+	}
+	return dirs, nil
+}
+
+// usageDir returns the directory at cephfs-usage-depth a path relative to the job's source is counted under,
+// or "" if the path is above that depth
+func usageDir(rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) <= cephfsUsageDepth {
+		return ""
+	}
+	return filepath.Join(parts[:cephfsUsageDepth]...)
+}
+
+// measureBackupUsage records the backup usage of every job. It runs on its own schedule rather than after each
+// backup since measuring a copy means reading every inode of it.
+func measureBackupUsage() {
+	for _, j := range cephfsJobs {
+		if isShuttingDown() {
+			return
+		}
+		recordBackupUsage(j)
+	}
+}
+
+// recordBackupUsage records how many bytes the job's last backup holds for each directory at cephfs-usage-depth,
+// to compare with what CephFS reports for the source. The repo engine keeps the sizes in its snapshot tree,
+// copies are measured with du.
+func recordBackupUsage(j *CephFSJob) {
+	usage := make(map[string]uint64)
+
+	var err error
+	if j.Engine == "repo" {
+		var repo *Repository
+		var snap *RepoSnapshot
+		if repo, err = openRepository(j.Repository); err == nil {
+			if snap, err = repo.findSnapshot(j.Name, "latest"); err == nil {
+				err = repo.walkTree(snap, func(n *RepoNode) error {
+					if dir := usageDir(n.Path); n.Type == "file" && dir != "" {
+						usage[dir] += uint64(n.Size)
+					}
+					return nil
+				})
+			}
+		}
+	} else {
+		root := backupRoot(j)
+		var dirs []string
+		if dirs, err = usageDirs(root, cephfsUsageDepth); err == nil {
+			for _, dir := range dirs {
+				var bytes uint64
+				if bytes, err = duBytes(filepath.Join(root, dir)); err != nil {
+					break
+				}
+				usage[dir] = bytes
+			}
+		}
+	}
+	if err != nil {
+		logger.Errorf("Unable to measure backup usage for CephFS job %s: %s", j.Name, err.Error())
+		return
+	}
+	if err := writeState(usageStateFile(j), usage); err != nil {
+		logger.Errorf("Unable to write backup usage for CephFS job %s: %s", j.Name, err.Error())
+	}
+}
+
+// duBytes returns the apparent size of the files below a directory, hard links counted once
+func duBytes(path string) (uint64, error) {
+	exitCode, stdout, err := execCommand("du", []string{"-s", "--bytes", path})
+	if err != nil || exitCode != 0 {
+		return 0, fmt.Errorf("du of %s failed with exit code %d: %v", path, exitCode, err)
+	}
+	fields := strings.Fields(stdout)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("du of %s returned nothing", path)
+	}
+	return strconv.ParseUint(fields[0], 10, 64)
+}
+
+// cephfsUsageCollector reports the size of each directory at cephfs-usage-depth below each job's source when
+// scraped, next to the size of that directory in the job's last backup
+type cephfsUsageCollector struct {
+	dirBytes       *prometheus.Desc
+	dirFiles       *prometheus.Desc
+	dirBackupBytes *prometheus.Desc
+}
+
+func newCephFSUsageCollector() *cephfsUsageCollector {
+	labels := []string{"cephfs_job", "path"}
+	return &cephfsUsageCollector{
+		dirBytes:       prometheus.NewDesc("cephback_cephfs_dir_bytes", "Number of bytes below a CephFS directory", labels, nil),
+		dirFiles:       prometheus.NewDesc("cephback_cephfs_dir_files", "Number of files below a CephFS directory", labels, nil),
+		dirBackupBytes: prometheus.NewDesc("cephback_cephfs_dir_backup_bytes", "Number of bytes below a CephFS directory in the last backup", labels, nil),
+	}
+}
+
+func (c *cephfsUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.dirBytes
+	ch <- c.dirFiles
+	ch <- c.dirBackupBytes
+}
+
+func (c *cephfsUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	if cephfsUsageDepth <= 0 {
+		return
+	}
+	for _, j := range cephfsJobs {
+		dirs, err := usageDirs(j.SourcePath(), cephfsUsageDepth)
+		if err != nil {
+			logger.Errorf("Unable to list CephFS directories for job %s: %s", j.Name, err.Error())
+			continue
+		}
+		backup := make(map[string]uint64)
+		if err := readState(usageStateFile(j), &backup); err != nil {
+			logger.Errorf("Unable to read backup usage for CephFS job %s: %s", j.Name, err.Error())
+		}
+		for _, dir := range dirs {
+			stats, err := cephfsDirStats(filepath.Join(j.SourcePath(), dir))
+			if err != nil {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(c.dirBytes, prometheus.GaugeValue, float64(stats.Bytes), j.Name, dir)
+			ch <- prometheus.MustNewConstMetric(c.dirFiles, prometheus.GaugeValue, float64(stats.Files), j.Name, dir)
+			ch <- prometheus.MustNewConstMetric(c.dirBackupBytes, prometheus.GaugeValue, float64(backup[dir]), j.Name, dir)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var configCheckPaths bool
+var configShowEffective bool
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the cephback configuration",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the configuration and report every error found",
+	Run: func(cmd *cobra.Command, args []string) {
+		keyringOffline = true
+		errs := validateConfig()
+		if configCheckPaths {
+			errs = append(errs, checkConfigPaths()...)
+		}
+		if viper.ConfigFileUsed() != "" {
+			fmt.Printf("Config file: %s\n", viper.ConfigFileUsed())
+		}
+		if len(errs) > 0 {
+			for e := range errs {
+				fmt.Fprintf(os.Stderr, "ERROR: %s\n", errs[e].Error())
+			}
+			fmt.Fprintf(os.Stderr, "%d errors found\n", len(errs))
+			os.Exit(1)
+		}
+		fmt.Println("Config OK")
+	},
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the configuration and where each value comes from",
+	Long: `Show the configuration and where each value comes from.
+
+By default only settings that have been set by a flag, environment variable or the config file are shown.
+With --effective every setting is shown, merged in the order cephback applies them: flag, env, file, default.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE")
+		for _, s := range configSources() {
+			if !configShowEffective && s.Source == "default" {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%v\t%s\n", s.Name, s.Value, s.Source)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	configValidateCmd.Flags().BoolVar(&configCheckPaths, "check-paths", false, "Also check that the configured paths exist on this host")
+	configShowCmd.Flags().BoolVar(&configShowEffective, "effective", false, "Show every setting including defaults")
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configShowCmd)
+	RootCmd.AddCommand(configCmd)
+}
+
+// ConfigSource is a single setting along with where its value came from
+type ConfigSource struct {
+	Name   string
+	Value  interface{}
+	Source string
+}
+
+// configSources returns every known setting with the source viper would take its value from
+func configSources() (sources []ConfigSource) {
+	RootCmd.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		source := "default"
+		if f.Changed {
+			source = "flag"
+		} else if _, ok := os.LookupEnv(strings.ToUpper(f.Name)); ok {
+			source = "env"
+		} else if viper.InConfig(f.Name) {
+			source = "file"
+		}
+		sources = append(sources, ConfigSource{Name: f.Name, Value: viper.Get(f.Name), Source: source})
+	})
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Name < sources[j].Name })
+	return sources
+}
+
+// checkConfigPaths checks that the configured mounts exist and that the directories for files we create are present
+func checkConfigPaths() (errs []error) {
+	for _, t := range []string{"cephfs-mount", "backup-mount"} {
+		p := viper.GetString(t)
+		fi, err := os.Stat(p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Unable to use '%s' setting: %s", t, err.Error()))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("Unable to use '%s' setting: '%s' is not a directory", t, p))
+		}
+	}
+	for _, t := range []string{"cephfs-rsync-lock", "cephfs-success-file"} {
+		p := filepath.Dir(viper.GetString(t))
+		if _, err := os.Stat(p); err != nil {
+			errs = append(errs, fmt.Errorf("Unable to use '%s' setting: %s", t, err.Error()))
+		}
+	}
+	return errs
+}
+
+var (
+	metricConfigVersion = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cephback_config_version",
+			Help: "Incremented every time a config is successfully loaded",
+		},
+	)
+	metricConfigLastLoaded = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cephback_config_last_loaded",
+			Help: "The epoch timestamp of the last successful config load",
+		},
+	)
+	metricConfigReloadFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_config_reload_failures",
+			Help: "The number of config reloads rejected due to errors",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricConfigVersion)
+	prometheus.MustRegister(metricConfigLastLoaded)
+	prometheus.MustRegister(metricConfigReloadFailures)
+}
+
+// ConfigStatus describes the config currently in use
+type ConfigStatus struct {
+	Version    int       `json:"version"`
+	File       string    `json:"file"`
+	Loaded     time.Time `json:"loaded"`
+	LastErrors []string  `json:"lastErrors,omitempty"`
+}
+
+var configStatus ConfigStatus
+var configMutex sync.Mutex
+
+func markConfigLoaded() {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	configStatus.Version++
+	configStatus.File = viper.ConfigFileUsed()
+	configStatus.Loaded = time.Now()
+	configStatus.LastErrors = nil
+	metricConfigVersion.Set(float64(configStatus.Version))
+	metricConfigLastLoaded.Set(float64(configStatus.Loaded.Unix()))
+	logger.Infof("Loaded config version %d", configStatus.Version)
+}
+
+// the config file as last loaded without errors, put back into viper when a reload is rejected
+var lastGoodConfig []byte
+
+// reloadConfig validates the changed config and only applies it if there are no errors, otherwise the running config is kept
+func reloadConfig() {
+	data, err := readConfigFile()
+	configReadErr = err
+	errs := validateConfig()
+	if len(errs) > 0 {
+		var msgs []string
+		for e := range errs {
+			logger.Error(errs[e].Error())
+			msgs = append(msgs, errs[e].Error())
+		}
+		logger.Errorf("Config reload rejected with %d errors, keeping config version %d", len(errs), configStatus.Version)
+		metricConfigReloadFailures.Inc()
+		configMutex.Lock()
+		configStatus.LastErrors = msgs
+		configMutex.Unlock()
+		restoreConfig()
+		return
+	}
+	lastGoodConfig = data
+
+	// these are only used at startup, keep what is running rather than pretend they were applied
+	listen, user := httpListen, cephUser
+	setConfigVars()
+	if httpListen != listen {
+		logger.Warnf("Setting 'listen' changed from %s to %s, restart cephback to apply it", listen, httpListen)
+		httpListen = listen
+	}
+	if cephUser != user {
+		logger.Warnf("Setting 'ceph-user' changed from %s to %s, restart cephback to apply it", user, cephUser)
+		cephUser = user
+	}
+	markConfigLoaded()
+	startScheduler()
+}
+
+// readConfigFile reads the config file into viper and returns what it read
+func readConfigFile() ([]byte, error) {
+	file := viper.ConfigFileUsed()
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	viper.SetConfigType(strings.TrimPrefix(filepath.Ext(file), "."))
+	return data, viper.ReadConfig(bytes.NewReader(data))
+}
+
+// restoreConfig puts the last good config file back into viper, so values from a rejected reload do not linger
+func restoreConfig() {
+	if lastGoodConfig == nil {
+		return
+	}
+	if err := viper.ReadConfig(bytes.NewReader(lastGoodConfig)); err != nil {
+		logger.Errorf("Unable to restore the last good config: %s", err.Error())
+		return
+	}
+	configReadErr = nil
+}
+
+func httpConfig(w http.ResponseWriter, r *http.Request) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configStatus)
+}
@@ -28,8 +28,8 @@ func CephConnInit() error {
 		}
 	}
 	if iocx == nil {
-		logger.Info("Opening ceph IO Context")
-		if iocx, err = conn.OpenIOContext("rbd"); err != nil {
+		logger.Infof("Opening ceph IO Context for pool %s", cephPool)
+		if iocx, err = conn.OpenIOContext(cephPool); err != nil {
 			return errors.New(fmt.Sprintf("Error opening IOContext. %s", err))
 		}
 	}
@@ -0,0 +1,284 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// encrypted data starts with this magic, followed by the key id length, the key id, the nonce and the AES-256-GCM
+// ciphertext. Everything before the ciphertext is authenticated as additional data.
+var encryptionMagic = []byte("CBK1")
+
+// Keyring holds the encryption keys by id. New data is always encrypted with the active key, any key can decrypt,
+// so keys are rotated by adding a new key, making it active and re-encrypting before the old key is removed.
+type Keyring struct {
+	Keys   map[string][]byte
+	Active string
+}
+
+// set by config validate, which must work without access to the cluster and so does not read the key secret
+var keyringOffline bool
+
+// loadKeyring reads the keys from the configured key file or Kubernetes secret, returning nil if encryption is off
+func loadKeyring() (*Keyring, error) {
+	if !viper.GetBool("encryption") {
+		return nil, nil
+	}
+
+	k := &Keyring{Keys: make(map[string][]byte)}
+	if f := viper.GetString("encryption-key-file"); f != "" {
+		if err := k.readKeyFile(f); err != nil {
+			return nil, err
+		}
+	}
+	if s := viper.GetString("encryption-key-secret"); s != "" {
+		parts := strings.SplitN(s, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Unable to parse 'encryption-key-secret' setting: '%s' must be namespace/name", s)
+		}
+		// the keys in the secret can only be checked from inside the cluster
+		if keyringOffline {
+			return k, nil
+		}
+		data, err := getSecretData(parts[0], parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read encryption key secret %s: %s", s, err.Error())
+		}
+		for id, key := range data {
+			if err := k.add(id, string(key)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(k.Keys) == 0 {
+		return nil, fmt.Errorf("Encryption is enabled but no keys were found in 'encryption-key-file' or 'encryption-key-secret'")
+	}
+
+	k.Active = viper.GetString("encryption-key-active")
+	if k.Active == "" {
+		if len(k.Keys) > 1 {
+			return nil, fmt.Errorf("More than one encryption key found, choose one with 'encryption-key-active'")
+		}
+		for id := range k.Keys {
+			k.Active = id
+		}
+	}
+	if _, ok := k.Keys[k.Active]; !ok {
+		return nil, fmt.Errorf("Active encryption key '%s' not found", k.Active)
+	}
+	return k, nil
+}
+
+// readKeyFile reads a key file of "<id> <base64 key>" lines, blank lines and lines starting with # are ignored
+func (k *Keyring) readKeyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read encryption key file: %s", err.Error())
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("Unable to parse encryption key file %s: lines must be '<id> <base64 key>'", path)
+		}
+		if err := k.add(fields[0], fields[1]); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// add adds a base64 encoded key. Keys in the secret are base64 encoded too, on top of the encoding of the
+// secret itself, so that a key can never be mistaken for another encoding.
+func (k *Keyring) add(id string, encoded string) error {
+	if len(id) == 0 || len(id) > 255 {
+		return fmt.Errorf("Encryption key id '%s' must be between 1 and 255 characters", id)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("Encryption key '%s' must be 32 bytes, base64 encoded", id)
+	}
+	k.Keys[id] = key
+	return nil
+}
+
+// ids returns the key ids in order, for reporting
+func (k *Keyring) ids() (ids []string) {
+	for id := range k.Keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data with the active key, or returns it unchanged if encryption is off
+func seal(data []byte) ([]byte, error) {
+	k := encryptionKeys
+	if k == nil {
+		return data, nil
+	}
+	gcm, err := newGCM(k.Keys[k.Active])
+	if err != nil {
+		return nil, err
+	}
+	header := append(append([]byte{}, encryptionMagic...), byte(len(k.Active)))
+	header = append(header, k.Active...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	return gcm.Seal(header, nonce, data, header), nil
+}
+
+// unseal decrypts data written by seal with whichever key it was sealed with. Data without the magic was written
+// before encryption was turned on and is returned as is.
+func unseal(data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	k := encryptionKeys
+	if k == nil {
+		return nil, fmt.Errorf("Data is encrypted but encryption is not enabled")
+	}
+	if len(data) < len(encryptionMagic)+1 {
+		return nil, fmt.Errorf("Encrypted data is truncated")
+	}
+	idLen := int(data[len(encryptionMagic)])
+	idEnd := len(encryptionMagic) + 1 + idLen
+	if len(data) < idEnd {
+		return nil, fmt.Errorf("Encrypted data is truncated")
+	}
+	id := string(data[len(encryptionMagic)+1 : idEnd])
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Data is encrypted with key '%s' which is not in the keyring", id)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonceEnd := idEnd + gcm.NonceSize()
+	if len(data) < nonceEnd {
+		return nil, fmt.Errorf("Encrypted data is truncated")
+	}
+	plain, err := gcm.Open(nil, data[idEnd:nonceEnd], data[nonceEnd:], data[:nonceEnd])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt data with key '%s': %s", id, err.Error())
+	}
+	return plain, nil
+}
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, encryptionMagic)
+}
+
+// sealedKeyID returns the id of the key data was sealed with, or "" if it is not encrypted
+func sealedKeyID(data []byte) string {
+	if !isSealed(data) || len(data) < len(encryptionMagic)+1 {
+		return ""
+	}
+	idEnd := len(encryptionMagic) + 1 + int(data[len(encryptionMagic)])
+	if len(data) < idEnd {
+		return ""
+	}
+	return string(data[len(encryptionMagic)+1 : idEnd])
+}
+
+// rekeyFile re-encrypts a file with the active key unless it already is, it returns whether the file was rewritten.
+// Files that do not exist are skipped.
+func rekeyFile(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if sealedKeyID(data) == encryptionKeys.Active {
+		return false, nil
+	}
+	plain, err := unseal(data)
+	if err != nil {
+		return false, fmt.Errorf("Unable to read %s: %s", path, err.Error())
+	}
+	sealed, err := seal(plain)
+	if err != nil {
+		return false, err
+	}
+	tmp := fmt.Sprintf("%s.tmp%d", path, os.Getpid())
+	if err := ioutil.WriteFile(tmp, sealed, 0600); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// rekeyState re-encrypts the state files and logs written outside of the repositories: those of each CephFS
+// job, the RBD change state and the trash state and holds
+func rekeyState() (rekeyed int, err error) {
+	if encryptionKeys == nil {
+		return 0, fmt.Errorf("Encryption is not enabled")
+	}
+	paths := []string{rbdChangeState, trashState, trashHoldsFile()}
+	for _, j := range cephfsJobs {
+		paths = append(paths, rctimeStateFile(j), capacityStateFile(j), usageStateFile(j), guardFile(j))
+		for _, pattern := range []string{"*.log.enc", "*.log.json"} {
+			logs, _ := filepath.Glob(filepath.Join(j.BackupMount, j.LogPrefix+pattern))
+			paths = append(paths, logs...)
+		}
+	}
+	for _, p := range paths {
+		ok, err := rekeyFile(p)
+		if err != nil {
+			return rekeyed, err
+		}
+		if ok {
+			rekeyed++
+		}
+	}
+	logger.Infof("Re-encrypted %d state files and logs with key %s", rekeyed, encryptionKeys.Active)
+	return rekeyed, nil
+}
+
+// sealFile replaces a file with an encrypted copy named path.enc, used for the rsync logs once they are complete
+func sealFile(path string) error {
+	if encryptionKeys == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(data)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".enc", sealed, 0600); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
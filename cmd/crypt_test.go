@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeyring(active string, keys map[string]byte) *Keyring {
+	k := &Keyring{Keys: make(map[string][]byte), Active: active}
+	for id, b := range keys {
+		k.Keys[id] = bytes.Repeat([]byte{b}, 32)
+	}
+	return k
+}
+
+// withKeyring makes k the keyring, the returned func puts the previous one back
+func withKeyring(k *Keyring) func() {
+	old := encryptionKeys
+	encryptionKeys = k
+	return func() { encryptionKeys = old }
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	defer withKeyring(testKeyring("a", map[string]byte{"a": 1}))()
+	plain := []byte("backup manifest")
+	sealed, err := seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plain) {
+		t.Fatal("sealed data holds the plaintext")
+	}
+	if id := sealedKeyID(sealed); id != "a" {
+		t.Fatalf("sealed with key %q, want a", id)
+	}
+	got, err := unseal(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("unsealed %q, want %q", got, plain)
+	}
+}
+
+func TestUnsealPlain(t *testing.T) {
+	defer withKeyring(testKeyring("a", map[string]byte{"a": 1}))()
+	plain := []byte(`{"written":"before encryption"}`)
+	got, err := unseal(plain)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("unseal of plain data = %q, %v", got, err)
+	}
+}
+
+func TestUnsealWrongKey(t *testing.T) {
+	defer withKeyring(testKeyring("a", map[string]byte{"a": 1}))()
+	sealed, err := seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptionKeys = testKeyring("a", map[string]byte{"a": 2})
+	if _, err := unseal(sealed); err == nil {
+		t.Fatal("unsealed with the wrong key")
+	}
+	encryptionKeys = testKeyring("b", map[string]byte{"b": 1})
+	if _, err := unseal(sealed); err == nil {
+		t.Fatal("unsealed with a key missing from the keyring")
+	}
+	encryptionKeys = nil
+	if _, err := unseal(sealed); err == nil {
+		t.Fatal("unsealed with encryption off")
+	}
+}
+
+func TestUnsealTampered(t *testing.T) {
+	defer withKeyring(testKeyring("a", map[string]byte{"a": 1}))()
+	sealed, err := seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(encryptionMagic); i < len(sealed); i++ {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 0x80
+		if _, err := unseal(tampered); err == nil {
+			t.Fatalf("unsealed data with byte %d changed", i)
+		}
+	}
+	if _, err := unseal(sealed[:len(sealed)-1]); err == nil {
+		t.Fatal("unsealed truncated data")
+	}
+}
+
+func TestRekeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cephback-crypt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	defer withKeyring(testKeyring("a", map[string]byte{"a": 1}))()
+	sealed, err := seal([]byte("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	encryptionKeys = testKeyring("b", map[string]byte{"a": 1, "b": 2})
+	if ok, err := rekeyFile(path); err != nil || !ok {
+		t.Fatalf("rekeyFile = %t, %v", ok, err)
+	}
+	if ok, err := rekeyFile(path); err != nil || ok {
+		t.Fatalf("second rekeyFile = %t, %v, want nothing to do", ok, err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := sealedKeyID(data); id != "b" {
+		t.Fatalf("rekeyed with key %q, want b", id)
+	}
+	encryptionKeys = testKeyring("b", map[string]byte{"b": 2})
+	if got, err := unseal(data); err != nil || string(got) != "state" {
+		t.Fatalf("unseal after rekey = %q, %v", got, err)
+	}
+	if ok, err := rekeyFile(filepath.Join(dir, "missing")); err != nil || ok {
+		t.Fatalf("rekeyFile of a missing file = %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"time"
+)
+
+// how much usage history is kept for the capacity forecast
+var capacityHistoryMax = 90 * 24 * time.Hour
+
+var (
+	metricBackupDaysUntilFull = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_backup_days_until_full",
+			Help: "Forecast days until the CephFS job's backup filesystem is full, +Inf if usage is not growing",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricBackupGrowthBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_backup_growth_bytes_per_day",
+			Help: "Growth trend of the CephFS job's backup filesystem usage",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricBackupProjectedBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_backup_projected_bytes",
+			Help: "Forecast backup filesystem usage plus retained snapshot size one retention period (snap age max) from now",
+		},
+		[]string{"cephfs_job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricBackupDaysUntilFull)
+	prometheus.MustRegister(metricBackupGrowthBytes)
+	prometheus.MustRegister(metricBackupProjectedBytes)
+}
+
+// CapacitySample is the backup usage recorded after a run
+type CapacitySample struct {
+	Time          time.Time
+	UsedBytes     uint64
+	SizeBytes     uint64
+	SnapshotBytes uint64
+}
+
+// CapacityForecast is the growth trend fitted to a job's capacity samples
+type CapacityForecast struct {
+	BytesPerDay    float64
+	DaysUntilFull  float64
+	ProjectedBytes float64
+}
+
+// capacityStateFile is where the job's usage history is kept, next to the success file
+func capacityStateFile(j *CephFSJob) string {
+	return j.SuccessFile + ".capacity"
+}
+
+// recordCapacity appends the current backup usage, and the size of the job's RBD snapshots, to the job's history
+func recordCapacity(j *CephFSJob) {
+	disk := DiskUsage(j.BackupMount)
+	if disk.All == 0 {
+		return
+	}
+	sample := CapacitySample{Time: time.Now(), UsedBytes: disk.Used, SizeBytes: disk.Used + disk.Free}
+	if j.RbdName != "" {
+		du, err := rbdDiskUsage(j.RbdName)
+		if err != nil {
+			logger.Errorf("Unable to read snapshot usage of %s: %s", j.RbdName, err.Error())
+		} else {
+			// what was written up to the newest snapshot, as rbd du gives each snapshot what changed since the one before
+			for _, e := range du.Images {
+				if e.Snapshot != "" {
+					sample.SnapshotBytes += e.UsedSize
+				}
+			}
+		}
+	}
+
+	var samples []CapacitySample
+	if err := readState(capacityStateFile(j), &samples); err != nil {
+		logger.Errorf("Unable to read capacity history for CephFS job %s: %s", j.Name, err.Error())
+	}
+	for len(samples) > 0 && time.Since(samples[0].Time) > capacityHistoryMax {
+		samples = samples[1:]
+	}
+	samples = append(samples, sample)
+	if err := writeState(capacityStateFile(j), samples); err != nil {
+		logger.Errorf("Unable to write capacity history for CephFS job %s: %s", j.Name, err.Error())
+	}
+}
+
+// linearFit returns the least squares slope and intercept of y against x
+func linearFit(x []float64, y []float64) (slope float64, intercept float64) {
+	n := float64(len(x))
+	var sx, sy, sxx, sxy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		sxy += x[i] * y[i]
+	}
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0, sy / n
+	}
+	slope = (n*sxy - sx*sy) / d
+	return slope, (sy - slope*sx) / n
+}
+
+// forecastCapacity fits a trend to the job's history, returning nil until there are two samples to fit
+func forecastCapacity(j *CephFSJob) (*CapacityForecast, error) {
+	var samples []CapacitySample
+	if err := readState(capacityStateFile(j), &samples); err != nil {
+		return nil, err
+	}
+	if len(samples) < 2 {
+		return nil, nil
+	}
+
+	// fit in days relative to now so that the intercept is today's usage
+	var days, used, total []float64
+	for _, s := range samples {
+		days = append(days, -time.Since(s.Time).Hours()/24)
+		used = append(used, float64(s.UsedBytes))
+		total = append(total, float64(s.UsedBytes+s.SnapshotBytes))
+	}
+	slope, now := linearFit(days, used)
+	totalSlope, totalNow := linearFit(days, total)
+
+	// a managed RBD is grown as it fills, so it is full at its maximum size
+	size := float64(samples[len(samples)-1].SizeBytes)
+	if cephfsRbdManage && j.RbdName != "" && float64(cephfsRbdMaxSize) > size {
+		size = float64(cephfsRbdMaxSize)
+	}
+
+	f := &CapacityForecast{BytesPerDay: slope, DaysUntilFull: math.Inf(1)}
+	if slope > 0 {
+		f.DaysUntilFull = math.Max(0, (size-now)/slope)
+	}
+	f.ProjectedBytes = totalNow + totalSlope*j.SnapAgeMax.Hours()/24
+	return f, nil
+}
+
+// checkCapacityHealth updates the job's forecast metrics and warns when it is forecast to fill within the window
+func checkCapacityHealth(j *CephFSJob) {
+	f, err := forecastCapacity(j)
+	if err != nil {
+		logger.Errorf("Unable to forecast capacity for CephFS job %s: %s", j.Name, err.Error())
+		return
+	}
+	if f == nil {
+		return
+	}
+	metricBackupDaysUntilFull.WithLabelValues(j.Name).Set(f.DaysUntilFull)
+	metricBackupGrowthBytes.WithLabelValues(j.Name).Set(f.BytesPerDay)
+	metricBackupProjectedBytes.WithLabelValues(j.Name).Set(f.ProjectedBytes)
+
+	if f.DaysUntilFull*24 < capacityWarningWindow.Hours() {
+		msg := fmt.Sprintf("WARNING: backup for CephFS job %s is forecast to be full in %.1f days", j.Name, f.DaysUntilFull)
+		health.Set("capacity-"+j.Name, msg)
+		logger.Warn(msg)
+	} else {
+		health.Set("capacity-"+j.Name, "")
+	}
+}
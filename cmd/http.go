@@ -11,15 +11,27 @@ func httpHello(w http.ResponseWriter, r *http.Request) {
 }
 
 func httpHealthz(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, health.Status()) // send data to client side
+	fmt.Fprintln(w, health.Status()) // send data to client side
+	for _, j := range cephfsJobs {
+		if info, err := lockHolder(j.LockFile); err == nil && info != nil {
+			fmt.Fprintf(w, "CephFS job %s rsync lock: %s\n", j.Name, info)
+		}
+	}
 }
 
 func httpServe() {
+	startBrowseReaper()
 
 	go func() {
 		logger.Infof("Listening on %s", httpListen)
 		http.HandleFunc("/", httpHello)
 		http.HandleFunc("/healthz", httpHealthz)
+		http.HandleFunc("/api/config", httpConfig)
+		http.HandleFunc("/api/cephfs/pvs", httpCephFSPvs)
+		http.HandleFunc("/api/cephfs/catalog", httpCatalog)
+		http.HandleFunc("/api/rbd/usage", httpSpaceReport)
+		http.HandleFunc("/api/rbd/trash", httpTrash)
+		http.Handle(browsePrefix+"/", httpBrowse())
 		http.Handle("/metrics", promhttp.Handler())
 		err := http.ListenAndServe(httpListen, nil)
 		if err != nil {
@@ -4,6 +4,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/v1"
+	metav1 "k8s.io/client-go/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
 )
 
@@ -28,7 +29,7 @@ func getBoundRbdPvImages() ([]string, error) {
 	return boundPVImages, nil
 }
 
-func getRbdPvImages(phase string) ([]string, error) {
+func listPvs() (*v1.PersistentVolumeList, error) {
 	// creates the in-cluster config
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -39,7 +40,24 @@ func getRbdPvImages(phase string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	pv, err := clientset.Core().PersistentVolumes().List(v1.ListOptions{})
+	return clientset.Core().PersistentVolumes().List(v1.ListOptions{})
+}
+
+// rbdPvInPool tells if a PV is an RBD image in ceph-pool, the only pool cephback works on. Kubernetes defaults
+// the pool of an RBD PV to rbd.
+func rbdPvInPool(r *v1.RBDVolumeSource) bool {
+	if r == nil {
+		return false
+	}
+	pool := r.RBDPool
+	if pool == "" {
+		pool = "rbd"
+	}
+	return pool == cephPool
+}
+
+func getRbdPvImages(phase string) ([]string, error) {
+	pv, err := listPvs()
 	if err != nil {
 		return nil, err
 	}
@@ -49,7 +67,7 @@ func getRbdPvImages(phase string) ([]string, error) {
 	for x := range pv.Items {
 		p := pv.Items[x]
 		if string(p.Status.Phase) == phase {
-			if p.Spec.PersistentVolumeSource.RBD != nil {
+			if rbdPvInPool(p.Spec.PersistentVolumeSource.RBD) {
 				matchingPVImages = append(matchingPVImages, p.Spec.PersistentVolumeSource.RBD.RBDImage)
 			}
 		}
@@ -57,3 +75,88 @@ func getRbdPvImages(phase string) ([]string, error) {
 
 	return matchingPVImages, nil
 }
+
+// CephFSPv is a CephFS backed persistent volume
+type CephFSPv struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Namespace string `json:"namespace,omitempty"`
+	Claim     string `json:"claim,omitempty"`
+}
+
+func getCephFSPvs(phase string) ([]CephFSPv, error) {
+	pv, err := listPvs()
+	if err != nil {
+		return nil, err
+	}
+
+	var matchingPVs []CephFSPv
+
+	for x := range pv.Items {
+		p := pv.Items[x]
+		if string(p.Status.Phase) == phase {
+			if p.Spec.PersistentVolumeSource.CephFS != nil {
+				c := CephFSPv{Name: p.Name, Path: p.Spec.PersistentVolumeSource.CephFS.Path}
+				if c.Path == "" {
+					c.Path = "/"
+				}
+				if p.Spec.ClaimRef != nil {
+					c.Namespace = p.Spec.ClaimRef.Namespace
+					c.Claim = p.Spec.ClaimRef.Name
+				}
+				matchingPVs = append(matchingPVs, c)
+			}
+		}
+	}
+
+	return matchingPVs, nil
+}
+
+func getSecretData(namespace string, name string) (map[string][]byte, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := clientset.Core().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// RbdPv is an RBD backed persistent volume and the claim it belongs to
+type RbdPv struct {
+	Name      string `json:"pv"`
+	Image     string `json:"image"`
+	Phase     string `json:"phase"`
+	Namespace string `json:"namespace,omitempty"`
+	Claim     string `json:"claim,omitempty"`
+}
+
+// getRbdPvs returns every RBD persistent volume whatever its phase
+func getRbdPvs() ([]RbdPv, error) {
+	pv, err := listPvs()
+	if err != nil {
+		return nil, err
+	}
+
+	var pvs []RbdPv
+
+	for x := range pv.Items {
+		p := pv.Items[x]
+		if rbdPvInPool(p.Spec.PersistentVolumeSource.RBD) {
+			r := RbdPv{Name: p.Name, Image: p.Spec.PersistentVolumeSource.RBD.RBDImage, Phase: string(p.Status.Phase)}
+			if p.Spec.ClaimRef != nil {
+				r.Namespace = p.Spec.ClaimRef.Namespace
+				r.Claim = p.Spec.ClaimRef.Name
+			}
+			pvs = append(pvs, r)
+		}
+	}
+
+	return pvs, nil
+}
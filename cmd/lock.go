@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexflint/go-filemutex"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+var (
+	metricCephFSRsyncLockBusy = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cephback_cephfs_rsync_lock_busy",
+			Help: "The number of rsyncs skipped because the lock was held",
+		},
+		[]string{"cephfs_job"},
+	)
+	metricCephFSRsyncLockStaleBroken = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_cephfs_rsync_lock_stale_broken",
+			Help: "The number of stale rsync locks left by dead processes that were broken",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCephFSRsyncLockBusy)
+	prometheus.MustRegister(metricCephFSRsyncLockStaleBroken)
+}
+
+// LockInfo identifies the holder of a lock file
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+func (i *LockInfo) String() string {
+	return fmt.Sprintf("held by pid %d on %s since %s (%s)", i.PID, i.Host, i.Started.Format(time.RFC3339), time.Since(i.Started).Truncate(time.Second))
+}
+
+// FileLock is an flock based lock whose file records the holder
+type FileLock struct {
+	path string
+	m    *filemutex.FileMutex
+}
+
+// readLockInfo returns the holder recorded in a lock file, or nil if the lock is free
+func readLockInfo(path string) (*LockInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var info LockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("Unable to parse lock file %s: %s", path, err.Error())
+	}
+	return &info, nil
+}
+
+// lockHolder returns the holder of a lock file, or nil if the lock is free. The holder recorded in the file is
+// only trusted while the file is flocked, a holder that died leaves its info behind until the lock is taken again.
+func lockHolder(path string) (*LockInfo, error) {
+	info, err := readLockInfo(path)
+	if err != nil || info == nil {
+		return info, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	// a shared probe fails while the holder has its exclusive lock, and does not get in the way of other probes
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		return info, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error probing lock %s: %s", path, err.Error())
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return nil, nil
+}
+
+// acquireLock tries to take the lock, retrying until wait has passed. The flock is released by the kernel when
+// the holder dies, so holder info found in the file once we have the lock was left by a dead process and is broken.
+func acquireLock(path string, wait time.Duration) (*FileLock, error) {
+	m, err := filemutex.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("Lock file %s could not be created: %s", path, err.Error())
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err = m.TryLock()
+		if err == nil {
+			break
+		}
+		if err != filemutex.AlreadyLocked {
+			m.Close()
+			return nil, fmt.Errorf("Error locking %s: %s", path, err.Error())
+		}
+		if time.Now().After(deadline) || isShuttingDown() {
+			m.Close()
+			info, _ := readLockInfo(path)
+			if info == nil {
+				return nil, fmt.Errorf("Lock %s is held by an unknown process", path)
+			}
+			return nil, fmt.Errorf("Lock %s is %s", path, info)
+		}
+		time.Sleep(time.Second)
+	}
+
+	if info, err := readLockInfo(path); err != nil || info != nil {
+		if info != nil {
+			logger.Warnf("Breaking stale lock %s %s", path, info)
+		} else {
+			logger.Warnf("Breaking stale lock %s: %s", path, err.Error())
+		}
+		metricCephFSRsyncLockStaleBroken.Inc()
+	}
+
+	host, _ := os.Hostname()
+	data, _ := json.Marshal(LockInfo{PID: os.Getpid(), Host: host, Started: time.Now()})
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		logger.Errorf("Unable to record lock holder in %s: %s", path, err.Error())
+	}
+	return &FileLock{path: path, m: m}, nil
+}
+
+// release clears the holder info and unlocks
+func (l *FileLock) release() {
+	if err := os.Truncate(l.path, 0); err != nil {
+		logger.Errorf("Unable to clear lock holder in %s: %s", l.path, err.Error())
+	}
+	l.m.Unlock()
+	l.m.Close()
+}
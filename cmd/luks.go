@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The rsync and generations engines copy files as they are, so with encryption on their backup RBD is a LUKS
+// volume. Each key of the keyring unlocks it with a passphrase derived from the key, and rekey adds the active
+// key's passphrase to it. A passphrase only unlocks the volume key, so removing a key from the keyring does not
+// re-encrypt anything, and snapshots taken before a rekey only open with the keys they were taken with.
+
+// luksPassphrase derives the passphrase of a key, the key itself never reaches cryptsetup
+func luksPassphrase(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("cephback luks"))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// luksName is the device mapper name the LUKS volume of an image is opened as
+func luksName(image string) string {
+	return "cephback-" + image
+}
+
+// isLuks tells if a device holds a LUKS volume
+func isLuks(dev string) (bool, error) {
+	exitCode, _, err := execCommand("cryptsetup", []string{"isLuks", dev})
+	if exitCode < 0 {
+		return false, err
+	}
+	return exitCode == 0, nil
+}
+
+// luksKeyIDs returns the key ids to try on a volume, the active key first
+func luksKeyIDs() []string {
+	ids := []string{encryptionKeys.Active}
+	for _, id := range encryptionKeys.ids() {
+		if id != encryptionKeys.Active {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// luksFormat creates a LUKS volume on a device, unlocked by the active key
+func luksFormat(dev string) error {
+	logger.Warnf("Creating LUKS volume on %s", dev)
+	exitCode, _, err := execCommandInput("cryptsetup", []string{"luksFormat", "--batch-mode", "--key-file", "-", dev},
+		luksPassphrase(encryptionKeys.Keys[encryptionKeys.Active]))
+	if exitCode != 0 {
+		return fmt.Errorf("Unable to create LUKS volume on %s: exit code %d %v", dev, exitCode, err)
+	}
+	return nil
+}
+
+// luksOpen opens the LUKS volume on a device as name with whichever key unlocks it, and returns the mapper device
+func luksOpen(dev string, name string, readOnly bool) (string, error) {
+	mapped := "/dev/mapper/" + name
+	if _, err := os.Stat(mapped); err == nil {
+		return mapped, nil
+	}
+	if encryptionKeys == nil {
+		return "", fmt.Errorf("%s is encrypted but encryption is not enabled", dev)
+	}
+	args := []string{"open", "--type", "luks", "--key-file", "-"}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	args = append(args, dev, name)
+	for _, id := range luksKeyIDs() {
+		if exitCode, _, _ := execCommandInput("cryptsetup", args, luksPassphrase(encryptionKeys.Keys[id])); exitCode == 0 {
+			return mapped, nil
+		}
+	}
+	return "", fmt.Errorf("No key of the keyring unlocks %s", dev)
+}
+
+// luksClose closes an open LUKS volume
+func luksClose(name string) error {
+	if exitCode, _, err := execCommand("cryptsetup", []string{"close", name}); exitCode != 0 {
+		return fmt.Errorf("Unable to close %s: exit code %d %v", name, exitCode, err)
+	}
+	return nil
+}
+
+// luksResize grows an open LUKS volume to the size of its device
+func luksResize(name string) error {
+	exitCode, _, err := execCommandInput("cryptsetup", []string{"resize", "--key-file", "-", name},
+		luksPassphrase(encryptionKeys.Keys[encryptionKeys.Active]))
+	if exitCode != 0 {
+		return fmt.Errorf("Unable to resize %s: exit code %d %v", name, exitCode, err)
+	}
+	return nil
+}
+
+// luksUnlocks tells if a key unlocks the LUKS volume on a device
+func luksUnlocks(dev string, key []byte) bool {
+	exitCode, _, _ := execCommandInput("cryptsetup", []string{"open", "--test-passphrase", "--key-file", "-", dev}, luksPassphrase(key))
+	return exitCode == 0
+}
+
+// luksAddActiveKey lets the active key unlock the LUKS volume on a device, it returns whether it was added
+func luksAddActiveKey(dev string) (bool, error) {
+	if luksUnlocks(dev, encryptionKeys.Keys[encryptionKeys.Active]) {
+		return false, nil
+	}
+	var unlocking []byte
+	for _, id := range luksKeyIDs() {
+		if luksUnlocks(dev, encryptionKeys.Keys[id]) {
+			unlocking = encryptionKeys.Keys[id]
+			break
+		}
+	}
+	if unlocking == nil {
+		return false, fmt.Errorf("No key of the keyring unlocks %s", dev)
+	}
+	// cryptsetup reads one passphrase from stdin, the new one has to be a file
+	f, err := ioutil.TempFile("", "cephback-luks-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(luksPassphrase(encryptionKeys.Keys[encryptionKeys.Active]))
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+	exitCode, _, err := execCommandInput("cryptsetup", []string{"luksAddKey", "--key-file", "-", dev, f.Name()}, luksPassphrase(unlocking))
+	if exitCode != 0 {
+		return false, fmt.Errorf("Unable to add key %s to %s: exit code %d %v", encryptionKeys.Active, dev, exitCode, err)
+	}
+	return true, nil
+}
+
+// openBackupLuks opens the LUKS volume of a backup RBD mapped at dev and returns the device to mount. An empty RBD
+// is formatted first. An RBD holding a plain filesystem is mounted as it is unless the job needs it encrypted.
+func openBackupLuks(j *CephFSJob, dev string) (string, error) {
+	encrypted, err := isLuks(dev)
+	if err != nil {
+		return "", err
+	}
+	if !encrypted {
+		if encryptionKeys == nil || j.Engine == "repo" {
+			return dev, nil
+		}
+		// blkid exits with 2 when it finds nothing at all on the device
+		exitCode, _, err := execCommand("blkid", []string{"-o", "value", "-s", "TYPE", dev})
+		if err != nil && exitCode != 2 {
+			return "", err
+		}
+		if exitCode != 2 {
+			return "", fmt.Errorf("Backup RBD %s holds an unencrypted filesystem, the %s engine needs a new, empty backup RBD to encrypt", j.RbdName, j.Engine)
+		}
+		if err := luksFormat(dev); err != nil {
+			return "", err
+		}
+	}
+	return luksOpen(dev, luksName(j.RbdName), false)
+}
+
+// rekeyBackupRbds adds the active key to the LUKS volumes of the backup RBDs, it returns how many were changed
+func rekeyBackupRbds() (rekeyed int, err error) {
+	done := make(map[string]bool)
+	for _, j := range cephfsJobs {
+		if j.RbdName == "" || done[j.RbdName] {
+			continue
+		}
+		done[j.RbdName] = true
+		dev, err := rbdMappedDevice(j.RbdName, "")
+		if err != nil {
+			return rekeyed, err
+		}
+		if dev == "" {
+			logger.Warnf("Backup RBD %s is not mapped, its LUKS volume was not rekeyed", j.RbdName)
+			continue
+		}
+		if encrypted, err := isLuks(dev); err != nil || !encrypted {
+			continue
+		}
+		added, err := luksAddActiveKey(dev)
+		if err != nil {
+			return rekeyed, err
+		}
+		if added {
+			logger.Infof("Added key %s to the LUKS volume of backup RBD %s", encryptionKeys.Active, j.RbdName)
+			rekeyed++
+		}
+	}
+	return rekeyed, nil
+}
+
+// isMapperDevice tells if a device is a device mapper volume, such as an open LUKS volume
+func isMapperDevice(dev string) bool {
+	return strings.HasPrefix(dev, "/dev/mapper/")
+}
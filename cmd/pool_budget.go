@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ceph/go-ceph/rbd"
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"time"
+)
+
+var (
+	metricPoolUsedRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cephback_pool_used_ratio",
+			Help: "How full the pool holding the RBD images is, from 0 to 1",
+		},
+	)
+	metricPoolSoftLimitExceeded = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cephback_pool_soft_limit_exceeded",
+			Help: "Whether the pool is above pool-soft-limit-pct and snapshots are pruned to make space",
+		},
+	)
+	metricPoolHardLimitExceeded = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cephback_pool_hard_limit_exceeded",
+			Help: "Whether the pool is above pool-hard-limit-pct and no snapshots are created",
+		},
+	)
+	metricPoolBudgetSnapshotsDeleted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_pool_budget_snapshots_deleted",
+			Help: "The number of snapshots deleted early because the pool was above its soft limit",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricPoolUsedRatio)
+	prometheus.MustRegister(metricPoolSoftLimitExceeded)
+	prometheus.MustRegister(metricPoolHardLimitExceeded)
+	prometheus.MustRegister(metricPoolBudgetSnapshotsDeleted)
+}
+
+// PoolUsage is the data stored in the pool and how much more can be stored, both logical bytes as written by
+// clients, before replication
+type PoolUsage struct {
+	UsedBytes  uint64
+	AvailBytes uint64
+}
+
+// Ratio is how full the pool is, from 0 to 1
+func (p PoolUsage) Ratio() float64 {
+	if p.UsedBytes+p.AvailBytes == 0 {
+		return 0
+	}
+	return float64(p.UsedBytes) / float64(p.UsedBytes+p.AvailBytes)
+}
+
+// poolUsage asks the monitors how full the pool is. max_avail already allows for replication and the full ratio.
+// Since Nautilus bytes_used is raw, after replication, and stored is the logical size to compare max_avail with;
+// older releases only have bytes_used, which is logical there.
+func poolUsage() (u PoolUsage, err error) {
+	if err := CephConnInit(); err != nil {
+		return u, err
+	}
+	buf, info, err := conn.MonCommand([]byte(`{"prefix": "df", "format": "json"}`))
+	if err != nil {
+		return u, fmt.Errorf("ceph df failed: %s %s", err.Error(), info)
+	}
+	var df struct {
+		Pools []struct {
+			Name  string `json:"name"`
+			Stats struct {
+				BytesUsed uint64  `json:"bytes_used"`
+				Stored    *uint64 `json:"stored"`
+				MaxAvail  uint64  `json:"max_avail"`
+			} `json:"stats"`
+		} `json:"pools"`
+	}
+	if err := json.Unmarshal(buf, &df); err != nil {
+		return u, fmt.Errorf("Unable to parse ceph df output: %s", err.Error())
+	}
+	for _, p := range df.Pools {
+		if p.Name == cephPool {
+			u.UsedBytes = p.Stats.BytesUsed
+			if p.Stats.Stored != nil {
+				u.UsedBytes = *p.Stats.Stored
+			}
+			u.AvailBytes = p.Stats.MaxAvail
+			return u, nil
+		}
+	}
+	return u, fmt.Errorf("Pool %s not found in ceph df", cephPool)
+}
+
+// checkPoolBudget compares the pool's usage with its limits and reports it, it returns the usage and whether
+// snapshots may be created
+func checkPoolBudget() (PoolUsage, bool) {
+	u, err := poolUsage()
+	if err != nil {
+		// not knowing is no reason to stop taking snapshots
+		logger.Errorf("Unable to get usage of pool %s: %s", cephPool, err.Error())
+		return u, true
+	}
+	pct := u.Ratio() * 100
+	metricPoolUsedRatio.Set(u.Ratio())
+
+	if poolSoftLimitPct > 0 && pct >= float64(poolSoftLimitPct) {
+		metricPoolSoftLimitExceeded.Set(1)
+	} else {
+		metricPoolSoftLimitExceeded.Set(0)
+	}
+	if poolHardLimitPct > 0 && pct >= float64(poolHardLimitPct) {
+		metricPoolHardLimitExceeded.Set(1)
+		msg := fmt.Sprintf("CRITICAL: pool %s is %.1f%% full, above the hard limit of %d%%, no snapshots are being created", cephPool, pct, poolHardLimitPct)
+		health.Set("pool-space", msg)
+		logger.Error(msg)
+		return u, false
+	}
+	metricPoolHardLimitExceeded.Set(0)
+	health.Set("pool-space", "")
+	return u, true
+}
+
+// budgetImage is an image whose oldest snapshots may be deleted to make space, largest consumer first
+type budgetImage struct {
+	Name       string
+	Bytes      uint64
+	Candidates []SnapshotUsage
+}
+
+// budgetCandidates returns the managed, unpinned and unheld snapshots of an image beyond its minimum count, oldest first
+func budgetCandidates(imageName string, minKeep int) (b budgetImage, err error) {
+	u, err := imageUsage(imageName)
+	if err != nil {
+		return b, err
+	}
+	b.Name = imageName
+	var managed []SnapshotUsage
+	for _, s := range u.Snapshots {
+		if !s.Managed {
+			continue
+		}
+		if _, err := time.Parse(layout, s.Name); err == nil {
+			managed = append(managed, s)
+		}
+	}
+	sort.Slice(managed, func(i, j int) bool { return managed[i].Name < managed[j].Name })
+	if len(managed) <= minKeep {
+		return b, nil
+	}
+
+	held, err := heldSnaps(imageName)
+	if err != nil {
+		return b, err
+	}
+	img := rbd.GetImage(iocx, imageName)
+	if err := img.Open(); err != nil {
+		return b, err
+	}
+	defer img.Close()
+	for _, s := range managed[:len(managed)-minKeep] {
+		if stringInSlice(s.Name, held) {
+			continue
+		}
+		if protected, err := img.GetSnapshot(s.Name).IsProtected(); err != nil || protected {
+			continue
+		}
+		b.Candidates = append(b.Candidates, s)
+		b.Bytes += s.Bytes
+	}
+	return b, nil
+}
+
+// pruneForSpace deletes snapshots until enough is expected to be freed to bring the pool back under its soft limit.
+// Each step takes the oldest candidate of the image whose candidates hold the most, as fast as the pass allows.
+// A snapshot's bytes are the ones it holds alone, logical like the pool usage, so what deleting it frees; the image
+// is measured again after each deletion, as the next snapshot then holds more alone. Object granularity and the
+// pool's own overhead still make it an estimate: if the pool is still over its limit, the next pass prunes more.
+func pruneForSpace(u PoolUsage, images map[string]int, p *deletionPass) {
+	target := uint64(float64(u.UsedBytes+u.AvailBytes) * float64(poolSoftLimitPct) / 100)
+	if u.UsedBytes <= target {
+		return
+	}
+	need := u.UsedBytes - target
+	logger.Warnf("Pool %s is %.1f%% full, pruning snapshots to free %d bytes", cephPool, u.Ratio()*100, need)
+
+	var budget []*budgetImage
+	for imageName, minKeep := range images {
+		b, err := budgetCandidates(imageName, minKeep)
+		if err != nil {
+			logger.Errorf("Unable to get snapshot space of image %s: %s", imageName, err.Error())
+			continue
+		}
+		if len(b.Candidates) > 0 {
+			budget = append(budget, &b)
+		}
+	}
+
+	var freed uint64
+	deleted := 0
+	for freed < need && len(budget) > 0 && p.allow() {
+		sort.Slice(budget, func(i, j int) bool { return budget[i].Bytes > budget[j].Bytes })
+		b := budget[0]
+		s := b.Candidates[0]
+		b.Candidates = b.Candidates[1:]
+		b.Bytes -= s.Bytes
+		if len(b.Candidates) == 0 {
+			budget = budget[1:]
+		}
+
+		logger.Infof("Deleting snapshot %s@%s to free %d bytes in pool %s", b.Name, s.Name, s.Bytes, cephPool)
+		if err := removeSnap(b.Name, s.Name); err != nil {
+			logger.Errorf("Error deleting snapshot %s@%s: %s", b.Name, s.Name, err.Error())
+			continue
+		}
+		freed += s.Bytes
+		deleted++
+		metricPoolBudgetSnapshotsDeleted.Inc()
+
+		// what the next snapshot holds alone grows by what it shared only with the deleted one
+		if len(b.Candidates) > 0 {
+			nb, err := budgetCandidates(b.Name, images[b.Name])
+			if err != nil {
+				logger.Errorf("Unable to get snapshot space of image %s: %s", b.Name, err.Error())
+				continue
+			}
+			*b = nb
+			if len(b.Candidates) == 0 {
+				budget = budget[1:]
+			}
+		}
+	}
+	if freed < need {
+		logger.Errorf("Pool %s still over its soft limit, only %d of %d bytes could be freed from snapshots", cephPool, freed, need)
+	}
+	logger.Infof("Deleted %d snapshots to free %d bytes in pool %s", deleted, freed, cephPool)
+}
+
+// budgetImages returns the images retention manages with the minimum number of snapshots each must keep
+func budgetImages(rbdImages []string) map[string]int {
+	images := make(map[string]int)
+	for _, imageName := range rbdImages {
+		images[imageName] = rbdSnapCountMin
+	}
+	for _, j := range cephfsJobs {
+		if j.RbdName != "" {
+			_, _, images[j.RbdName] = rbdSnapPolicy(j)
+		}
+	}
+	return images
+}
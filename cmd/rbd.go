@@ -3,10 +3,11 @@ package cmd
 import (
 	//	"github.com/ceph/go-ceph/rbd"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
 	"time"
 )
 
-var rbdSnapshotRegex = "[0-9]{4}-[0-9]{2}-[0-9]{2}_[0-9]{2}:[0-9]{2}"
+var rbdSnapshotRegex = "^[0-9]{4}-[0-9]{2}-[0-9]{2}_[0-9]{2}:[0-9]{2}$"
 
 var (
 	metricRBDSnapshotsCreated = prometheus.NewCounter(
@@ -69,11 +70,21 @@ func purgeSnapsOnFailedPV() {
 
 	logger.Infof("purgeSnaps - Processing %d images", len(images))
 
+	p := newDeletionPass("failed-pv")
+	defer p.done()
+
 	for i := range images {
 		imageName := images[i]
 		logger.Debug("purgeSnaps - Processing image: ", imageName)
 
-		purgeSnaps(imageName)
+		// the trashed image no longer blocks deleting the PV, which then has to be deleted by hand
+		if trashEnabled {
+			if err := trashImage(imageName, "pv failed"); err != nil {
+				logger.Errorf("Unable to move image %s to the trash: %s", imageName, err.Error())
+			}
+			continue
+		}
+		purgeSnaps(imageName, p)
 	}
 }
 
@@ -92,15 +103,60 @@ func processImages() {
 
 	logger.Infof("processImages - Processing %d images", len(images))
 
+	var changes map[string]*ImageChange
+	if rbdChangeDetect {
+		if changes, err = readImageChanges(); err != nil {
+			logger.Errorf("Unable to read RBD change state: %s", err.Error())
+		}
+	}
+
+	p := newDeletionPass("retention")
+	defer p.done()
+
+	// once the pool is nearly full no more snapshots are taken
+	snapsAllowed := true
+	var usage PoolUsage
+	if poolSoftLimitPct > 0 || poolHardLimitPct > 0 {
+		usage, snapsAllowed = checkPoolBudget()
+	}
+
+	// every image is snapshotted before pruning and retention start, so a backlog of deletions held back by the
+	// throttle does not hold back the snapshots of the images after it
 	for i := range images {
 		imageName := images[i]
 		logger.Debug("Processing image: ", imageName)
 
-		metricRBDSnapshotsCreated.Add(float64(createSnap(imageName, rbdSnapAgeMin, false)))
-		metricRBDSnapshotsDeleted.Add(float64(deleteSnap(imageName, rbdSnapAgeMax, rbdSnapCountMin)))
-
+		if snapsAllowed {
+			metricRBDSnapshotsCreated.Add(float64(createSnap(imageName, rbdSnapAgeMin, "")))
+		}
+		// measured before retention runs, so a snapshot to pin is still there
+		if changes != nil {
+			recordImageChange(imageName, changes)
+		}
 		metricRBDImagesChecked.Inc()
 	}
+	if changes != nil {
+		writeImageChanges(changes, images)
+	}
+
+	// a pool running out of space is pruned before retention runs
+	if poolSoftLimitPct > 0 && usage.Ratio()*100 >= float64(poolSoftLimitPct) {
+		// the trash is emptied, oldest first and whether due or not, before any live snapshot goes, and the
+		// next pass sees what that freed
+		purged, pending := 0, false
+		if trashEnabled {
+			purged, pending = purgeTrashEntries(true)
+		}
+		if purged > 0 || pending {
+			logger.Warnf("Pool %s is %.1f%% full, purged %d trash entries before pruning snapshots", cephPool, usage.Ratio()*100, purged)
+		} else {
+			pruneForSpace(usage, budgetImages(images), p)
+		}
+	}
+
+	for i := range images {
+		metricRBDSnapshotsDeleted.Add(float64(deleteSnap(images[i], rbdSnapAgeMax, rbdSnapCountMin, p)))
+	}
 }
 
 // returns true if all images have a snapshot within the duration, false and a slice of unhealthy image names otherwise
@@ -125,3 +181,21 @@ func checkRbdImagesSnapHealth(youngerThan time.Duration) (healthy bool, imagesUn
 
 	return healthy, imagesUnhealthy
 }
+
+var rbdCmd = &cobra.Command{
+	Use:   "rbd",
+	Short: "Work with RBD image snapshots",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if errs := validateConfig(); len(errs) > 0 {
+			for e := range errs {
+				logger.Error(errs[e].Error())
+			}
+			logger.Fatalf("Invalid configuration, %d errors found", len(errs))
+		}
+		setConfigVars()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rbdCmd)
+}
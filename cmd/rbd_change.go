@@ -0,0 +1,466 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexflint/go-filemutex"
+	"github.com/ceph/go-ceph/rbd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	metricRBDChangeBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_rbd_change_bytes",
+			Help: "The bytes of an image that changed between its last two snapshots",
+		},
+		[]string{"image"},
+	)
+	metricRBDChangeRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_rbd_change_rate_bytes_per_hour",
+			Help: "How fast an image changed between its last two snapshots",
+		},
+		[]string{"image"},
+	)
+	metricRBDChangeBaseline = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_rbd_change_baseline_bytes_per_hour",
+			Help: "The moving average change rate of an image that spikes are compared with",
+		},
+		[]string{"image"},
+	)
+	metricRBDChangeAnomaly = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_rbd_change_anomaly",
+			Help: "Whether an image had a change rate spike that has not been cleared with rbd unpin yet",
+		},
+		[]string{"image"},
+	)
+	metricRBDChangeAnomalies = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_rbd_change_anomalies",
+			Help: "The number of change rate spikes detected on RBD images",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricRBDChangeBytes)
+	prometheus.MustRegister(metricRBDChangeRate)
+	prometheus.MustRegister(metricRBDChangeBaseline)
+	prometheus.MustRegister(metricRBDChangeAnomaly)
+	prometheus.MustRegister(metricRBDChangeAnomalies)
+}
+
+// ImageChange is how much an image changes between snapshots, kept per image in the rbd-change-state file
+type ImageChange struct {
+	LastSnap string    `json:"last_snap"`
+	LastTime time.Time `json:"last_time"`
+	Bytes    uint64    `json:"bytes"`
+	Rate     float64   `json:"rate"`
+	Baseline float64   `json:"baseline"`
+	Samples  int       `json:"samples"`
+	Anomaly  bool      `json:"anomaly"`
+	Pinned   []string  `json:"pinned,omitempty"`
+	// NotPinned has the snapshots before a spike that were already protected by something else, so not pinned
+	NotPinned []string `json:"not_pinned,omitempty"`
+
+	// what this pass found, merged into the state as it is when written, which rbd unpin may have changed
+	spike     bool
+	newPinned []string
+	notPinned []string
+}
+
+// rbdDiffExtent is an entry of rbd diff, older releases write exists as a string
+type rbdDiffExtent struct {
+	Offset uint64      `json:"offset"`
+	Length uint64      `json:"length"`
+	Exists interface{} `json:"exists"`
+}
+
+// exists tells if an extent holds data rather than being discarded
+func (e rbdDiffExtent) exists() bool {
+	switch v := e.Exists.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// rbdDiffExtents returns the extents of an image written or discarded between two of its snapshots, since it was
+// created if fromSnap is empty and up to the head if snap is
+func rbdDiffExtents(image string, fromSnap string, snap string) ([]rbdDiffExtent, error) {
+	args := []string{"diff", "--format", "json"}
+	if fromSnap != "" {
+		args = append(args, "--from-snap", fromSnap)
+	}
+	if snap != "" {
+		image = fmt.Sprintf("%s@%s", image, snap)
+	}
+	out, err := rbdCommand(append(args, image)...)
+	if err != nil {
+		return nil, err
+	}
+	var extents []rbdDiffExtent
+	if err := json.Unmarshal([]byte(out), &extents); err != nil {
+		return nil, fmt.Errorf("Unable to parse rbd diff output for %s: %s", image, err.Error())
+	}
+	return extents, nil
+}
+
+// rbdDiffBytes returns the bytes of an image written or discarded between two of its snapshots
+func rbdDiffBytes(image string, fromSnap string, snap string) (uint64, error) {
+	extents, err := rbdDiffExtents(image, fromSnap, snap)
+	if err != nil {
+		return 0, err
+	}
+	var total uint64
+	for _, e := range extents {
+		total += e.Length
+	}
+	return total, nil
+}
+
+// serialises changes to the RBD change state within this process, lockImageChanges also locks out the CLI
+var imageChangesMutex sync.Mutex
+
+// lockImageChanges takes the RBD change state lock, the returned func releases it
+func lockImageChanges() (func(), error) {
+	imageChangesMutex.Lock()
+	m, err := filemutex.New(rbdChangeState + ".lock")
+	if err != nil {
+		imageChangesMutex.Unlock()
+		return nil, err
+	}
+	if err := m.Lock(); err != nil {
+		m.Close()
+		imageChangesMutex.Unlock()
+		return nil, err
+	}
+	return func() {
+		m.Unlock()
+		m.Close()
+		imageChangesMutex.Unlock()
+	}, nil
+}
+
+func readImageChanges() (map[string]*ImageChange, error) {
+	changes := make(map[string]*ImageChange)
+	if err := readState(rbdChangeState, &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// datedSnaps returns the names of an image's retention-managed snapshots, oldest first
+func datedSnaps(imageName string) []string {
+	var names []string
+	for _, s := range getSnapshots(imageName) {
+		if matchSnapName(s.Name, rbdSnapshotRegex) {
+			if _, err := time.Parse(layout, s.Name); err == nil {
+				names = append(names, s.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkImageChange measures how much an image changed between its two newest snapshots, if it has not been
+// measured yet, and compares it with the image's baseline. On a spike the older snapshot, the last one from
+// before it, is protected so retention cannot remove it. A spike stays flagged until rbd unpin clears it.
+func checkImageChange(imageName string, c *ImageChange) {
+	snaps := datedSnaps(imageName)
+	if len(snaps) < 2 {
+		return
+	}
+	prev, last := snaps[len(snaps)-2], snaps[len(snaps)-1]
+	if c.LastSnap == last {
+		return
+	}
+
+	prevTime, _ := time.Parse(layout, prev)
+	lastTime, _ := time.Parse(layout, last)
+	hours := lastTime.Sub(prevTime).Hours()
+	if hours <= 0 {
+		return
+	}
+	bytes, err := rbdDiffBytes(imageName, prev, last)
+	if err != nil {
+		logger.Errorf("Unable to diff %s@%s against %s: %s", imageName, last, prev, err.Error())
+		return
+	}
+
+	c.LastSnap = last
+	c.LastTime = lastTime
+	c.Bytes = bytes
+	c.Rate = float64(bytes) / hours
+	if c.Samples >= rbdChangeMinSamples && bytes >= rbdChangeMinBytes && c.Rate > rbdChangeFactor*c.Baseline {
+		c.Anomaly, c.spike = true, true
+		metricRBDChangeAnomalies.Inc()
+		logger.Errorf("Image %s changed %d bytes between snapshots %s and %s, %.0f bytes/hour against a baseline of %.0f",
+			imageName, bytes, prev, last, c.Rate, c.Baseline)
+		if err := pinSnap(imageName, prev); err != nil {
+			logger.Errorf("Unable to pin snapshot %s@%s: %s", imageName, prev, err.Error())
+			c.notPinned = append(c.notPinned, prev)
+		} else {
+			c.newPinned = append(c.newPinned, prev)
+		}
+	}
+
+	// a spike moves the baseline too, so that a lasting change in workload stops alerting after a while
+	if c.Samples == 0 {
+		c.Baseline = c.Rate
+	} else {
+		c.Baseline = rbdChangeWeight*c.Rate + (1-rbdChangeWeight)*c.Baseline
+	}
+	c.Samples++
+}
+
+// snapPinned tells if a snapshot is pinned by a change rate spike
+func snapPinned(imageName string, snapName string) bool {
+	changes, err := readImageChanges()
+	if err != nil {
+		logger.Errorf("Unable to read RBD change state: %s", err.Error())
+		// better left protected than losing a pin
+		return true
+	}
+	c, ok := changes[imageName]
+	return ok && stringInSlice(snapName, c.Pinned)
+}
+
+// pinSnap protects a snapshot, which retention never deletes. A snapshot already protected for browse or restore
+// mounts is pinned too, as the mounts leave pinned snapshots protected. One protected by anything else is not, as
+// cephback would have no say over when it is unprotected.
+func pinSnap(imageName string, snapName string) error {
+	img := rbd.GetImage(iocx, imageName)
+	if err := img.Open(); err != nil {
+		return err
+	}
+	defer img.Close()
+	s := img.GetSnapshot(snapName)
+	protected, err := s.IsProtected()
+	if err != nil {
+		return err
+	}
+	if protected {
+		if !mountProtected(imageName, snapName) {
+			return fmt.Errorf("it is already protected by something other than cephback")
+		}
+		logger.Infof("Pinning snapshot %s@%s, already protected for mounts", imageName, snapName)
+		return nil
+	}
+	logger.Infof("Pinning snapshot %s@%s", imageName, snapName)
+	return s.Protect()
+}
+
+// unpinSnap unprotects a snapshot pinned by a spike so retention can delete it again. One that is not protected
+// any more is unpinned already, and one still cloned by mounts is unprotected by the last of them to close.
+func unpinSnap(imageName string, snapName string) error {
+	img := rbd.GetImage(iocx, imageName)
+	if err := img.Open(); err != nil {
+		return err
+	}
+	defer img.Close()
+	s := img.GetSnapshot(snapName)
+	protected, err := s.IsProtected()
+	if err != nil {
+		return err
+	}
+	if !protected {
+		logger.Infof("Snapshot %s@%s is not protected any more", imageName, snapName)
+		return nil
+	}
+	if children, err := snapChildren(imageName, snapName); err == nil && len(children) > 0 {
+		for _, c := range children {
+			if !isMountClone(imageName, c) {
+				return fmt.Errorf("it has clones: %s", strings.Join(children, ", "))
+			}
+		}
+		logger.Infof("Unpinning snapshot %s@%s, it stays protected until its mounts close", imageName, snapName)
+		return nil
+	}
+	logger.Infof("Unpinning snapshot %s@%s", imageName, snapName)
+	return s.Unprotect()
+}
+
+// recordImageChange measures the change rate of an image and exports it
+func recordImageChange(imageName string, changes map[string]*ImageChange) {
+	c, ok := changes[imageName]
+	if !ok {
+		c = &ImageChange{}
+		changes[imageName] = c
+	}
+	checkImageChange(imageName, c)
+
+	metricRBDChangeBytes.WithLabelValues(imageName).Set(float64(c.Bytes))
+	metricRBDChangeRate.WithLabelValues(imageName).Set(c.Rate)
+	metricRBDChangeBaseline.WithLabelValues(imageName).Set(c.Baseline)
+	if c.Anomaly {
+		metricRBDChangeAnomaly.WithLabelValues(imageName).Set(1)
+	} else {
+		metricRBDChangeAnomaly.WithLabelValues(imageName).Set(0)
+	}
+}
+
+// writeImageChanges saves the change state of the images processed, dropping images that are gone unless
+// they still have pinned snapshots. The state is read again under the lock and the measurements and new spikes
+// of this pass merged into it, so that an unpin made while the pass ran is kept.
+func writeImageChanges(changes map[string]*ImageChange, images []string) {
+	unlock, err := lockImageChanges()
+	if err != nil {
+		logger.Errorf("Unable to lock RBD change state: %s", err.Error())
+		return
+	}
+	defer unlock()
+	stored, err := readImageChanges()
+	if err != nil {
+		logger.Errorf("Unable to read RBD change state: %s", err.Error())
+		return
+	}
+	for imageName, c := range changes {
+		s, ok := stored[imageName]
+		if !ok {
+			s = &ImageChange{}
+			stored[imageName] = s
+		}
+		s.LastSnap, s.LastTime, s.Bytes, s.Rate, s.Baseline, s.Samples = c.LastSnap, c.LastTime, c.Bytes, c.Rate, c.Baseline, c.Samples
+		if c.spike {
+			s.Anomaly = true
+		}
+		for _, snap := range c.newPinned {
+			if !stringInSlice(snap, s.Pinned) {
+				s.Pinned = append(s.Pinned, snap)
+			}
+		}
+		for _, snap := range c.notPinned {
+			if !stringInSlice(snap, s.NotPinned) {
+				s.NotPinned = append(s.NotPinned, snap)
+			}
+		}
+	}
+	for imageName, s := range stored {
+		if !stringInSlice(imageName, images) && len(s.Pinned) == 0 {
+			delete(stored, imageName)
+			metricRBDChangeBytes.DeleteLabelValues(imageName)
+			metricRBDChangeRate.DeleteLabelValues(imageName)
+			metricRBDChangeBaseline.DeleteLabelValues(imageName)
+			metricRBDChangeAnomaly.DeleteLabelValues(imageName)
+		} else if !s.Anomaly {
+			metricRBDChangeAnomaly.WithLabelValues(imageName).Set(0)
+		}
+	}
+	if err := writeState(rbdChangeState, stored); err != nil {
+		logger.Errorf("Unable to write RBD change state: %s", err.Error())
+	}
+}
+
+// checkImageChangeHealth reports the images whose last change rate was a spike
+func checkImageChangeHealth() {
+	changes, err := readImageChanges()
+	if err != nil {
+		logger.Errorf("Unable to read RBD change state: %s", err.Error())
+		return
+	}
+	var spikes []string
+	for imageName, c := range changes {
+		if c.Anomaly {
+			spike := fmt.Sprintf("%s (%.0f bytes/hour, baseline %.0f, pinned %s", imageName, c.Rate, c.Baseline, strings.Join(c.Pinned, ","))
+			if len(c.NotPinned) > 0 {
+				spike += ", NOT pinned as protected by something else " + strings.Join(c.NotPinned, ",")
+			}
+			spikes = append(spikes, spike+")")
+		}
+	}
+	sort.Strings(spikes)
+	if len(spikes) == 0 {
+		health.Set("rbd-change", "")
+		return
+	}
+	msg := fmt.Sprintf("Change rate spike on %d RBD images: %s", len(spikes), strings.Join(spikes, " "))
+	health.Set("rbd-change", msg)
+	logger.Infof(msg)
+}
+
+var rbdChangesCmd = &cobra.Command{
+	Use:   "changes",
+	Short: "Show how much each RBD image changed between its last snapshots, against its baseline",
+	Run: func(cmd *cobra.Command, args []string) {
+		changes, err := readImageChanges()
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		var names []string
+		for imageName := range changes {
+			names = append(names, imageName)
+		}
+		sort.Strings(names)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "IMAGE\tSNAPSHOT\tCHANGED BYTES\tBYTES/HOUR\tBASELINE\tSAMPLES\tSPIKE\tPINNED")
+		for _, imageName := range names {
+			c := changes[imageName]
+			fmt.Fprintf(w, "%s\t%s\t%d\t%.0f\t%.0f\t%d\t%t\t%s\n", imageName, c.LastSnap, c.Bytes, c.Rate, c.Baseline,
+				c.Samples, c.Anomaly, strings.Join(c.Pinned, ","))
+		}
+		w.Flush()
+	},
+}
+
+var rbdUnpinCmd = &cobra.Command{
+	Use:   "unpin <image> [snapshot]",
+	Short: "Unprotect the snapshots of an image pinned by a change rate spike, so retention can delete them",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := CephConnInit(); err != nil {
+			logger.Fatal(err.Error())
+		}
+		unlock, err := lockImageChanges()
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		defer unlock()
+		changes, err := readImageChanges()
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		c, ok := changes[args[0]]
+		if !ok || (len(c.Pinned) == 0 && !c.Anomaly) {
+			logger.Fatalf("Image %s has no pinned snapshots", args[0])
+		}
+		var kept []string
+		for _, snap := range c.Pinned {
+			if len(args) == 2 && args[1] != snap {
+				kept = append(kept, snap)
+				continue
+			}
+			if err := unpinSnap(args[0], snap); err != nil {
+				logger.Errorf("Unable to unpin %s@%s: %s", args[0], snap, err.Error())
+				kept = append(kept, snap)
+			}
+		}
+		c.Pinned = kept
+		// acknowledging the spike clears the alert
+		if len(kept) == 0 {
+			c.Anomaly = false
+			c.NotPinned = nil
+		}
+		if err := writeState(rbdChangeState, changes); err != nil {
+			logger.Fatal(err.Error())
+		}
+	},
+}
+
+func init() {
+	rbdCmd.AddCommand(rbdChangesCmd)
+	rbdCmd.AddCommand(rbdUnpinCmd)
+}
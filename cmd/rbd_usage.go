@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SnapshotUsage is the space held by a snapshot. Bytes are exclusive to it, written since the previous snapshot
+// and overwritten before the next one or the head, which is what deleting it frees. WrittenBytes is everything
+// written between the previous snapshot and this one, as rbd du gives it. Managed snapshots are the ones cephback
+// takes and prunes.
+type SnapshotUsage struct {
+	Name         string `json:"name"`
+	Bytes        uint64 `json:"bytes"`
+	WrittenBytes uint64 `json:"written_bytes"`
+	Managed      bool   `json:"managed"`
+}
+
+// ImageUsage is the space used by an image and its snapshots. UsedBytes is all of it, HeadBytes what was written
+// since the newest snapshot and SnapshotBytes the rest, what was written up to the newest snapshot. Only the part
+// of SnapshotBytes the head has overwritten since would be freed by deleting every snapshot.
+type ImageUsage struct {
+	RbdPv
+	CephFSJob        string          `json:"cephfs_job,omitempty"`
+	ProvisionedBytes uint64          `json:"provisioned_bytes"`
+	UsedBytes        uint64          `json:"used_bytes"`
+	HeadBytes        uint64          `json:"head_bytes"`
+	SnapshotBytes    uint64          `json:"snapshot_bytes"`
+	Snapshots        []SnapshotUsage `json:"snapshots"`
+}
+
+// NamespaceUsage is the space used by the images of every claim in a namespace
+type NamespaceUsage struct {
+	Namespace     string `json:"namespace"`
+	Images        int    `json:"images"`
+	Snapshots     int    `json:"snapshots"`
+	UsedBytes     uint64 `json:"used_bytes"`
+	HeadBytes     uint64 `json:"head_bytes"`
+	SnapshotBytes uint64 `json:"snapshot_bytes"`
+}
+
+// SpaceReport is the result of one accounting pass
+type SpaceReport struct {
+	Time            time.Time        `json:"time"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	Images          []ImageUsage     `json:"images"`
+	Namespaces      []NamespaceUsage `json:"namespaces"`
+	Unmeasured      []string         `json:"unmeasured,omitempty"`
+}
+
+var spaceReport *SpaceReport
+var spaceReportMutex sync.Mutex
+
+func init() {
+	prometheus.MustRegister(newSpaceCollector())
+}
+
+// overlapBytes returns how many bytes two lists of diff extents have in common
+func overlapBytes(a []rbdDiffExtent, b []rbdDiffExtent) uint64 {
+	sort.Slice(a, func(i, j int) bool { return a[i].Offset < a[j].Offset })
+	sort.Slice(b, func(i, j int) bool { return b[i].Offset < b[j].Offset })
+	var total uint64
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := a[i].Offset, a[i].Offset+a[i].Length
+		if b[j].Offset > start {
+			start = b[j].Offset
+		}
+		if e := b[j].Offset + b[j].Length; e < end {
+			end = e
+		}
+		if end > start {
+			total += end - start
+		}
+		if a[i].Offset+a[i].Length < b[j].Offset+b[j].Length {
+			i++
+		} else {
+			j++
+		}
+	}
+	return total
+}
+
+// snapshotExclusiveBytes sets the exclusive bytes of an image's snapshots, which must be in the order they were
+// taken, as rbd du lists them. What a snapshot holds alone is what was written since the previous snapshot and
+// overwritten or discarded before the next one, or before the head for the newest.
+func snapshotExclusiveBytes(imageName string, snaps []SnapshotUsage) error {
+	if len(snaps) == 0 {
+		return nil
+	}
+	changed, err := rbdDiffExtents(imageName, "", snaps[0].Name)
+	if err != nil {
+		return err
+	}
+	for i := range snaps {
+		var written []rbdDiffExtent
+		for _, e := range changed {
+			if e.exists() {
+				written = append(written, e)
+			}
+		}
+		next := ""
+		if i+1 < len(snaps) {
+			next = snaps[i+1].Name
+		}
+		if changed, err = rbdDiffExtents(imageName, snaps[i].Name, next); err != nil {
+			return err
+		}
+		snaps[i].Bytes = overlapBytes(written, changed)
+	}
+	return nil
+}
+
+// imageUsage returns the space used by an image and each of its snapshots
+func imageUsage(imageName string) (u ImageUsage, err error) {
+	du, err := rbdDiskUsage(imageName)
+	if err != nil {
+		return u, err
+	}
+	u.UsedBytes = du.TotalUsedSize
+	for _, e := range du.Images {
+		if e.Snapshot == "" {
+			u.ProvisionedBytes = e.ProvisionedSize
+			u.HeadBytes = e.UsedSize
+			continue
+		}
+		u.Snapshots = append(u.Snapshots, SnapshotUsage{
+			Name:         e.Snapshot,
+			WrittenBytes: e.UsedSize,
+			Managed:      matchSnapName(e.Snapshot, rbdSnapshotRegex),
+		})
+	}
+	if err := snapshotExclusiveBytes(imageName, u.Snapshots); err != nil {
+		return u, err
+	}
+	if u.UsedBytes > u.HeadBytes {
+		u.SnapshotBytes = u.UsedBytes - u.HeadBytes
+	}
+	return u, nil
+}
+
+// accountSpace measures every RBD PV image and CephFS backup RBD, and rolls the PVs up by the namespace of their claim
+func accountSpace() {
+	if err = CephConnInit(); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	pvs, err := getRbdPvs()
+	if err != nil {
+		logger.Errorf("Unable to list RBD PVs for space accounting: %s", err.Error())
+		return
+	}
+	seen := make(map[string]bool)
+	for _, pv := range pvs {
+		seen[pv.Image] = true
+	}
+	for _, j := range cephfsJobs {
+		if j.RbdName != "" && !seen[j.RbdName] {
+			seen[j.RbdName] = true
+			pvs = append(pvs, RbdPv{Image: j.RbdName})
+		}
+	}
+
+	started := time.Now()
+	r := &SpaceReport{Time: started, Images: []ImageUsage{}, Namespaces: []NamespaceUsage{}}
+	namespaces := make(map[string]*NamespaceUsage)
+	for _, pv := range pvs {
+		// without fast-diff rbd du reads every object of the image
+		if !rbdAccountingFullScan {
+			fastDiff, err := rbdFastDiff(pv.Image)
+			if err != nil {
+				logger.Errorf("Unable to get features of image %s: %s", pv.Image, err.Error())
+				continue
+			}
+			if !fastDiff {
+				r.Unmeasured = append(r.Unmeasured, pv.Image)
+				continue
+			}
+		}
+		u, err := imageUsage(pv.Image)
+		if err != nil {
+			logger.Errorf("Unable to get space used by image %s: %s", pv.Image, err.Error())
+			continue
+		}
+		u.RbdPv = pv
+		if pv.Name == "" {
+			for _, j := range cephfsJobs {
+				if j.RbdName == pv.Image {
+					u.CephFSJob = j.Name
+				}
+			}
+		}
+		r.Images = append(r.Images, u)
+
+		n, ok := namespaces[pv.Namespace]
+		if !ok {
+			n = &NamespaceUsage{Namespace: pv.Namespace}
+			namespaces[pv.Namespace] = n
+		}
+		n.Images++
+		n.Snapshots += len(u.Snapshots)
+		n.UsedBytes += u.UsedBytes
+		n.HeadBytes += u.HeadBytes
+		n.SnapshotBytes += u.SnapshotBytes
+	}
+	for _, n := range namespaces {
+		r.Namespaces = append(r.Namespaces, *n)
+	}
+	sort.Slice(r.Images, func(a, b int) bool { return r.Images[a].SnapshotBytes > r.Images[b].SnapshotBytes })
+	sort.Slice(r.Namespaces, func(a, b int) bool { return r.Namespaces[a].SnapshotBytes > r.Namespaces[b].SnapshotBytes })
+	r.DurationSeconds = time.Since(started).Seconds()
+
+	if len(r.Unmeasured) > 0 {
+		logger.Warnf("Not accounting space of %d RBD images without fast-diff, set rbd-accounting-full-scan to read them in full: %s",
+			len(r.Unmeasured), strings.Join(r.Unmeasured, ", "))
+	}
+	logger.Infof("Accounted space of %d RBD images in %d namespaces in %.0fs", len(r.Images), len(r.Namespaces), r.DurationSeconds)
+	spaceReportMutex.Lock()
+	spaceReport = r
+	spaceReportMutex.Unlock()
+}
+
+// lastSpaceReport returns the result of the last accounting pass, or nil if there has not been one
+func lastSpaceReport() *SpaceReport {
+	spaceReportMutex.Lock()
+	defer spaceReportMutex.Unlock()
+	return spaceReport
+}
+
+// httpSpaceReport serves the last accounting pass, limited to one namespace with ?namespace=
+func httpSpaceReport(w http.ResponseWriter, r *http.Request) {
+	report := lastSpaceReport()
+	if report == nil {
+		http.Error(w, "No space accounting has run yet", http.StatusServiceUnavailable)
+		return
+	}
+	if ns, ok := r.URL.Query()["namespace"]; ok {
+		filtered := &SpaceReport{Time: report.Time, DurationSeconds: report.DurationSeconds, Images: []ImageUsage{}, Namespaces: []NamespaceUsage{}}
+		for _, u := range report.Images {
+			if u.Namespace == ns[0] {
+				filtered.Images = append(filtered.Images, u)
+			}
+		}
+		for _, n := range report.Namespaces {
+			if n.Namespace == ns[0] {
+				filtered.Namespaces = append(filtered.Namespaces, n)
+			}
+		}
+		report = filtered
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// spaceCollector reports the last accounting pass when scraped
+type spaceCollector struct {
+	imageUsed          *prometheus.Desc
+	imageHeadBytes     *prometheus.Desc
+	imageSnapshotBytes *prometheus.Desc
+	imageSnapshots     *prometheus.Desc
+	nsUsed             *prometheus.Desc
+	nsHeadBytes        *prometheus.Desc
+	nsSnapshotBytes    *prometheus.Desc
+	reportTime         *prometheus.Desc
+}
+
+func newSpaceCollector() *spaceCollector {
+	imageLabels := []string{"image", "namespace", "claim"}
+	nsLabels := []string{"namespace"}
+	return &spaceCollector{
+		imageUsed:          prometheus.NewDesc("cephback_rbd_image_used_bytes", "Number of bytes used by an RBD image and its snapshots together", imageLabels, nil),
+		imageHeadBytes:     prometheus.NewDesc("cephback_rbd_image_head_bytes", "Number of bytes written to an RBD image since its newest snapshot", imageLabels, nil),
+		imageSnapshotBytes: prometheus.NewDesc("cephback_rbd_image_snapshot_bytes", "Number of bytes written to an RBD image up to its newest snapshot, more than deleting the snapshots would free", imageLabels, nil),
+		imageSnapshots:     prometheus.NewDesc("cephback_rbd_image_snapshots", "Number of snapshots of an RBD image", imageLabels, nil),
+		nsUsed:             prometheus.NewDesc("cephback_namespace_used_bytes", "Number of bytes used by the RBD images claimed in a namespace and their snapshots together", nsLabels, nil),
+		nsHeadBytes:        prometheus.NewDesc("cephback_namespace_head_bytes", "Number of bytes written to the RBD images claimed in a namespace since their newest snapshots", nsLabels, nil),
+		nsSnapshotBytes:    prometheus.NewDesc("cephback_namespace_snapshot_bytes", "Number of bytes written to the RBD images claimed in a namespace up to their newest snapshots", nsLabels, nil),
+		reportTime:         prometheus.NewDesc("cephback_rbd_space_accounted", "The epoch timestamp of the last RBD space accounting", nil, nil),
+	}
+}
+
+func (c *spaceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.imageUsed
+	ch <- c.imageHeadBytes
+	ch <- c.imageSnapshotBytes
+	ch <- c.imageSnapshots
+	ch <- c.nsUsed
+	ch <- c.nsHeadBytes
+	ch <- c.nsSnapshotBytes
+	ch <- c.reportTime
+}
+
+func (c *spaceCollector) Collect(ch chan<- prometheus.Metric) {
+	r := lastSpaceReport()
+	if r == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.reportTime, prometheus.GaugeValue, float64(r.Time.Unix()))
+	for _, u := range r.Images {
+		ch <- prometheus.MustNewConstMetric(c.imageUsed, prometheus.GaugeValue, float64(u.UsedBytes), u.Image, u.Namespace, u.Claim)
+		ch <- prometheus.MustNewConstMetric(c.imageHeadBytes, prometheus.GaugeValue, float64(u.HeadBytes), u.Image, u.Namespace, u.Claim)
+		ch <- prometheus.MustNewConstMetric(c.imageSnapshotBytes, prometheus.GaugeValue, float64(u.SnapshotBytes), u.Image, u.Namespace, u.Claim)
+		ch <- prometheus.MustNewConstMetric(c.imageSnapshots, prometheus.GaugeValue, float64(len(u.Snapshots)), u.Image, u.Namespace, u.Claim)
+	}
+	for _, n := range r.Namespaces {
+		ch <- prometheus.MustNewConstMetric(c.nsUsed, prometheus.GaugeValue, float64(n.UsedBytes), n.Namespace)
+		ch <- prometheus.MustNewConstMetric(c.nsHeadBytes, prometheus.GaugeValue, float64(n.HeadBytes), n.Namespace)
+		ch <- prometheus.MustNewConstMetric(c.nsSnapshotBytes, prometheus.GaugeValue, float64(n.SnapshotBytes), n.Namespace)
+	}
+}
@@ -0,0 +1,497 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/alexflint/go-filemutex"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	metricRepoChunksStored = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_repo_chunks_stored",
+			Help: "The number of new chunks written to backup repositories",
+		},
+	)
+	metricRepoChunksDeduplicated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_repo_chunks_deduplicated",
+			Help: "The number of chunks that were already in the backup repository",
+		},
+	)
+	metricRepoBytesStored = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_repo_bytes_stored",
+			Help: "The number of bytes written to backup repositories after compression",
+		},
+	)
+	metricRepoChunksRemoved = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cephback_repo_chunks_removed",
+			Help: "The number of unreferenced chunks removed from backup repositories",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricRepoChunksStored)
+	prometheus.MustRegister(metricRepoChunksDeduplicated)
+	prometheus.MustRegister(metricRepoBytesStored)
+	prometheus.MustRegister(metricRepoChunksRemoved)
+}
+
+const repoVersion = 1
+
+// Repository is a content addressed store of compressed chunks plus the snapshots that reference them.
+//
+//	config                   repository version
+//	chunks/<id[:2]>/<id>     chunk data, the id is the sha256 of the uncompressed data, or with encryption its
+//	                         HMAC-SHA256 under the chunk key so ids do not give away the content
+//	snapshots/<id>           snapshot metadata, the tree is a stream of RepoNode JSON lines stored as chunks
+//	lock                     held shared while backing up and exclusively while removing chunks
+type Repository struct {
+	Path     string
+	chunkKey []byte
+}
+
+// RepoConfig is the config file at the root of a repository. ChunkKey is random and made when an encrypted
+// repository is created, it lives in the config which is sealed with the encryption keys so it survives a rekey.
+type RepoConfig struct {
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	ChunkKey []byte    `json:"chunk_key,omitempty"`
+}
+
+// RepoSnapshot is one backup run of a job
+type RepoSnapshot struct {
+	ID     string    `json:"id"`
+	Job    string    `json:"job"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Host   string    `json:"host"`
+	Files  int64     `json:"files"`
+	Size   int64     `json:"size"`
+	Errors int64     `json:"errors"`
+	Tree   []string  `json:"tree"`
+}
+
+// RepoNode is a single file, directory or symlink in a snapshot tree, Path is relative to the snapshot source
+type RepoNode struct {
+	Path   string      `json:"path"`
+	Type   string      `json:"type"`
+	Mode   os.FileMode `json:"mode"`
+	UID    uint32      `json:"uid"`
+	GID    uint32      `json:"gid"`
+	MTime  time.Time   `json:"mtime"`
+	Size   int64       `json:"size,omitempty"`
+	Target string      `json:"target,omitempty"`
+	Chunks []string    `json:"chunks,omitempty"`
+}
+
+// openRepository opens the repository at path, creating it if it does not exist yet
+func openRepository(path string) (*Repository, error) {
+	r := &Repository{Path: path}
+	var config RepoConfig
+	_, err := os.Stat(filepath.Join(path, "config"))
+	if os.IsNotExist(err) {
+		logger.Infof("Creating backup repository %s", path)
+		for _, d := range []string{"chunks", "snapshots"} {
+			if err := os.MkdirAll(filepath.Join(path, d), 0700); err != nil {
+				return nil, fmt.Errorf("Unable to create repository %s: %s", path, err.Error())
+			}
+		}
+		config = RepoConfig{Version: repoVersion, Created: time.Now()}
+		if encryptionKeys != nil {
+			config.ChunkKey = make([]byte, 32)
+			if _, err := rand.Read(config.ChunkKey); err != nil {
+				return nil, fmt.Errorf("Unable to create repository %s: %s", path, err.Error())
+			}
+			r.chunkKey = config.ChunkKey
+		}
+		if err := writeState(filepath.Join(path, "config"), config); err != nil {
+			return nil, fmt.Errorf("Unable to create repository %s: %s", path, err.Error())
+		}
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open repository %s: %s", path, err.Error())
+	}
+	if err := readState(filepath.Join(path, "config"), &config); err != nil {
+		return nil, fmt.Errorf("Unable to open repository %s: %s", path, err.Error())
+	}
+	if config.Version != repoVersion {
+		return nil, fmt.Errorf("Repository %s has version %d, expected %d", path, config.Version, repoVersion)
+	}
+	r.chunkKey = config.ChunkKey
+	if encryptionKeys != nil && r.chunkKey == nil {
+		logger.Warnf("Repository %s was created without encryption, its chunk ids are plain sha256 sums of the data, back up to a new repository to hide them", path)
+	}
+	return r, nil
+}
+
+// lock takes the repository lock, shared for backups and exclusive for removing chunks
+func (r *Repository) lock(exclusive bool) (*filemutex.FileMutex, error) {
+	m, err := filemutex.New(filepath.Join(r.Path, "lock"))
+	if err != nil {
+		return nil, err
+	}
+	if exclusive {
+		err = m.TryLock()
+	} else {
+		err = m.RLock()
+	}
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (r *Repository) chunkPath(id string) string {
+	return filepath.Join(r.Path, "chunks", id[:2], id)
+}
+
+// writeObject compresses and, if enabled, encrypts data and writes it to path atomically
+func (r *Repository) writeObject(path string, data []byte) (int, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+
+	sealed, err := seal(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, err
+	}
+	tmp := fmt.Sprintf("%s.tmp%d", path, os.Getpid())
+	if err := ioutil.WriteFile(tmp, sealed, 0600); err != nil {
+		return 0, err
+	}
+	return len(sealed), os.Rename(tmp, path)
+}
+
+// readObject reads, decrypts and decompresses an object written by writeObject
+func (r *Repository) readObject(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = unseal(data); err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", path, err.Error())
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress %s: %s", path, err.Error())
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// chunkID returns the id a chunk is stored under
+func (r *Repository) chunkID(data []byte) string {
+	if r.chunkKey == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, r.chunkKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// saveChunk stores a chunk unless the repository already has it, and returns its id
+func (r *Repository) saveChunk(data []byte) (string, error) {
+	id := r.chunkID(data)
+	if _, err := os.Stat(r.chunkPath(id)); err == nil {
+		metricRepoChunksDeduplicated.Inc()
+		return id, nil
+	}
+	n, err := r.writeObject(r.chunkPath(id), data)
+	if err != nil {
+		return "", fmt.Errorf("Unable to store chunk %s: %s", id, err.Error())
+	}
+	metricRepoChunksStored.Inc()
+	metricRepoBytesStored.Add(float64(n))
+	return id, nil
+}
+
+func (r *Repository) loadChunk(id string) ([]byte, error) {
+	data, err := r.readObject(r.chunkPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load chunk %s: %s", id, err.Error())
+	}
+	if r.chunkID(data) != id {
+		return nil, fmt.Errorf("Chunk %s is corrupt", id)
+	}
+	return data, nil
+}
+
+// writeChunks writes the content of a list of chunks to w
+func (r *Repository) writeChunks(w io.Writer, chunks []string) error {
+	for _, id := range chunks {
+		data, err := r.loadChunk(id)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) saveSnapshot(s *RepoSnapshot) error {
+	b := make([]byte, 4)
+	rand.Read(b)
+	s.ID = fmt.Sprintf("%s-%s", s.Time.UTC().Format("20060102T150405Z"), hex.EncodeToString(b))
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = r.writeObject(filepath.Join(r.Path, "snapshots", s.ID), data)
+	return err
+}
+
+// snapshots returns the snapshots of a job oldest first, or of every job if job is empty
+func (r *Repository) snapshots(job string) ([]*RepoSnapshot, error) {
+	files, err := ioutil.ReadDir(filepath.Join(r.Path, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	var snaps []*RepoSnapshot
+	for _, f := range files {
+		if strings.Contains(f.Name(), ".tmp") {
+			continue
+		}
+		data, err := r.readObject(filepath.Join(r.Path, "snapshots", f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read snapshot %s: %s", f.Name(), err.Error())
+		}
+		var s RepoSnapshot
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("Unable to parse snapshot %s: %s", f.Name(), err.Error())
+		}
+		if job == "" || s.Job == job {
+			snaps = append(snaps, &s)
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+	return snaps, nil
+}
+
+// findSnapshot returns the snapshot with the given id, or the newest snapshot of the job for "latest"
+func (r *Repository) findSnapshot(job string, id string) (*RepoSnapshot, error) {
+	snaps, err := r.snapshots(job)
+	if err != nil {
+		return nil, err
+	}
+	if id == "latest" && len(snaps) > 0 {
+		return snaps[len(snaps)-1], nil
+	}
+	for _, s := range snaps {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("Snapshot %s not found in repository %s", id, r.Path)
+}
+
+// walkTree calls f for every node of a snapshot tree in the order they were stored, stopping at the first error
+func (r *Repository) walkTree(s *RepoSnapshot, f func(n *RepoNode) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(r.writeChunks(pw, s.Tree))
+	}()
+	defer pr.Close()
+
+	scanner := bufio.NewScanner(pr)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var n RepoNode
+		if err := json.Unmarshal(scanner.Bytes(), &n); err != nil {
+			return fmt.Errorf("Unable to parse tree of snapshot %s: %s", s.ID, err.Error())
+		}
+		if err := f(&n); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// forgetSnapshots removes the snapshots of a job beyond the newest minKeep which are older than olderThan
+func (r *Repository) forgetSnapshots(job string, olderThan time.Duration, minKeep int) (forgotten int, err error) {
+	snaps, err := r.snapshots(job)
+	if err != nil {
+		return 0, err
+	}
+	for i, s := range snaps {
+		if len(snaps)-i <= minKeep {
+			break
+		}
+		if time.Since(s.Time) <= olderThan {
+			continue
+		}
+		logger.Infof("Removing repository snapshot %s of job %s from %s", s.ID, s.Job, s.Time)
+		if err := os.Remove(filepath.Join(r.Path, "snapshots", s.ID)); err != nil {
+			return forgotten, err
+		}
+		forgotten++
+	}
+	return forgotten, nil
+}
+
+// gc removes every chunk that is not referenced by a snapshot. It needs the exclusive lock so that chunks written
+// by a backup which has not saved its snapshot yet are not removed, and is skipped if a backup is running.
+func (r *Repository) gc() (removed int, err error) {
+	m, err := r.lock(true)
+	if err != nil {
+		if err == filemutex.AlreadyLocked {
+			logger.Infof("Skipping garbage collection of repository %s since it is in use", r.Path)
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer m.Close()
+	defer m.Unlock()
+
+	used := make(map[string]bool)
+	snaps, err := r.snapshots("")
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range snaps {
+		for _, id := range s.Tree {
+			used[id] = true
+		}
+		err := r.walkTree(s, func(n *RepoNode) error {
+			for _, id := range n.Chunks {
+				used[id] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = filepath.Walk(filepath.Join(r.Path, "chunks"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if used[info.Name()] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	metricRepoChunksRemoved.Add(float64(removed))
+	logger.Infof("Removed %d unreferenced chunks from repository %s", removed, r.Path)
+	return removed, err
+}
+
+// restore recreates the nodes of a snapshot at or below path under dest
+func (r *Repository) restore(s *RepoSnapshot, path string, dest string, dryRun bool) (restored int, err error) {
+	path = strings.Trim(filepath.Clean("/"+path), "/")
+	var dirs []*RepoNode
+
+	err = r.walkTree(s, func(n *RepoNode) error {
+		rel := n.Path
+		if path != "" {
+			if n.Path != path && !strings.HasPrefix(n.Path, path+"/") {
+				return nil
+			}
+			rel = strings.TrimPrefix(strings.TrimPrefix(n.Path, path), "/")
+		}
+		target := filepath.Join(dest, rel)
+		restored++
+		if dryRun {
+			fmt.Printf("%s %12d %s %s\n", n.Mode, n.Size, n.MTime.Format(time.RFC3339), n.Path)
+			return nil
+		}
+
+		switch n.Type {
+		case "dir":
+			if err := os.MkdirAll(target, n.Mode.Perm()|0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, n)
+		case "symlink":
+			os.Remove(target)
+			if err := os.Symlink(n.Target, target); err != nil {
+				return err
+			}
+			os.Lchown(target, int(n.UID), int(n.GID))
+			return nil
+		default:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, n.Mode.Perm())
+			if err != nil {
+				return err
+			}
+			err = r.writeChunks(f, n.Chunks)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("Unable to restore %s: %s", n.Path, err.Error())
+			}
+		}
+		os.Chown(target, int(n.UID), int(n.GID))
+		os.Chmod(target, n.Mode.Perm())
+		os.Chtimes(target, n.MTime, n.MTime)
+		return nil
+	})
+
+	// directory times change as their contents are restored, so set them last
+	for _, n := range dirs {
+		target := filepath.Join(dest, strings.TrimPrefix(strings.TrimPrefix(n.Path, path), "/"))
+		os.Chmod(target, n.Mode.Perm())
+		os.Chtimes(target, n.MTime, n.MTime)
+	}
+	return restored, err
+}
+
+// rekey re-encrypts every object that is not encrypted with the active key, after which older keys can be removed
+func (r *Repository) rekey() (rekeyed int, err error) {
+	if encryptionKeys == nil {
+		return 0, fmt.Errorf("Encryption is not enabled")
+	}
+	m, err := r.lock(true)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to lock repository %s: %s", r.Path, err.Error())
+	}
+	defer m.Close()
+	defer m.Unlock()
+
+	err = filepath.Walk(r.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() == "lock" || strings.Contains(info.Name(), ".tmp") {
+			return err
+		}
+		ok, err := rekeyFile(path)
+		if ok {
+			rekeyed++
+		}
+		return err
+	})
+	logger.Infof("Re-encrypted %d objects in repository %s with key %s", rekeyed, r.Path, encryptionKeys.Active)
+	return rekeyed, err
+}
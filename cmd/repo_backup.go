@@ -0,0 +1,343 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// backupCephFSToRepo backs up the job's sources into its repository as a new snapshot. Unchanged files, going by
+// size, mtime and mode against the job's previous snapshot, reuse their chunks without being read.
+// The counts of the run go into the report.
+func backupCephFSToRepo(j *CephFSJob, r *RsyncReport) bool {
+	sources, cleanup, err := cephfsSources(j)
+	defer cleanup()
+	if err != nil {
+		logger.Errorf("Skipping backup for CephFS job %s: %s", j.Name, err.Error())
+		return false
+	}
+
+	repo, err := openRepository(j.Repository)
+	if err != nil {
+		logger.Error(err.Error())
+		return false
+	}
+	m, err := repo.lock(false)
+	if err != nil {
+		logger.Errorf("Unable to lock repository %s: %s", repo.Path, err.Error())
+		return false
+	}
+	defer m.Close()
+	defer m.RUnlock()
+
+	previous := make(map[string]*RepoNode)
+	if last, err := repo.findSnapshot(j.Name, "latest"); err == nil {
+		err := repo.walkTree(last, func(n *RepoNode) error {
+			if n.Type == "file" {
+				previous[n.Path] = n
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Errorf("Unable to read previous snapshot %s, every file will be read: %s", last.ID, err.Error())
+		}
+	}
+
+	host, _ := os.Hostname()
+	snap := &RepoSnapshot{Job: j.Name, Time: time.Now(), Source: j.SourcePath(), Host: host}
+	var kept int64
+	tree := repo.newBlobWriter()
+	treeBuf := bufio.NewWriterSize(tree, 1024*1024)
+	enc := json.NewEncoder(treeBuf)
+
+	for _, src := range sources {
+		err := filepath.Walk(src.Src, func(path string, info os.FileInfo, err error) error {
+			if isShuttingDown() {
+				return fmt.Errorf("interrupted by shutdown")
+			}
+			if err == nil {
+				rel, _ := filepath.Rel(src.Src, path)
+				var node *RepoNode
+				if node, err = repoNode(repo, filepath.Join(src.Key, rel), path, info, previous); err == nil {
+					snap.Files++
+					snap.Size += node.Size
+					if reportRepoNode(r, node, previous) {
+						kept++
+					}
+					return enc.Encode(node)
+				}
+			}
+			// files vanishing while we walk are expected on a live filesystem
+			logger.Warnf("Unable to back up %s: %s", path, err.Error())
+			if os.IsNotExist(err) {
+				r.Vanished = append(r.Vanished, path)
+			} else {
+				snap.Errors++
+				r.Failed = append(r.Failed, path)
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Errorf("Backup of CephFS job %s to repository failed: %s", j.Name, err.Error())
+			return false
+		}
+	}
+
+	if err := treeBuf.Flush(); err != nil {
+		logger.Errorf("Backup of CephFS job %s to repository failed: %s", j.Name, err.Error())
+		return false
+	}
+	if snap.Tree, err = tree.Close(); err != nil {
+		logger.Errorf("Backup of CephFS job %s to repository failed: %s", j.Name, err.Error())
+		return false
+	}
+	if err := repo.saveSnapshot(snap); err != nil {
+		logger.Errorf("Unable to save snapshot for CephFS job %s: %s", j.Name, err.Error())
+		return false
+	}
+	logger.Infof("Saved repository snapshot %s for CephFS job %s: %d files, %d bytes, %d errors", snap.ID, j.Name, snap.Files, snap.Size, snap.Errors)
+	r.FilesDeleted = int64(len(previous)) - kept
+	r.FilesFailed = snap.Errors
+	return snap.Errors == 0
+}
+
+// reportRepoNode counts a backed up node in the run's report and returns whether it is a file the previous
+// snapshot had too
+func reportRepoNode(r *RsyncReport, n *RepoNode, previous map[string]*RepoNode) bool {
+	r.Files++
+	if n.Type != "file" {
+		return false
+	}
+	r.TotalBytes += n.Size
+	p, ok := previous[n.Path]
+	if !ok {
+		r.FilesCreated++
+	}
+	if !ok || !unchangedNode(p, n) {
+		r.FilesTransferred++
+		r.TransferredBytes += n.Size
+	}
+	return ok
+}
+
+// unchangedNode returns whether a file looks the same as in the previous snapshot, going by size, mtime and mode
+func unchangedNode(p *RepoNode, n *RepoNode) bool {
+	return p.Size == n.Size && p.MTime.Equal(n.MTime) && p.Mode == n.Mode
+}
+
+// repoNode builds the tree node for a path, storing the file content unless it is unchanged since the previous snapshot
+func repoNode(repo *Repository, rel string, path string, info os.FileInfo, previous map[string]*RepoNode) (*RepoNode, error) {
+	if rel == "." {
+		rel = ""
+	}
+	n := &RepoNode{Path: rel, Mode: info.Mode(), MTime: info.ModTime()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		n.UID = st.Uid
+		n.GID = st.Gid
+	}
+
+	switch {
+	case info.IsDir():
+		n.Type = "dir"
+	case info.Mode()&os.ModeSymlink != 0:
+		n.Type = "symlink"
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		n.Target = target
+	case info.Mode().IsRegular():
+		n.Type = "file"
+		n.Size = info.Size()
+		if p, ok := previous[rel]; ok && unchangedNode(p, n) {
+			n.Chunks = p.Chunks
+			return n, nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		w := repo.newBlobWriter()
+		if _, err := io.Copy(w, f); err != nil {
+			return nil, err
+		}
+		if n.Chunks, err = w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		// devices, sockets and fifos are recorded but have no content
+		n.Type = "special"
+	}
+	return n, nil
+}
+
+// pruneRepo applies the job's retention to its repository snapshots and removes chunks nothing refers to any more
+func pruneRepo(j *CephFSJob) {
+	repo, err := openRepository(j.Repository)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	forgotten, err := repo.forgetSnapshots(j.Name, j.SnapAgeMax, j.SnapCountMin)
+	if err != nil {
+		logger.Errorf("Error pruning repository snapshots for CephFS job %s: %s", j.Name, err.Error())
+		return
+	}
+	metricCephFSSnapshotsDeleted.WithLabelValues(j.Name).Add(float64(forgotten))
+	if forgotten > 0 {
+		if _, err := repo.gc(); err != nil {
+			logger.Errorf("Error removing unreferenced chunks from repository %s: %s", repo.Path, err.Error())
+		}
+	}
+}
+
+var repoJobName string
+var repoSnapshotID string
+var repoRestorePath string
+var repoRestoreTo string
+var repoDryRun bool
+
+var cephfsCmd = &cobra.Command{
+	Use:   "cephfs",
+	Short: "Work with CephFS backups",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if errs := validateConfig(); len(errs) > 0 {
+			for e := range errs {
+				logger.Error(errs[e].Error())
+			}
+			logger.Fatalf("Invalid configuration, %d errors found", len(errs))
+		}
+		setConfigVars()
+	},
+}
+
+var repoCmd = &cobra.Command{
+	Use:   "repo",
+	Short: "Work with the repositories of repo engine CephFS jobs",
+}
+
+var repoSnapshotsCmd = &cobra.Command{
+	Use:   "snapshots",
+	Short: "List repository snapshots",
+	Run: func(cmd *cobra.Command, args []string) {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tJOB\tTIME\tFILES\tSIZE\tERRORS")
+		for _, j := range repoJobs() {
+			repo, err := openRepository(j.Repository)
+			if err != nil {
+				logger.Fatal(err.Error())
+			}
+			snaps, err := repo.snapshots(j.Name)
+			if err != nil {
+				logger.Fatal(err.Error())
+			}
+			for _, s := range snaps {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", s.ID, s.Job, s.Time.Format(time.RFC3339), s.Files, s.Size, s.Errors)
+			}
+		}
+		w.Flush()
+	},
+}
+
+var repoPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Apply retention to repository snapshots and remove unreferenced chunks",
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, j := range repoJobs() {
+			pruneRepo(j)
+		}
+	},
+}
+
+var repoRekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Re-encrypt repository data, state files and logs with the active encryption key",
+	Long: `Re-encrypt repository data, state files and logs with the active encryption key, and let it unlock the
+LUKS volumes of the backup RBDs.
+
+To rotate keys add the new key alongside the old ones, make it active with encryption-key-active, run rekey,
+then remove the old keys once every repository has been re-encrypted. Snapshots of a backup RBD taken before the
+rekey only open with the old keys, keep them until those snapshots have expired.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, j := range repoJobs() {
+			repo, err := openRepository(j.Repository)
+			if err != nil {
+				logger.Fatal(err.Error())
+			}
+			if _, err := repo.rekey(); err != nil {
+				logger.Fatal(err.Error())
+			}
+		}
+		if _, err := rekeyState(); err != nil {
+			logger.Fatal(err.Error())
+		}
+		if err := CephConnInit(); err != nil {
+			logger.Fatal(err.Error())
+		}
+		if _, err := rekeyBackupRbds(); err != nil {
+			logger.Fatal(err.Error())
+		}
+	},
+}
+
+var repoRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a path from a repository snapshot",
+	Run: func(cmd *cobra.Command, args []string) {
+		jobs := repoJobs()
+		if len(jobs) != 1 {
+			logger.Fatal("Choose the job to restore from with --job")
+		}
+		if repoRestoreTo == "" && !repoDryRun {
+			logger.Fatal("Choose where to restore to with --to")
+		}
+		repo, err := openRepository(jobs[0].Repository)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		snap, err := repo.findSnapshot(jobs[0].Name, repoSnapshotID)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		restored, err := repo.restore(snap, repoRestorePath, repoRestoreTo, repoDryRun)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		logger.Infof("Restored %d entries from snapshot %s", restored, snap.ID)
+	},
+}
+
+// repoJobs returns the repo engine jobs, limited to the one named by --job if it is set
+func repoJobs() (jobs []*CephFSJob) {
+	for _, j := range cephfsJobs {
+		if j.Engine == "repo" && (repoJobName == "" || j.Name == repoJobName) {
+			jobs = append(jobs, j)
+		}
+	}
+	if len(jobs) == 0 {
+		logger.Fatal("No matching CephFS jobs use the repo engine")
+	}
+	return jobs
+}
+
+func init() {
+	repoCmd.PersistentFlags().StringVar(&repoJobName, "job", "", "CephFS job name")
+	repoRestoreCmd.Flags().StringVar(&repoSnapshotID, "snapshot", "latest", "Snapshot ID to restore from")
+	repoRestoreCmd.Flags().StringVar(&repoRestorePath, "path", "", "Path within the snapshot to restore, everything if empty")
+	repoRestoreCmd.Flags().StringVar(&repoRestoreTo, "to", "", "Directory to restore into")
+	repoRestoreCmd.Flags().BoolVar(&repoDryRun, "dry-run", false, "List what would be restored")
+	repoCmd.AddCommand(repoSnapshotsCmd)
+	repoCmd.AddCommand(repoPruneCmd)
+	repoCmd.AddCommand(repoRestoreCmd)
+	repoCmd.AddCommand(repoRekeyCmd)
+	cephfsCmd.AddCommand(repoCmd)
+	RootCmd.AddCommand(cephfsCmd)
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// content defined chunking boundaries, a cut is made where the top bits of a gear hash over the last 64 bytes are
+// all zero so that inserting data only changes the chunks around the insertion
+const (
+	chunkMin  = 512 * 1024
+	chunkMax  = 8 * 1024 * 1024
+	chunkBits = 20 // average chunk size of 1MiB
+	chunkMask = uint64(1<<chunkBits-1) << (64 - chunkBits)
+)
+
+// gearTable maps each byte to a random looking value, derived from a fixed seed so chunk boundaries never change
+var gearTable [256]uint64
+
+func init() {
+	for i := range gearTable {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("cephback gear %d", i)))
+		gearTable[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+// blobWriter splits everything written to it into content defined chunks and stores them in the repository
+type blobWriter struct {
+	repo   *Repository
+	buf    []byte
+	hash   uint64
+	chunks []string
+	size   int64
+}
+
+func (r *Repository) newBlobWriter() *blobWriter {
+	return &blobWriter{repo: r, buf: make([]byte, 0, chunkMax)}
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		w.buf = append(w.buf, b)
+		w.hash = (w.hash << 1) + gearTable[b]
+		if (len(w.buf) >= chunkMin && w.hash&chunkMask == 0) || len(w.buf) >= chunkMax {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+func (w *blobWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	id, err := w.repo.saveChunk(w.buf)
+	if err != nil {
+		return err
+	}
+	w.chunks = append(w.chunks, id)
+	w.buf = w.buf[:0]
+	w.hash = 0
+	return nil
+}
+
+// Close stores the final chunk and returns the ids of every chunk written
+func (w *blobWriter) Close() ([]string, error) {
+	if err := w.flush(); err != nil {
+		return nil, err
+	}
+	return w.chunks, nil
+}
@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var restoreJobName string
+var restorePath string
+var restoreAt string
+var restoreTo string
+var restoreDryRun bool
+var restoreInPlace bool
+var restoreBackup string
+
+// formats accepted by --at, besides the snapshot name layout
+var restoreTimeFormats = []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"}
+
+// BackupGeneration is one point in time a CephFS job can be restored from: a snapshot of the RBD holding its
+// backup, a repository snapshot for repo engine jobs or a generation directory for generations engine jobs
+type BackupGeneration struct {
+	Job  *CephFSJob
+	Name string
+	Time time.Time
+}
+
+// backupRbd returns the RBD a job's backup is on: its own, or that of the job owning its backup mount
+func backupRbd(j *CephFSJob) string {
+	if j.RbdName != "" {
+		return j.RbdName
+	}
+	for _, o := range cephfsJobs {
+		if o.BackupMount == j.BackupMount && o.RbdName != "" {
+			return o.RbdName
+		}
+	}
+	return ""
+}
+
+// cephfsGenerations returns the generations a job can be restored from, oldest first
+func cephfsGenerations(j *CephFSJob) (gens []*BackupGeneration, err error) {
+	if j.Engine == "generations" {
+		names, err := listGenerations(j)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if t, err := time.ParseInLocation(layout, name, time.Local); err == nil {
+				gens = append(gens, &BackupGeneration{Job: j, Name: name, Time: t})
+			}
+		}
+	} else if j.Engine == "repo" {
+		repo, err := openRepository(j.Repository)
+		if err != nil {
+			return nil, err
+		}
+		snaps, err := repo.snapshots(j.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range snaps {
+			gens = append(gens, &BackupGeneration{Job: j, Name: s.ID, Time: s.Time})
+		}
+	} else {
+		image := backupRbd(j)
+		if image == "" {
+			return nil, fmt.Errorf("CephFS job %s has no backup RBD to restore from", j.Name)
+		}
+		if err := CephConnInit(); err != nil {
+			return nil, err
+		}
+		for _, s := range getSnapshots(image) {
+			if !matchSnapName(s.Name, rbdSnapshotRegex) {
+				continue
+			}
+			if t, err := time.ParseInLocation(layout, s.Name, time.Local); err == nil {
+				gens = append(gens, &BackupGeneration{Job: j, Name: s.Name, Time: t})
+			}
+		}
+	}
+	sort.Slice(gens, func(a, b int) bool { return gens[a].Time.Before(gens[b].Time) })
+	return gens, nil
+}
+
+// findGeneration returns the newest generation taken at or before a time
+func findGeneration(j *CephFSJob, at time.Time) (*BackupGeneration, error) {
+	gens, err := cephfsGenerations(j)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(gens) - 1; i >= 0; i-- {
+		if !gens[i].Time.After(at) {
+			return gens[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No backup of CephFS job %s found at or before %s", j.Name, at.Format(time.RFC3339))
+}
+
+// findGenerationByName returns the generation with a name, as listed by a catalog search
+func findGenerationByName(j *CephFSJob, name string) (*BackupGeneration, error) {
+	gens, err := cephfsGenerations(j)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gens {
+		if g.Name == name {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("No backup %s found for CephFS job %s", name, j.Name)
+}
+
+// restore copies path, relative to the job's source, from the generation to dest, or lists it if dryRun is set
+func (g *BackupGeneration) restore(path string, dest string, dryRun bool) (int, error) {
+	if g.Job.Engine == "repo" {
+		repo, err := openRepository(g.Job.Repository)
+		if err != nil {
+			return 0, err
+		}
+		snap, err := repo.findSnapshot(g.Job.Name, g.Name)
+		if err != nil {
+			return 0, err
+		}
+		return repo.restore(snap, path, dest, dryRun)
+	}
+	if g.Job.Engine == "generations" {
+		dir, err := generationDir(g.Job, g.Name)
+		if err != nil {
+			return 0, err
+		}
+		return restoreFromDir(dir, path, dest, dryRun)
+	}
+
+	m, err := mountRbdSnapshot(backupRbd(g.Job), g.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer m.Close()
+	rel, err := filepath.Rel(g.Job.BackupMount, g.Job.Target)
+	if err != nil {
+		return 0, err
+	}
+	return restoreFromDir(filepath.Join(m.Path, rel), path, dest, dryRun)
+}
+
+// restoreFromDir copies path below root to dest with rsync, or lists it if dryRun is set
+func restoreFromDir(root string, path string, dest string, dryRun bool) (restored int, err error) {
+	src := filepath.Join(root, path)
+	info, err := os.Lstat(src)
+	if err != nil {
+		return 0, fmt.Errorf("%s not found in backup", path)
+	}
+
+	if dryRun {
+		err = filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(root, p)
+			fmt.Printf("%s %12d %s %s\n", info.Mode(), info.Size(), info.ModTime().Format(time.RFC3339), rel)
+			restored++
+			return nil
+		})
+		return restored, err
+	}
+
+	if info.IsDir() {
+		src += "/"
+		dest = strings.TrimSuffix(dest, "/") + "/"
+	}
+	if err := os.MkdirAll(filepath.Dir(strings.TrimSuffix(dest, "/")), 0755); err != nil {
+		return 0, err
+	}
+	exitCode, _, err := execCommand("rsync", []string{"-aHAX", "--numeric-ids", "--stats", src, dest})
+	if err != nil {
+		return 0, fmt.Errorf("rsync of %s to %s failed: %s", src, dest, err.Error())
+	}
+	if exitCode != 0 {
+		return 0, fmt.Errorf("rsync of %s to %s exited with %d", src, dest, exitCode)
+	}
+	return 1, nil
+}
+
+// parseRestoreTime parses --at, which defaults to now
+func parseRestoreTime(at string) (time.Time, error) {
+	if at == "" {
+		return time.Now(), nil
+	}
+	for _, f := range append([]string{layout}, restoreTimeFormats...) {
+		if t, err := time.ParseInLocation(f, at, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Unable to parse time '%s', use RFC3339 or YYYY-MM-DD HH:MM", at)
+}
+
+// restoreJob returns the job named by --job, which may be left out when there is only one job
+func restoreJob(name string) (*CephFSJob, error) {
+	for _, j := range cephfsJobs {
+		if j.Name == name || (name == "" && len(cephfsJobs) == 1) {
+			return j, nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Choose the job to restore from with --job")
+	}
+	return nil, fmt.Errorf("No CephFS job named %s", name)
+}
+
+// restoreRelPath makes a path given as a CephFS path, or relative to the job's source, relative to the job's source
+func restoreRelPath(j *CephFSJob, path string) (string, error) {
+	if filepath.IsAbs(path) && (path == j.SourcePath() || strings.HasPrefix(path, j.SourcePath()+"/")) {
+		path, _ = filepath.Rel(j.SourcePath(), path)
+	}
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+		return "", fmt.Errorf("%s is not below the source %s of CephFS job %s", path, j.SourcePath(), j.Name)
+	}
+	if path == "." {
+		path = ""
+	}
+	return path, nil
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a path from the newest CephFS backup at or before a time",
+	Long: `Restore a path from the newest CephFS backup at or before a time.
+
+The path is relative to the job's source, or a path under cephfs-mount. It is restored to --to, or over where it
+came from with --in-place. Backups on an RBD are restored from a read-only clone of the snapshot, which is removed again
+afterwards.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		j, err := restoreJob(restoreJobName)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		at, err := parseRestoreTime(restoreAt)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		path, err := restoreRelPath(j, restorePath)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		to := restoreTo
+		if to == "" {
+			if !restoreInPlace && !restoreDryRun {
+				logger.Fatal("Choose where to restore to with --to, or restore over the source with --in-place")
+			}
+			to = filepath.Join(j.SourcePath(), path)
+		} else if restoreInPlace {
+			logger.Fatal("--to and --in-place can't be used together")
+		}
+
+		var g *BackupGeneration
+		if restoreBackup != "" {
+			g, err = findGenerationByName(j, restoreBackup)
+		} else {
+			g, err = findGeneration(j, at)
+		}
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		logger.Infof("Restoring %s of CephFS job %s from backup %s taken %s to %s", path, j.Name, g.Name, g.Time.Format(time.RFC3339), to)
+		restored, err := g.restore(path, to, restoreDryRun)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		if restoreDryRun {
+			logger.Infof("%d entries would be restored from backup %s", restored, g.Name)
+		} else {
+			logger.Infof("Restored %s from backup %s", path, g.Name)
+		}
+	},
+}
+
+func init() {
+	restoreCmd.Flags().StringVar(&restoreJobName, "job", "", "CephFS job name, needed when there is more than one job")
+	restoreCmd.Flags().StringVar(&restorePath, "path", "", "Path to restore, relative to the job's source or under cephfs-mount")
+	restoreCmd.Flags().StringVar(&restoreAt, "at", "", "Restore from the newest backup at or before this time, default now")
+	restoreCmd.Flags().StringVar(&restoreBackup, "backup", "", "Restore from this backup, as listed by catalog search, instead of using --at")
+	restoreCmd.Flags().StringVar(&restoreTo, "to", "", "Where to restore the path to")
+	restoreCmd.Flags().BoolVar(&restoreInPlace, "in-place", false, "Restore the path over its original location")
+	restoreCmd.Flags().BoolVar(&restoreDryRun, "dry-run", false, "List what would be restored")
+	cephfsCmd.AddCommand(restoreCmd)
+}
@@ -1,18 +1,24 @@
 package cmd
 
 import (
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/fsnotify/fsnotify"
 	"github.com/robfig/cron"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var cfgFile string
+var configReadErr error
 
 var cephUser string
 var debug bool
@@ -26,16 +32,56 @@ var imageExclude []string
 var httpListen string
 var cephfsMount string
 var backupMount string
-var checkCephfsInterval string
-var rsyncCephfsInterval time.Duration
-var cephfsRsyncLock string
-var cephfsRsyncArgs []string
-var cephfsRsyncValidExitCodes []int
-var cephfsSuccessFile string
-var cephfsRbdName string
-var cephfsSnapCountMin int
-var cephfsSnapAgeMin time.Duration
-var cephfsSnapAgeMax time.Duration
+var cephfsRsyncLockWait time.Duration
+var cephfsSnapshots bool
+var cephfsJobs []*CephFSJob
+var cephfsRsyncShardRetries int
+var cephfsMountRoot string
+var cephfsPvBackupsEnabled bool
+var cephfsPvInterval string
+var cephfsPvTarget string
+var fsfreezeMax time.Duration
+var encryptionKeys *Keyring
+var cephPool string
+var capacityWarningWindow time.Duration
+var cephfsUsageDepth int
+var cephfsUsageInterval string
+var cephfsGuard bool
+var cephfsGuardDeletesMin int64
+var cephfsGuardDeletesFactor float64
+var cephfsGuardChangedMin uint64
+var cephfsGuardChangedFactor float64
+var cephfsCatalog bool
+var cephfsCatalogHash bool
+var browseEnabled bool
+var browseAuthFile string
+var browseIdleTimeout time.Duration
+var cephfsRbdManage bool
+var cephfsRbdSize uint64
+var cephfsRbdFeatures []string
+var cephfsRbdFs string
+var cephfsRbdGrowFreePct int
+var cephfsRbdGrowStep uint64
+var cephfsRbdMaxSize uint64
+var shutdownTimeout time.Duration
+var deletionRatePerMinute int
+var deletionMaxPerPass int
+var deletionPauseBusy bool
+var trashEnabled bool
+var trashDelay time.Duration
+var trashState string
+var trashAuditLog string
+var poolSoftLimitPct int
+var poolHardLimitPct int
+var rbdAccounting bool
+var rbdAccountingInterval string
+var rbdAccountingFullScan bool
+var rbdChangeDetect bool
+var rbdChangeState string
+var rbdChangeFactor float64
+var rbdChangeMinBytes uint64
+var rbdChangeMinSamples int
+var rbdChangeWeight float64
 
 var logger = logrus.New()
 
@@ -43,8 +89,14 @@ var RootCmd = &cobra.Command{
 	Use:   "cephback",
 	Short: "A service to snapshot RBD's and backup files via rsync",
 	PreRun: func(cmd *cobra.Command, args []string) {
-		viper.BindPFlags(cmd.PersistentFlags())
+		if errs := validateConfig(); len(errs) > 0 {
+			for e := range errs {
+				logger.Error(errs[e].Error())
+			}
+			logger.Fatalf("Invalid configuration, %d errors found", len(errs))
+		}
 		setConfigVars()
+		markConfigLoaded()
 		out, _ := os.OpenFile("/var/log/cephback.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		multi := io.MultiWriter(out, os.Stderr)
 		logger.Out = multi
@@ -67,27 +119,16 @@ var RootCmd = &cobra.Command{
 			return
 		}
 
-		// remove the cephfs rbd from the list - we'll handle this separately
-		imageExclude = append(imageExclude, cephfsRbdName)
-		logger.Infof("Starting RBD routine on cron schedule -> %s", checkRbdInterval)
-		logger.Infof("Starting PVs Failed routine on cron schedule -> %s", checkPurgedInterval)
-		logger.Infof("Starting CephFS routine on cron schedule -> %s", checkCephfsInterval)
-		logger.Infof("Starting health check routine on cron schedule -> %s", healthCheckInterval)
-		go func() {
-			// initialize a new cron
-			c := cron.New()
-			// add the rbd routine
-			c.AddFunc(checkRbdInterval, func() { processImages() })
-			// add the failed pv routine - this is to handle Failed pv's - Openshift fails to delete the pv if the rbd has snapshots
-			c.AddFunc(checkPurgedInterval, func() { purgeSnapsOnFailedPV() })
-			// add the cephfs routine
-			c.AddFunc(checkCephfsInterval, func() { processCephFS() })
-			// add the health check routine
-			c.AddFunc(healthCheckInterval, func() { checkHealth() })
-			go c.Start()
-		}()
-		// block forever
-		select {}
+		// a previous instance may have died with a backup mount frozen
+		for _, j := range cephfsJobs {
+			thawStaleFreeze(j.BackupMount)
+		}
+
+		startScheduler()
+		watchConfig()
+
+		// block until we are told to stop
+		waitForShutdown()
 	},
 }
 
@@ -107,6 +148,7 @@ func init() {
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/cephback.yaml)")
 	RootCmd.PersistentFlags().StringP("ceph-user", "u", "admin", "Ceph user")
 	RootCmd.PersistentFlags().BoolP("debug", "d", false, "Enable debugging")
+	RootCmd.PersistentFlags().String("ceph-pool", "rbd", "Ceph pool holding the RBD images, RBD PVs in other pools are not backed up")
 	RootCmd.PersistentFlags().Int("rbd-snap-count-min", 7, "The minimum number of RBD snapshots before we consider deleting older ones")
 	RootCmd.PersistentFlags().String("rbd-snap-age-min", "24h", "Duration since the last snapshot before we take another one")
 	RootCmd.PersistentFlags().String("rbd-snap-age-max", "168h", "Snapshots older than this will be deleted")
@@ -120,66 +162,346 @@ func init() {
 	RootCmd.PersistentFlags().String("cephfs-interval", "30 */15 * * * *", "Interval between CephFS RBD snapshot checks")
 	RootCmd.PersistentFlags().String("cephfs-rsync-interval", "24h", "Interval between CephFS rsyncs")
 	RootCmd.PersistentFlags().String("cephfs-rsync-lock", "/backup/rsync.lock", "Path to lock file for CephFS rsync")
+	RootCmd.PersistentFlags().String("cephfs-rsync-lock-wait", "1m", "How long to wait for the CephFS rsync lock before skipping the run")
 	RootCmd.PersistentFlags().StringSlice("cephfs-rsync-args", []string{"-ah", "--delete", "--delete-excluded"}, "Rsync args for the cephfs backup")
 	RootCmd.PersistentFlags().StringSlice("cephfs-rsync-valid-exit-codes", []string{"0", "24"}, "Rsync valid exit codes for the cephfs backup")
+	RootCmd.PersistentFlags().Int("cephfs-rsync-shard-depth", 0, "Split the CephFS rsync into one rsync per directory this many levels down, 0 to disable")
+	RootCmd.PersistentFlags().Int("cephfs-rsync-workers", 4, "Number of CephFS rsync shards to run in parallel")
+	RootCmd.PersistentFlags().Int("cephfs-rsync-shard-retries", 2, "Number of times to retry a failed CephFS rsync shard")
+	RootCmd.PersistentFlags().Bool("cephfs-rctime-skip", false, "Skip CephFS rsync shards whose ceph.dir.rctime has not changed since their last successful rsync")
+	RootCmd.PersistentFlags().String("cephfs-engine", "rsync", "How CephFS is backed up: rsync to mirror into the backup RBD, repo for a deduplicating repository, or generations for dated hard-linked copies")
+	RootCmd.PersistentFlags().String("cephfs-repository", "repository", "Directory under backup-mount holding the repository used by the repo engine, shared by every job using it")
 	RootCmd.PersistentFlags().String("cephfs-success-file", "/backup/rsync_success", "Path to CephFS rsync success file")
+	RootCmd.PersistentFlags().Bool("cephfs-snapshots", false, "Rsync from native CephFS snapshots for a point-in-time consistent backup - needs cephfs-mount to be writable")
+	RootCmd.PersistentFlags().StringSlice("cephfs-snapshot-dirs", []string{}, "Directories relative to cephfs-mount to snapshot and back up, the whole filesystem if empty")
+	RootCmd.PersistentFlags().String("cephfs-mount-root", "/", "Path within CephFS that is mounted at cephfs-mount, used to find PV paths")
+	RootCmd.PersistentFlags().Bool("cephfs-pv-backups", false, "Back up each bound CephFS PV as its own unit")
+	RootCmd.PersistentFlags().String("cephfs-pv-interval", "40 */15 * * * *", "Interval between CephFS PV backup checks")
+	RootCmd.PersistentFlags().String("cephfs-pv-target", "pv", "Directory under backup-mount that CephFS PVs are backed up to")
 	RootCmd.PersistentFlags().String("cephfs-rbd-name", "cephfs_backup", "RBD name that CephFS is backed up to")
+	RootCmd.PersistentFlags().Int("cephfs-usage-depth", 0, "Export the size of each CephFS directory this many levels below a job's source, and of its backup, 0 to disable")
+	RootCmd.PersistentFlags().String("cephfs-usage-interval", "0 30 4 * * *", "Interval between measurements of the backup size of the directories at cephfs-usage-depth")
+	RootCmd.PersistentFlags().Bool("cephfs-guard", false, "Dry run each CephFS rsync first and stop the job if it would delete or change far more than the previous run")
+	RootCmd.PersistentFlags().Int64("cephfs-guard-deletes-min", 10000, "Deletions a CephFS rsync may always make before the guard trips, 0 to not guard deletions")
+	RootCmd.PersistentFlags().Float64("cephfs-guard-deletes-factor", 10, "Times the previous run's deletions a CephFS rsync may make before the guard trips")
+	RootCmd.PersistentFlags().String("cephfs-guard-changed-min", "100G", "Bytes a CephFS rsync may always transfer before the guard trips, 0 to not guard changes")
+	RootCmd.PersistentFlags().Float64("cephfs-guard-changed-factor", 10, "Times the previous run's transferred bytes a CephFS rsync may transfer before the guard trips")
+	RootCmd.PersistentFlags().Bool("cephfs-catalog", false, "Record the files in each CephFS backup in a searchable catalog next to the success file - not with encryption")
+	RootCmd.PersistentFlags().Bool("cephfs-catalog-hash", false, "Also record a SHA-256 of each file in the catalog, which reads every file in the backup")
+	RootCmd.PersistentFlags().Bool("cephfs-rbd-manage", false, "Create, map and mount the CephFS backup RBDs, and grow them when they run low on space")
+	RootCmd.PersistentFlags().String("cephfs-rbd-size", "2T", "Size of a CephFS backup RBD when it is created")
+	RootCmd.PersistentFlags().StringSlice("cephfs-rbd-features", []string{"layering"}, "Image features of a CephFS backup RBD when it is created")
+	RootCmd.PersistentFlags().String("cephfs-rbd-fs", "xfs", "Filesystem to create on a new CephFS backup RBD: xfs or ext4")
+	RootCmd.PersistentFlags().Int("cephfs-rbd-grow-free-pct", 10, "Grow a CephFS backup RBD when its free space drops below this percentage")
+	RootCmd.PersistentFlags().String("cephfs-rbd-grow-step", "256G", "How much to grow a CephFS backup RBD by at a time")
+	RootCmd.PersistentFlags().String("cephfs-rbd-max-size", "4T", "Size a CephFS backup RBD will not be grown beyond")
+	RootCmd.PersistentFlags().Int("deletion-rate-per-minute", 0, "Most snapshot deletions to make per minute, 0 for no limit")
+	RootCmd.PersistentFlags().Int("deletion-max-per-pass", 0, "Most snapshot deletions to make in one retention or purge pass, the rest wait for the next pass, 0 for no limit")
+	RootCmd.PersistentFlags().Bool("deletion-pause-busy", false, "Leave snapshot deletions for a later pass while the cluster is recovering, backfilling or has slow requests")
+	RootCmd.PersistentFlags().Bool("trash", false, "Move snapshots pruned by retention, and the images of Failed PVs, to a trash instead of deleting them - Failed PVs then need deleting by hand")
+	RootCmd.PersistentFlags().String("trash-delay", "72h", "How long snapshots and images stay in the trash before they are removed for good, unless the pool passes pool-soft-limit-pct first")
+	RootCmd.PersistentFlags().String("trash-state", "/backup/rbd_trash", "Path to the file listing what is in the trash")
+	RootCmd.PersistentFlags().String("trash-audit-log", "/backup/rbd_trash_audit.log", "Path to the log of everything moved to, restored from and purged from the trash")
+	RootCmd.PersistentFlags().Int("pool-soft-limit-pct", 0, "Prune the oldest snapshots beyond the minimum count, largest consumers first, when the pool is fuller than this percentage, 0 to disable")
+	RootCmd.PersistentFlags().Int("pool-hard-limit-pct", 0, "Stop creating snapshots and alert when the pool is fuller than this percentage, 0 to disable")
+	RootCmd.PersistentFlags().Bool("rbd-accounting", false, "Periodically measure the space held by the snapshots of each RBD image, per image and per PVC namespace")
+	RootCmd.PersistentFlags().String("rbd-accounting-interval", "0 20 * * * *", "Interval between RBD space accounting runs")
+	RootCmd.PersistentFlags().Bool("rbd-accounting-full-scan", false, "Also measure images without the fast-diff feature, which means reading every object of them")
+	RootCmd.PersistentFlags().Bool("rbd-change-detect", false, "Measure how much each RBD image changes between snapshots and alert on spikes")
+	RootCmd.PersistentFlags().String("rbd-change-state", "/backup/rbd_change_state", "Path to the file holding each RBD image's change rate baseline")
+	RootCmd.PersistentFlags().Float64("rbd-change-factor", 5, "Times its baseline an image's change rate must reach to count as a spike")
+	RootCmd.PersistentFlags().String("rbd-change-min-bytes", "1G", "Changes between two snapshots smaller than this are never a spike")
+	RootCmd.PersistentFlags().Int("rbd-change-min-samples", 5, "Number of snapshot intervals measured before an image's baseline is trusted")
+	RootCmd.PersistentFlags().Float64("rbd-change-weight", 0.2, "Weight of the newest change rate in an image's moving average baseline, between 0 and 1")
 	RootCmd.PersistentFlags().Int("cephfs-snap-count-min", 7, "The minimum number of CephFS RBD snapshots before we consider deleting older ones")
 	RootCmd.PersistentFlags().String("cephfs-snap-age-min", "24h", "Duration since the last snapshot before we take another one")
 	RootCmd.PersistentFlags().String("cephfs-snap-age-max", "168h", "Snapshots older than this will be deleted")
+	RootCmd.PersistentFlags().Bool("encryption", false, "Encrypt backup data, manifests and logs written by cephback - rsync and generations copies are kept on a LUKS volume on the backup RBD, which needs cephfs-rbd-manage")
+	RootCmd.PersistentFlags().String("encryption-key-file", "", "File of '<id> <base64 key>' lines holding the 32 byte encryption keys")
+	RootCmd.PersistentFlags().String("encryption-key-secret", "", "Kubernetes secret (namespace/name) whose entries are base64 encoded encryption keys by id")
+	RootCmd.PersistentFlags().String("encryption-key-active", "", "Id of the key new data is encrypted with, needed when there is more than one key")
+	RootCmd.PersistentFlags().Bool("browse", false, "Serve CephFS backups and RBD snapshots read-only over HTTP and WebDAV at /browse/, to admins only and behind TLS")
+	RootCmd.PersistentFlags().String("browse-auth-file", "", "File of 'user:bcrypt hash of password' lines, as written by htpasswd -nB, allowed to use /browse/")
+	RootCmd.PersistentFlags().String("browse-idle-timeout", "10m", "How long a backup or snapshot mounted for browsing may sit unused before it is unmounted")
+	RootCmd.PersistentFlags().String("capacity-warning-window", "336h", "Warn in /healthz when a backup filesystem is forecast to be full within this time")
+	RootCmd.PersistentFlags().String("fsfreeze-max", "2m", "Maximum time the backup mount may stay frozen before it is thawed regardless")
+	RootCmd.PersistentFlags().String("shutdown-timeout", "100s", "Time to wait for running jobs on shutdown before interrupting them - keep below the pod termination grace period")
+
+	viper.BindPFlags(RootCmd.PersistentFlags())
+}
+
+// settings which must parse as a duration
+var durationSettings = []string{
+	"rbd-snap-age-min",
+	"rbd-snap-age-max",
+	"cephfs-rsync-interval",
+	"cephfs-rsync-lock-wait",
+	"cephfs-snap-age-min",
+	"cephfs-snap-age-max",
+	"fsfreeze-max",
+	"shutdown-timeout",
+	"capacity-warning-window",
+	"browse-idle-timeout",
+	"trash-delay",
+}
+
+// settings which must parse as a cron expression
+var cronSettings = []string{
+	"rbd-interval",
+	"purge-interval",
+	"healthcheck-interval",
+	"cephfs-interval",
+	"cephfs-pv-interval",
+	"rbd-accounting-interval",
+	"cephfs-usage-interval",
 }
 
-func durationSettingParser(t string) time.Duration {
+func durationSettingParser(t string) (time.Duration, error) {
 	td, err := time.ParseDuration(viper.GetString(t))
 	if err != nil {
-		logger.Fatalf("Unable to parse '%s' setting: '%s'. %s", t, viper.GetString(t), err.Error())
+		return 0, fmt.Errorf("Unable to parse '%s' setting: '%s'. %s", t, viper.GetString(t), err.Error())
 	}
-	return td
+	return td, nil
 }
 
-func cronSettingParser(t string) string {
+func cronSettingParser(t string) (string, error) {
 	_, err := cron.Parse(viper.GetString(t))
 	if err != nil {
-		logger.Fatalf("Unable to parse '%s' setting: '%s'. %s", t, viper.GetString(t), err.Error())
-		os.Exit(2)
+		return "", fmt.Errorf("Unable to parse '%s' setting: '%s'. %s", t, viper.GetString(t), err.Error())
+	}
+	return viper.GetString(t), nil
+}
+
+// settings which must parse as a size
+var sizeSettings = []string{
+	"cephfs-rbd-size",
+	"cephfs-rbd-grow-step",
+	"cephfs-rbd-max-size",
+	"cephfs-guard-changed-min",
+	"rbd-change-min-bytes",
+}
+
+// sizeSettingParser parses a size in bytes with an optional K, M, G, T or P suffix in powers of 1024
+func sizeSettingParser(t string) (uint64, error) {
+	v := strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(viper.GetString(t)), "B"))
+	var shift uint
+	if len(v) > 0 {
+		if i := strings.IndexByte("KMGTP", v[len(v)-1]); i >= 0 {
+			shift = uint(i+1) * 10
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse '%s' setting: '%s'. %s", t, viper.GetString(t), err.Error())
+	}
+	if n > math.MaxUint64>>shift {
+		return 0, fmt.Errorf("Unable to parse '%s' setting: '%s' is too large", t, viper.GetString(t))
+	}
+	return n << shift, nil
+}
+
+func exitCodesSettingParser(t string) ([]int, error) {
+	var codes []int
+	ec := viper.GetStringSlice(t)
+	for a := range ec {
+		val, err := strconv.Atoi(ec[a])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse '%s' setting: unable to convert %s to int: %s", t, ec[a], err.Error())
+		}
+		if val < 0 || val > 255 {
+			return nil, fmt.Errorf("Unable to parse '%s' setting: exit code %d is out of range", t, val)
+		}
+		codes = append(codes, val)
+	}
+	return codes, nil
+}
+
+// settings which must be absolute paths
+var pathSettings = []string{
+	"cephfs-mount",
+	"backup-mount",
+	"cephfs-rsync-lock",
+	"cephfs-success-file",
+	"cephfs-mount-root",
+	"rbd-change-state",
+	"trash-state",
+	"trash-audit-log",
+}
+
+func pathSettingParser(t string) (string, error) {
+	p := viper.GetString(t)
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("Unable to parse '%s' setting: '%s' is not an absolute path", t, p)
+	}
+	return filepath.Clean(p), nil
+}
+
+// relativeDirsSettingParser checks a list of directories are relative and stay below the directory they are relative to
+func relativeDirsSettingParser(t string) ([]string, error) {
+	var dirs []string
+	for _, d := range viper.GetStringSlice(t) {
+		d = filepath.Clean(d)
+		if filepath.IsAbs(d) || d == ".." || strings.HasPrefix(d, "../") {
+			return nil, fmt.Errorf("Unable to parse '%s' setting: '%s' must be a relative path below the mount", t, d)
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+// validateConfig checks every setting that can fail to parse and returns all of the errors found,
+// so that a bad config can be rejected as a whole before any of it is applied
+func validateConfig() (errs []error) {
+	if configReadErr != nil {
+		errs = append(errs, fmt.Errorf("Unable to read config file: %s", configReadErr.Error()))
+	}
+	for _, t := range durationSettings {
+		if _, err := durationSettingParser(t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, t := range cronSettings {
+		if _, err := cronSettingParser(t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, t := range pathSettings {
+		if _, err := pathSettingParser(t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, t := range sizeSettings {
+		if _, err := sizeSettingParser(t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if viper.GetBool("browse") {
+		if viper.GetString("browse-auth-file") == "" {
+			errs = append(errs, fmt.Errorf("'browse' needs users in 'browse-auth-file'"))
+		} else if _, err := readBrowseUsers(viper.GetString("browse-auth-file")); err != nil {
+			errs = append(errs, fmt.Errorf("Unable to parse 'browse-auth-file' setting: %s", err.Error()))
+		}
+	}
+	if step, err := sizeSettingParser("cephfs-rbd-grow-step"); err == nil && step == 0 {
+		errs = append(errs, fmt.Errorf("Unable to parse 'cephfs-rbd-grow-step' setting: it must be above 0"))
+	}
+	size, sizeErr := sizeSettingParser("cephfs-rbd-size")
+	maxSize, maxErr := sizeSettingParser("cephfs-rbd-max-size")
+	if sizeErr == nil && maxErr == nil && size > maxSize {
+		errs = append(errs, fmt.Errorf("Unable to parse 'cephfs-rbd-size' setting: it must not be above 'cephfs-rbd-max-size'"))
+	}
+	if fs := viper.GetString("cephfs-rbd-fs"); fs != "xfs" && fs != "ext4" {
+		errs = append(errs, fmt.Errorf("Unable to parse 'cephfs-rbd-fs' setting: '%s' must be xfs or ext4", fs))
+	}
+	for _, t := range []string{"pool-soft-limit-pct", "pool-hard-limit-pct"} {
+		if pct := viper.GetInt(t); pct < 0 || pct > 100 {
+			errs = append(errs, fmt.Errorf("Unable to parse '%s' setting: '%d' must be a percentage", t, pct))
+		}
+	}
+	if soft, hard := viper.GetInt("pool-soft-limit-pct"), viper.GetInt("pool-hard-limit-pct"); soft > 0 && hard > 0 && soft >= hard {
+		errs = append(errs, fmt.Errorf("'pool-soft-limit-pct' %d must be below 'pool-hard-limit-pct' %d", soft, hard))
 	}
-	return viper.GetString(t)
+	if d := viper.GetInt("cephfs-usage-depth"); d < 0 {
+		errs = append(errs, fmt.Errorf("Unable to parse 'cephfs-usage-depth' setting: '%d' must not be negative", d))
+	}
+	if w := viper.GetFloat64("rbd-change-weight"); w <= 0 || w > 1 {
+		errs = append(errs, fmt.Errorf("Unable to parse 'rbd-change-weight' setting: '%v' must be above 0 and at most 1", w))
+	}
+	if _, err := exitCodesSettingParser("cephfs-rsync-valid-exit-codes"); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := relativeDirsSettingParser("cephfs-snapshot-dirs"); err != nil {
+		errs = append(errs, err)
+	}
+	jobs, jobErrs := cephfsJobsSettingParser()
+	errs = append(errs, jobErrs...)
+	if _, err := loadKeyring(); err != nil {
+		errs = append(errs, err)
+	}
+	if viper.GetBool("encryption") {
+		if viper.GetBool("cephfs-catalog") {
+			errs = append(errs, fmt.Errorf("cephfs-catalog can't be used with encryption, the catalog keeps paths, sizes and hashes unencrypted"))
+		}
+		for _, j := range jobs {
+			if j.Engine != "repo" && (!viper.GetBool("cephfs-rbd-manage") || j.RbdName == "") {
+				errs = append(errs, fmt.Errorf("CephFS job %s uses the %s engine whose copies are only encrypted on a backup RBD cephback manages, set cephfs-rbd-manage and an RBD name or use the repo engine", j.Name, j.Engine))
+			}
+		}
+	}
+	return errs
 }
 
+// setConfigVars copies the viper settings into the package vars. The config must have passed validateConfig first.
 func setConfigVars() {
 
 	cephUser = viper.GetString("ceph-user")
 	debug = viper.GetBool("debug")
+	cephPool = viper.GetString("ceph-pool")
 	rbdSnapCountMin = viper.GetInt("rbd-snap-count-min")
-	rbdSnapAgeMin = durationSettingParser("rbd-snap-age-min")
-	rbdSnapAgeMax = durationSettingParser("rbd-snap-age-max")
-	checkRbdInterval = cronSettingParser("rbd-interval")
-	checkPurgedInterval = cronSettingParser("purge-interval")
-	healthCheckInterval = cronSettingParser("healthcheck-interval")
-	imageExclude = viper.GetStringSlice("exclude")
+	rbdSnapAgeMin, _ = durationSettingParser("rbd-snap-age-min")
+	rbdSnapAgeMax, _ = durationSettingParser("rbd-snap-age-max")
+	checkRbdInterval, _ = cronSettingParser("rbd-interval")
+	checkPurgedInterval, _ = cronSettingParser("purge-interval")
+	healthCheckInterval, _ = cronSettingParser("healthcheck-interval")
 	httpListen = viper.GetString("listen")
 	cephfsMount = viper.GetString("cephfs-mount")
 	backupMount = viper.GetString("backup-mount")
-	checkCephfsInterval = cronSettingParser("cephfs-interval")
-	rsyncCephfsInterval = durationSettingParser("cephfs-rsync-interval")
-	cephfsRsyncLock = viper.GetString("cephfs-rsync-lock")
-	cephfsRsyncArgs = viper.GetStringSlice("cephfs-rsync-args")
-	// clear slice
-	cephfsRsyncValidExitCodes = cephfsRsyncValidExitCodes[:0]
-	ec := viper.GetStringSlice("cephfs-rsync-valid-exit-codes")
-	for a := range ec {
-		val, err := strconv.Atoi(ec[a])
-		if err == nil {
-			cephfsRsyncValidExitCodes = append(cephfsRsyncValidExitCodes, val)
-		} else {
-			logger.Errorf("Error processing cephfs-rsync-valid-exit-codes - unable to convert %s to int: %s", ec[a], err.Error())
-		}
+	cephfsRsyncLockWait, _ = durationSettingParser("cephfs-rsync-lock-wait")
+	cephfsSnapshots = viper.GetBool("cephfs-snapshots")
+	cephfsJobs, _ = cephfsJobsSettingParser()
+	cephfsRsyncShardRetries = viper.GetInt("cephfs-rsync-shard-retries")
+	cephfsMountRoot = filepath.Clean(viper.GetString("cephfs-mount-root"))
+	cephfsPvBackupsEnabled = viper.GetBool("cephfs-pv-backups")
+	cephfsPvInterval, _ = cronSettingParser("cephfs-pv-interval")
+	cephfsPvTarget = filepath.Clean("/" + viper.GetString("cephfs-pv-target"))[1:]
+	fsfreezeMax, _ = durationSettingParser("fsfreeze-max")
+	encryptionKeys, _ = loadKeyring()
+	capacityWarningWindow, _ = durationSettingParser("capacity-warning-window")
+	cephfsUsageDepth = viper.GetInt("cephfs-usage-depth")
+	cephfsUsageInterval, _ = cronSettingParser("cephfs-usage-interval")
+	cephfsGuard = viper.GetBool("cephfs-guard")
+	cephfsGuardDeletesMin = viper.GetInt64("cephfs-guard-deletes-min")
+	cephfsGuardDeletesFactor = viper.GetFloat64("cephfs-guard-deletes-factor")
+	cephfsGuardChangedMin, _ = sizeSettingParser("cephfs-guard-changed-min")
+	cephfsGuardChangedFactor = viper.GetFloat64("cephfs-guard-changed-factor")
+	cephfsCatalog = viper.GetBool("cephfs-catalog")
+	cephfsCatalogHash = viper.GetBool("cephfs-catalog-hash")
+	browseEnabled = viper.GetBool("browse")
+	browseAuthFile = viper.GetString("browse-auth-file")
+	browseIdleTimeout, _ = durationSettingParser("browse-idle-timeout")
+	cephfsRbdManage = viper.GetBool("cephfs-rbd-manage")
+	cephfsRbdSize, _ = sizeSettingParser("cephfs-rbd-size")
+	cephfsRbdFeatures = viper.GetStringSlice("cephfs-rbd-features")
+	cephfsRbdFs = viper.GetString("cephfs-rbd-fs")
+	cephfsRbdGrowFreePct = viper.GetInt("cephfs-rbd-grow-free-pct")
+	cephfsRbdGrowStep, _ = sizeSettingParser("cephfs-rbd-grow-step")
+	cephfsRbdMaxSize, _ = sizeSettingParser("cephfs-rbd-max-size")
+	shutdownTimeout, _ = durationSettingParser("shutdown-timeout")
+	deletionRatePerMinute = viper.GetInt("deletion-rate-per-minute")
+	deletionMaxPerPass = viper.GetInt("deletion-max-per-pass")
+	deletionPauseBusy = viper.GetBool("deletion-pause-busy")
+	trashEnabled = viper.GetBool("trash")
+	trashDelay, _ = durationSettingParser("trash-delay")
+	trashState, _ = pathSettingParser("trash-state")
+	trashAuditLog, _ = pathSettingParser("trash-audit-log")
+	poolSoftLimitPct = viper.GetInt("pool-soft-limit-pct")
+	poolHardLimitPct = viper.GetInt("pool-hard-limit-pct")
+	rbdAccounting = viper.GetBool("rbd-accounting")
+	rbdAccountingInterval, _ = cronSettingParser("rbd-accounting-interval")
+	rbdAccountingFullScan = viper.GetBool("rbd-accounting-full-scan")
+	rbdChangeDetect = viper.GetBool("rbd-change-detect")
+	rbdChangeState, _ = pathSettingParser("rbd-change-state")
+	rbdChangeFactor = viper.GetFloat64("rbd-change-factor")
+	rbdChangeMinBytes, _ = sizeSettingParser("rbd-change-min-bytes")
+	rbdChangeMinSamples = viper.GetInt("rbd-change-min-samples")
+	rbdChangeWeight = viper.GetFloat64("rbd-change-weight")
+
+	// remove the cephfs rbds from the list - we'll handle these separately
+	imageExclude = viper.GetStringSlice("exclude")
+	for _, j := range cephfsJobs {
+		imageExclude = append(imageExclude, j.RbdName)
 	}
-	cephfsSuccessFile = viper.GetString("cephfs-success-file")
-	cephfsRbdName = viper.GetString("cephfs-rbd-name")
-	cephfsSnapCountMin = viper.GetInt("cephfs-snap-count-min")
-	cephfsSnapAgeMin = durationSettingParser("cephfs-snap-age-min")
-	cephfsSnapAgeMax = durationSettingParser("cephfs-snap-age-max")
 
 }
 
@@ -195,13 +517,20 @@ func initConfig() {
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
+	configReadErr = viper.ReadInConfig()
+	if configReadErr == nil {
 		logger.Info("Using config file:", viper.ConfigFileUsed())
+	} else if _, ok := configReadErr.(viper.ConfigFileNotFoundError); ok {
+		configReadErr = nil
 	}
+}
 
+// watchConfig reloads the config whenever the config file changes
+func watchConfig() {
+	lastGoodConfig, _ = ioutil.ReadFile(viper.ConfigFileUsed())
 	viper.WatchConfig()
 	viper.OnConfigChange(func(e fsnotify.Event) {
-		logger.Infof("Config file changed:", e.Name)
-		setConfigVars()
+		logger.Infof("Config file changed: %s", e.Name)
+		reloadConfig()
 	})
 }
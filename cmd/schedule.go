@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"github.com/robfig/cron"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var scheduler *cron.Cron
+var schedulerMutex sync.Mutex
+
+// scheduled jobs which are currently running
+var jobsRunning sync.WaitGroup
+
+// closed once a shutdown signal has been received
+var shutdownStarted = make(chan struct{})
+
+// startScheduler builds a new cron from the current config, replacing any scheduler that is already running.
+// Jobs that are running when the old scheduler is stopped are left to finish.
+func startScheduler() {
+	schedulerMutex.Lock()
+	defer schedulerMutex.Unlock()
+
+	if isShuttingDown() {
+		return
+	}
+
+	if scheduler != nil {
+		logger.Info("Stopping existing scheduler")
+		scheduler.Stop()
+	}
+
+	logger.Infof("Starting RBD routine on cron schedule -> %s", checkRbdInterval)
+	logger.Infof("Starting PVs Failed routine on cron schedule -> %s", checkPurgedInterval)
+	logger.Infof("Starting health check routine on cron schedule -> %s", healthCheckInterval)
+
+	// initialize a new cron
+	c := cron.New()
+	// add the rbd routine
+	c.AddFunc(checkRbdInterval, trackJob("rbd", func() { processImages() }))
+	// add the failed pv routine - this is to handle Failed pv's - Openshift fails to delete the pv if the rbd has snapshots
+	c.AddFunc(checkPurgedInterval, trackJob("failed-pv", func() { purgeSnapsOnFailedPV() }))
+	// add the trash purge routine
+	if trashEnabled {
+		c.AddFunc(checkPurgedInterval, trackJob("trash", func() { purgeTrash(false) }))
+	}
+	// add a cephfs routine for each job
+	for _, j := range cephfsJobs {
+		j := j
+		logger.Infof("Starting CephFS job %s routine on cron schedule -> %s", j.Name, j.Schedule)
+		c.AddFunc(j.Schedule, trackJob("cephfs-"+j.Name, func() { processCephFSJob(j) }))
+	}
+	// add the cephfs pv routine
+	if cephfsPvBackupsEnabled {
+		logger.Infof("Starting CephFS PV routine on cron schedule -> %s", cephfsPvInterval)
+		c.AddFunc(cephfsPvInterval, trackJob("cephfs-pv", func() { processCephFSPvs() }))
+	}
+	// add the backup usage routine
+	if cephfsUsageDepth > 0 {
+		logger.Infof("Starting CephFS backup usage routine on cron schedule -> %s", cephfsUsageInterval)
+		c.AddFunc(cephfsUsageInterval, trackJob("cephfs-usage", func() { measureBackupUsage() }))
+	}
+	// add the rbd space accounting routine
+	if rbdAccounting {
+		logger.Infof("Starting RBD space accounting routine on cron schedule -> %s", rbdAccountingInterval)
+		c.AddFunc(rbdAccountingInterval, trackJob("rbd-accounting", func() { accountSpace() }))
+	}
+	// add the health check routine
+	c.AddFunc(healthCheckInterval, trackJob("health", func() { checkHealth() }))
+	c.Start()
+
+	scheduler = c
+}
+
+// scheduled jobs by name which are currently running, a job still running from a replaced scheduler is not
+// started again by the new one
+var runningJobs = make(map[string]bool)
+var runningJobsMutex sync.Mutex
+
+// trackJob wraps a scheduled job so that shutdown can wait for it to finish and it never runs twice at once
+func trackJob(name string, f func()) func() {
+	return func() {
+		// checked under the same lock shutdown is started with, so Add never races with Wait
+		runningJobsMutex.Lock()
+		if isShuttingDown() {
+			runningJobsMutex.Unlock()
+			return
+		}
+		if runningJobs[name] {
+			runningJobsMutex.Unlock()
+			logger.Warnf("Job %s is still running, skipping this run", name)
+			return
+		}
+		runningJobs[name] = true
+		jobsRunning.Add(1)
+		runningJobsMutex.Unlock()
+
+		defer func() {
+			runningJobsMutex.Lock()
+			delete(runningJobs, name)
+			runningJobsMutex.Unlock()
+			jobsRunning.Done()
+		}()
+		f()
+	}
+}
+
+func isShuttingDown() bool {
+	select {
+	case <-shutdownStarted:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT is received, then stops the scheduler and waits up to shutdownTimeout
+// for running jobs before interrupting any commands they are still running. Frozen mounts are always thawed.
+func waitForShutdown() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+
+	logger.Infof("Received signal %s, shutting down", sig)
+	runningJobsMutex.Lock()
+	close(shutdownStarted)
+	runningJobsMutex.Unlock()
+
+	schedulerMutex.Lock()
+	if scheduler != nil {
+		scheduler.Stop()
+	}
+	schedulerMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		jobsRunning.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info("All running jobs finished")
+	case <-time.After(shutdownTimeout):
+		logger.Warnf("Running jobs did not finish within %s, interrupting them", shutdownTimeout)
+		interruptCommands()
+		select {
+		case <-done:
+			logger.Info("All running jobs finished after being interrupted")
+		case <-time.After(10 * time.Second):
+			logger.Error("Running jobs did not finish after being interrupted")
+		}
+	}
+
+	closeBrowseMounts()
+	thawAll()
+	logger.Info("Shutdown complete")
+	os.Exit(0)
+}
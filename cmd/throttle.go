@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a check of whether the cluster is recovering is trusted
+var clusterBusyCacheTime = 30 * time.Second
+
+var (
+	metricDeletionBacklog = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cephback_deletion_backlog",
+			Help: "The number of snapshot deletions the last pass left for later because of the rate limit, cap or a busy cluster",
+		},
+		[]string{"pass"},
+	)
+	metricDeletionsPerformed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cephback_deletions_performed",
+			Help: "The number of snapshot or image deletions let through by the throttle",
+		},
+		[]string{"pass"},
+	)
+	metricDeletionsPaused = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cephback_deletions_paused",
+			Help: "Whether deletions are paused because the cluster is recovering, backfilling or has slow ops",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricDeletionBacklog)
+	prometheus.MustRegister(metricDeletionsPerformed)
+	prometheus.MustRegister(metricDeletionsPaused)
+}
+
+// the rate limit is shared by every pass so that passes running at the same time do not add up
+var deletionMutex sync.Mutex
+var lastDeletion time.Time
+var clusterBusyChecked time.Time
+var clusterBusyReason string
+
+// deletionPass throttles the deletions of one retention or purge pass. Deletions it refuses are counted as its
+// backlog and left for a later pass.
+type deletionPass struct {
+	name     string
+	allowed  int
+	deferred int
+}
+
+func newDeletionPass(name string) *deletionPass {
+	return &deletionPass{name: name}
+}
+
+// allow waits until the rate limit lets another deletion through and returns true, or returns false if the pass
+// has reached its cap, the cluster is busy or we are shutting down
+func (p *deletionPass) allow() bool {
+	if p.deferred > 0 || (deletionMaxPerPass > 0 && p.allowed >= deletionMaxPerPass) {
+		p.deferred++
+		return false
+	}
+	if deletionPauseBusy {
+		if reason := clusterBusy(); reason != "" {
+			logger.Warnf("Pausing %s deletions, the cluster is busy: %s", p.name, reason)
+			p.deferred++
+			return false
+		}
+	}
+
+	deletionMutex.Lock()
+	defer deletionMutex.Unlock()
+	if deletionRatePerMinute > 0 {
+		wait := lastDeletion.Add(time.Minute / time.Duration(deletionRatePerMinute)).Sub(time.Now())
+		if wait > 0 {
+			select {
+			case <-shutdownStarted:
+				p.deferred++
+				return false
+			case <-time.After(wait):
+			}
+		}
+	}
+	lastDeletion = time.Now()
+	p.allowed++
+	metricDeletionsPerformed.WithLabelValues(p.name).Inc()
+	return true
+}
+
+// done reports the pass's backlog
+func (p *deletionPass) done() {
+	metricDeletionBacklog.WithLabelValues(p.name).Set(float64(p.deferred))
+	if p.deferred > 0 {
+		logger.Infof("%d %s deletions left for a later pass, %d done", p.deferred, p.name, p.allowed)
+	}
+}
+
+// clusterBusy returns why the cluster is too busy for snapshot trimming, or "" if it is not
+func clusterBusy() string {
+	deletionMutex.Lock()
+	defer deletionMutex.Unlock()
+	if time.Since(clusterBusyChecked) < clusterBusyCacheTime {
+		return clusterBusyReason
+	}
+
+	reason, err := clusterStatusBusy()
+	if err != nil {
+		// deleting blind could make an unhealthy cluster worse
+		logger.Errorf("Unable to get cluster status: %s", err.Error())
+		reason = "status unknown"
+	}
+	clusterBusyChecked = time.Now()
+	clusterBusyReason = reason
+	if reason != "" {
+		metricDeletionsPaused.Set(1)
+	} else {
+		metricDeletionsPaused.Set(0)
+	}
+	return reason
+}
+
+// clusterStatusBusy looks for recovering or backfilling placement groups and slow requests in ceph status.
+// Jewel reports slow requests in the health summary, later releases as health checks.
+func clusterStatusBusy() (string, error) {
+	if err := CephConnInit(); err != nil {
+		return "", err
+	}
+	buf, info, err := conn.MonCommand([]byte(`{"prefix": "status", "format": "json"}`))
+	if err != nil {
+		return "", fmt.Errorf("ceph status failed: %s %s", err.Error(), info)
+	}
+	var status struct {
+		Health struct {
+			Summary []struct {
+				Summary string `json:"summary"`
+			} `json:"summary"`
+			Checks map[string]interface{} `json:"checks"`
+		} `json:"health"`
+		PGMap struct {
+			PGsByState []struct {
+				StateName string `json:"state_name"`
+				Count     int    `json:"count"`
+			} `json:"pgs_by_state"`
+		} `json:"pgmap"`
+	}
+	if err := json.Unmarshal(buf, &status); err != nil {
+		return "", fmt.Errorf("Unable to parse ceph status output: %s", err.Error())
+	}
+
+	var reasons []string
+	for _, s := range status.PGMap.PGsByState {
+		if strings.Contains(s.StateName, "recover") || strings.Contains(s.StateName, "backfill") {
+			reasons = append(reasons, fmt.Sprintf("%d pgs %s", s.Count, s.StateName))
+		}
+	}
+	for _, s := range status.Health.Summary {
+		if strings.Contains(s.Summary, "blocked") || strings.Contains(s.Summary, "slow") {
+			reasons = append(reasons, s.Summary)
+		}
+	}
+	for _, check := range []string{"SLOW_OPS", "REQUEST_SLOW", "REQUEST_STUCK"} {
+		if _, ok := status.Health.Checks[check]; ok {
+			reasons = append(reasons, check)
+		}
+	}
+	return strings.Join(reasons, ", "), nil
+}
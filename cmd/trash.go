@@ -0,0 +1,594 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexflint/go-filemutex"
+	"github.com/ceph/go-ceph/rbd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// trashed snapshots and images are renamed with this prefix and a timestamp, which takes them out of retention.
+// rbd trash mv would keep image names but jewel does not have it, so images are renamed too.
+var trashPrefix = "trash_"
+var trashTimeFormat = "20060102150405"
+
+var (
+	metricTrashMoved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cephback_trash_moved",
+			Help: "The number of snapshots and images moved to the trash",
+		},
+		[]string{"kind"},
+	)
+	metricTrashRestored = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cephback_trash_restored",
+			Help: "The number of snapshots and images restored from the trash",
+		},
+		[]string{"kind"},
+	)
+	metricTrashPurged = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cephback_trash_purged",
+			Help: "The number of snapshots and images permanently removed from the trash",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(newTrashCollector())
+	prometheus.MustRegister(metricTrashMoved)
+	prometheus.MustRegister(metricTrashRestored)
+	prometheus.MustRegister(metricTrashPurged)
+}
+
+// TrashEntry is a snapshot or image in the trash. For a snapshot Image is the image it belongs to and Name its
+// original name, for an image Name is its original name.
+type TrashEntry struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Image      string    `json:"image"`
+	Name       string    `json:"name"`
+	TrashName  string    `json:"trash_name"`
+	Reason     string    `json:"reason"`
+	Trashed    time.Time `json:"trashed"`
+	PurgeAfter time.Time `json:"purge_after"`
+}
+
+// TrashEvent is a line of the trash audit log
+type TrashEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	TrashEntry
+	Error string `json:"error,omitempty"`
+}
+
+// TrashHold is a snapshot restored from the trash. Retention would otherwise trash it again on its next pass, so it
+// leaves held snapshots alone until they are released with rbd trash release.
+type TrashHold struct {
+	Image    string    `json:"image"`
+	Name     string    `json:"name"`
+	Restored time.Time `json:"restored"`
+}
+
+// serialises changes to the trash state file within this process, lockTrash also locks out the CLI
+var trashMutex sync.Mutex
+
+// lockTrash takes the trash lock, the returned func releases it
+func lockTrash() (func(), error) {
+	trashMutex.Lock()
+	m, err := filemutex.New(trashState + ".lock")
+	if err != nil {
+		trashMutex.Unlock()
+		return nil, err
+	}
+	if err := m.Lock(); err != nil {
+		m.Close()
+		trashMutex.Unlock()
+		return nil, err
+	}
+	return func() {
+		m.Unlock()
+		m.Close()
+		trashMutex.Unlock()
+	}, nil
+}
+
+func readTrash() ([]TrashEntry, error) {
+	var entries []TrashEntry
+	if err := readState(trashState, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func writeTrash(entries []TrashEntry) error {
+	return writeState(trashState, entries)
+}
+
+// trashHoldsFile is where the holds on restored snapshots are kept, next to the trash state and under its lock
+func trashHoldsFile() string {
+	return trashState + ".holds"
+}
+
+func readTrashHolds() ([]TrashHold, error) {
+	var holds []TrashHold
+	if err := readState(trashHoldsFile(), &holds); err != nil {
+		return nil, err
+	}
+	return holds, nil
+}
+
+// heldSnaps returns the snapshots of an image restored from the trash and not released yet
+func heldSnaps(imageName string) (names []string, err error) {
+	holds, err := readTrashHolds()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range holds {
+		if h.Image == imageName {
+			names = append(names, h.Name)
+		}
+	}
+	return names, nil
+}
+
+// releaseHold lets retention delete a snapshot restored from the trash again
+func releaseHold(imageName string, snapName string) error {
+	unlock, err := lockTrash()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	holds, err := readTrashHolds()
+	if err != nil {
+		return err
+	}
+	for i, h := range holds {
+		if h.Image != imageName || h.Name != snapName {
+			continue
+		}
+		auditTrash("release", TrashEntry{ID: imageName + "@" + snapName, Kind: "snapshot", Image: imageName, Name: snapName}, nil)
+		logger.Infof("Released snapshot %s@%s to retention", imageName, snapName)
+		return writeState(trashHoldsFile(), append(holds[:i], holds[i+1:]...))
+	}
+	return fmt.Errorf("Snapshot %s@%s is not held", imageName, snapName)
+}
+
+// trashCollector counts the trash entries when scraped, as the CLI changes the trash too
+type trashCollector struct {
+	entries *prometheus.Desc
+}
+
+func newTrashCollector() *trashCollector {
+	return &trashCollector{
+		entries: prometheus.NewDesc("cephback_trash_entries", "The number of snapshots and images in the trash", []string{"kind"}, nil),
+	}
+}
+
+func (c *trashCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.entries
+}
+
+func (c *trashCollector) Collect(ch chan<- prometheus.Metric) {
+	if !trashEnabled {
+		return
+	}
+	entries, err := readTrash()
+	if err != nil {
+		logger.Errorf("Unable to read trash state: %s", err.Error())
+		return
+	}
+	counts := map[string]int{"snapshot": 0, "image": 0}
+	for _, e := range entries {
+		counts[e.Kind]++
+	}
+	for kind, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(n), kind)
+	}
+}
+
+// auditTrash appends an event to the trash audit log
+func auditTrash(action string, e TrashEntry, actionErr error) {
+	ev := TrashEvent{Time: time.Now(), Action: action, TrashEntry: e}
+	if actionErr != nil {
+		ev.Error = actionErr.Error()
+	}
+	data, _ := json.Marshal(ev)
+	f, err := os.OpenFile(trashAuditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Errorf("Unable to write trash audit log %s: %s", trashAuditLog, err.Error())
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
+
+// addTrash records a new trash entry
+func addTrash(e TrashEntry) error {
+	unlock, err := lockTrash()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := readTrash()
+	if err != nil {
+		return err
+	}
+	return writeTrash(append(entries, e))
+}
+
+// trashSnap renames a snapshot into the trash instead of deleting it
+func trashSnap(imageName string, snapName string, reason string) error {
+	now := time.Now()
+	e := TrashEntry{
+		Kind:       "snapshot",
+		Image:      imageName,
+		Name:       snapName,
+		TrashName:  trashPrefix + snapName + "_" + now.Format(trashTimeFormat),
+		Reason:     reason,
+		Trashed:    now,
+		PurgeAfter: now.Add(trashDelay),
+	}
+	e.ID = e.Image + "@" + e.TrashName
+	logger.Infof("Moving snapshot %s@%s to the trash as %s", imageName, snapName, e.TrashName)
+	if _, err := rbdCommand("snap", "rename", imageName+"@"+snapName, imageName+"@"+e.TrashName); err != nil {
+		auditTrash("trash", e, err)
+		return err
+	}
+	metricTrashMoved.WithLabelValues(e.Kind).Inc()
+	auditTrash("trash", e, nil)
+	return addTrash(e)
+}
+
+// trashImage renames an image, with its snapshots, into the trash instead of purging its snapshots
+func trashImage(imageName string, reason string) error {
+	unlock, err := lockTrash()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := readTrash()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Kind == "image" && e.Name == imageName {
+			logger.Debugf("Image %s is already in the trash as %s", imageName, e.TrashName)
+			return nil
+		}
+	}
+
+	now := time.Now()
+	e := TrashEntry{
+		Kind:       "image",
+		Image:      imageName,
+		Name:       imageName,
+		TrashName:  trashPrefix + imageName + "_" + now.Format(trashTimeFormat),
+		Reason:     reason,
+		Trashed:    now,
+		PurgeAfter: now.Add(trashDelay),
+	}
+	e.ID = e.TrashName
+	logger.Infof("Moving image %s to the trash as %s", imageName, e.TrashName)
+	if _, err := rbdCommand("rename", imageName, e.TrashName); err != nil {
+		auditTrash("trash", e, err)
+		return err
+	}
+	metricTrashMoved.WithLabelValues(e.Kind).Inc()
+	auditTrash("trash", e, nil)
+	return writeTrash(append(entries, e))
+}
+
+// restoreTrash renames a trash entry back to its original name and removes it from the trash. A restored snapshot
+// is held, so retention does not trash it again, until it is released.
+func restoreTrash(id string) error {
+	unlock, err := lockTrash()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := readTrash()
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.ID != id {
+			continue
+		}
+		if e.Kind == "snapshot" {
+			_, err = rbdCommand("snap", "rename", e.Image+"@"+e.TrashName, e.Image+"@"+e.Name)
+		} else {
+			_, err = rbdCommand("rename", e.TrashName, e.Name)
+		}
+		auditTrash("restore", e, err)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Restored %s %s from the trash", e.Kind, e.ID)
+		metricTrashRestored.WithLabelValues(e.Kind).Inc()
+		if e.Kind == "snapshot" {
+			holds, err := readTrashHolds()
+			if err != nil {
+				return err
+			}
+			holds = append(holds, TrashHold{Image: e.Image, Name: e.Name, Restored: time.Now()})
+			if err := writeState(trashHoldsFile(), holds); err != nil {
+				return err
+			}
+			logger.Infof("Snapshot %s@%s is held from retention until released with rbd trash release", e.Image, e.Name)
+		}
+		return writeTrash(append(entries[:i], entries[i+1:]...))
+	}
+	return fmt.Errorf("No trash entry %s", id)
+}
+
+// errDeletionDeferred is returned when the throttle leaves a deletion for a later pass
+var errDeletionDeferred = errors.New("deletion deferred")
+
+// removeTrashEntry permanently removes what a trash entry holds. A trashed image loses its snapshots first,
+// including protected ones, each of them and the image itself counting against the pass's throttle.
+func removeTrashEntry(e TrashEntry, p *deletionPass) error {
+	if e.Kind == "snapshot" {
+		if !p.allow() {
+			return errDeletionDeferred
+		}
+		return removeSnap(e.Image, e.TrashName)
+	}
+	img := rbd.GetImage(iocx, e.TrashName)
+	if err := img.Open(); err != nil {
+		return err
+	}
+	snaps, err := img.GetSnapshotNames()
+	if err != nil {
+		img.Close()
+		return err
+	}
+	for _, s := range snaps {
+		if !p.allow() {
+			img.Close()
+			return errDeletionDeferred
+		}
+		snap := img.GetSnapshot(s.Name)
+		if protected, _ := snap.IsProtected(); protected {
+			if err := snap.Unprotect(); err != nil {
+				img.Close()
+				return fmt.Errorf("Unable to unprotect snapshot %s@%s: %s", e.TrashName, s.Name, err.Error())
+			}
+		}
+		if err := snap.Remove(); err != nil {
+			img.Close()
+			return fmt.Errorf("Unable to remove snapshot %s@%s: %s", e.TrashName, s.Name, err.Error())
+		}
+	}
+	img.Close()
+	if !p.allow() {
+		return errDeletionDeferred
+	}
+	return img.Remove()
+}
+
+// purgeTrash permanently removes trash entries whose delay has passed, or every entry if all is set
+func purgeTrash(all bool) (purged int) {
+	purged, _ = purgeTrashEntries(all)
+	return purged
+}
+
+// purgeTrashEntries permanently removes trash entries oldest first, those whose delay has passed or every entry if
+// all is set, and tells if entries to purge are left for the throttle or for a purge already running. The trash
+// lock is only held to pick the entries and to drop the purged ones, not while the throttle waits, and a purge
+// already running, here or in the CLI, is left to it. Entries purged before their delay are audited as such.
+func purgeTrashEntries(all bool) (purged int, pending bool) {
+	if err := CephConnInit(); err != nil {
+		logger.Error(err.Error())
+		return 0, false
+	}
+	m, err := filemutex.New(trashState + ".purge")
+	if err != nil {
+		logger.Errorf("Unable to lock trash purge: %s", err.Error())
+		return 0, false
+	}
+	defer m.Close()
+	if err := m.TryLock(); err != nil {
+		if err == filemutex.AlreadyLocked {
+			logger.Infof("Trash purge already running, skipping")
+			return 0, true
+		}
+		logger.Errorf("Unable to lock trash purge: %s", err.Error())
+		return 0, false
+	}
+	defer m.Unlock()
+
+	unlock, err := lockTrash()
+	if err != nil {
+		logger.Errorf("Unable to lock trash state: %s", err.Error())
+		return 0, false
+	}
+	entries, err := readTrash()
+	unlock()
+	if err != nil {
+		logger.Errorf("Unable to read trash state: %s", err.Error())
+		return 0, false
+	}
+	var due []TrashEntry
+	for _, e := range entries {
+		if all || !time.Now().Before(e.PurgeAfter) {
+			due = append(due, e)
+		}
+	}
+	if len(due) == 0 {
+		return 0, false
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Trashed.Before(due[j].Trashed) })
+
+	p := newDeletionPass("trash")
+	defer p.done()
+	removed := make(map[string]bool)
+	for _, e := range due {
+		err := removeTrashEntry(e, p)
+		if err == errDeletionDeferred {
+			pending = true
+			break
+		}
+		action := "purge"
+		if time.Now().Before(e.PurgeAfter) {
+			action = "purge-early"
+		}
+		auditTrash(action, e, err)
+		if err != nil {
+			logger.Errorf("Unable to purge %s %s from the trash: %s", e.Kind, e.ID, err.Error())
+			continue
+		}
+		if action == "purge-early" {
+			logger.Warnf("Purged %s %s from the trash before its delay, trashed %s for %s", e.Kind, e.ID, e.Trashed.Format(time.RFC3339), e.Reason)
+		} else {
+			logger.Infof("Purged %s %s from the trash, trashed %s for %s", e.Kind, e.ID, e.Trashed.Format(time.RFC3339), e.Reason)
+		}
+		metricTrashPurged.WithLabelValues(e.Kind).Inc()
+		removed[e.ID] = true
+		purged++
+	}
+	if purged == 0 {
+		return 0, pending
+	}
+
+	// entries may have been added or restored meanwhile
+	if unlock, err = lockTrash(); err != nil {
+		logger.Errorf("Unable to lock trash state: %s", err.Error())
+		return purged, pending
+	}
+	defer unlock()
+	if entries, err = readTrash(); err != nil {
+		logger.Errorf("Unable to read trash state: %s", err.Error())
+		return purged, pending
+	}
+	var kept []TrashEntry
+	for _, e := range entries {
+		if !removed[e.ID] {
+			kept = append(kept, e)
+		}
+	}
+	if err := writeTrash(kept); err != nil {
+		logger.Errorf("Unable to write trash state: %s", err.Error())
+	}
+	return purged, pending
+}
+
+// httpTrash lists the trash
+func httpTrash(w http.ResponseWriter, r *http.Request) {
+	entries, err := readTrash()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []TrashEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "Work with the snapshots and images moved to the trash instead of being deleted",
+}
+
+var trashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the trash",
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := readTrash()
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Trashed.Before(entries[j].Trashed) })
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tKIND\tIMAGE\tNAME\tREASON\tTRASHED\tPURGE AFTER")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.Kind, e.Image, e.Name, e.Reason,
+				e.Trashed.Format(time.RFC3339), e.PurgeAfter.Format(time.RFC3339))
+		}
+		w.Flush()
+	},
+}
+
+var trashRestoreCmd = &cobra.Command{
+	Use:   "restore <id>",
+	Short: "Put a snapshot or image back under its original name",
+	Long: `Put a snapshot or image back under its original name.
+
+A restored snapshot is held: retention leaves it alone until it is released with
+rbd trash release, after which it is trashed again once it is past its age.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := CephConnInit(); err != nil {
+			logger.Fatal(err.Error())
+		}
+		if err := restoreTrash(args[0]); err != nil {
+			logger.Fatal(err.Error())
+		}
+	},
+}
+
+var trashHeldCmd = &cobra.Command{
+	Use:   "held",
+	Short: "List the snapshots restored from the trash that retention leaves alone",
+	Run: func(cmd *cobra.Command, args []string) {
+		holds, err := readTrashHolds()
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "IMAGE\tSNAPSHOT\tRESTORED")
+		for _, h := range holds {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", h.Image, h.Name, h.Restored.Format(time.RFC3339))
+		}
+		w.Flush()
+	},
+}
+
+var trashReleaseCmd = &cobra.Command{
+	Use:   "release <image>@<snapshot>",
+	Short: "Let retention delete a snapshot restored from the trash again",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		parts := strings.SplitN(args[0], "@", 2)
+		if len(parts) != 2 {
+			logger.Fatalf("%s is not <image>@<snapshot>", args[0])
+		}
+		if err := releaseHold(parts[0], parts[1]); err != nil {
+			logger.Fatal(err.Error())
+		}
+	},
+}
+
+var trashPurgeAll bool
+
+var trashPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Permanently remove the trash entries whose delay has passed",
+	Run: func(cmd *cobra.Command, args []string) {
+		logger.Infof("Purged %d trash entries", purgeTrash(trashPurgeAll))
+	},
+}
+
+func init() {
+	trashPurgeCmd.Flags().BoolVar(&trashPurgeAll, "all", false, "Also remove the entries whose delay has not passed yet")
+	trashCmd.AddCommand(trashListCmd)
+	trashCmd.AddCommand(trashRestoreCmd)
+	trashCmd.AddCommand(trashHeldCmd)
+	trashCmd.AddCommand(trashReleaseCmd)
+	trashCmd.AddCommand(trashPurgeCmd)
+	rbdCmd.AddCommand(trashCmd)
+}
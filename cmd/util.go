@@ -2,15 +2,18 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/ceph/go-ceph/rbd"
 	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -31,19 +34,48 @@ func init() {
 // format for snapshot - used to parse into an actual time
 var layout = "2006-01-02_15:04"
 
-var health HealthStatus
+var health = HealthStatus{checks: make(map[string]string)}
 
+// HealthStatus holds a message for each failing check, keyed by check name
 type HealthStatus struct {
-	RBD    string
-	CephFS string
+	sync.Mutex
+	checks map[string]string
+}
+
+// Set records the message for a check, an empty message marks the check as healthy
+func (h *HealthStatus) Set(check string, msg string) {
+	h.Lock()
+	defer h.Unlock()
+
+	if msg == "" {
+		delete(h.checks, check)
+	} else {
+		h.checks[check] = msg
+	}
+	if len(h.checks) == 0 {
+		metricHealth.Set(0)
+	} else {
+		metricHealth.Set(1)
+	}
 }
 
 func (h *HealthStatus) Status() string {
-	if (h.RBD == "") && (h.CephFS == "") {
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.checks) == 0 {
 		return "OK"
-	} else {
-		return h.RBD + " " + h.CephFS
 	}
+	var names []string
+	for c := range h.checks {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	var msgs []string
+	for _, c := range names {
+		msgs = append(msgs, h.checks[c])
+	}
+	return strings.Join(msgs, " ")
 }
 
 type DiskStatus struct {
@@ -58,36 +90,61 @@ func DiskUsage(path string) (disk DiskStatus) {
 	if err != nil {
 		return
 	}
+	// match df: free is what is available to unprivileged users, used excludes the reserved blocks
 	disk.All = fs.Blocks * uint64(fs.Bsize)
-	disk.Free = fs.Bfree * uint64(fs.Bsize)
-	disk.Used = disk.All - disk.Free
+	disk.Free = fs.Bavail * uint64(fs.Bsize)
+	disk.Used = (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
 	return
 }
 
-func execHelper(command string, cmdArgs []string, validExitCodes []int) (result bool) {
+// processes started by execCommand that are still running, so that they can be interrupted on shutdown
+var runningCmds = make(map[*exec.Cmd]string)
+var runningCmdsMutex sync.Mutex
+
+// execCommand runs a command, logging its output, and returns its exit code and stdout
+func execCommand(command string, cmdArgs []string) (exitCode int, stdout string, err error) {
+	return execCommandInput(command, cmdArgs, nil)
+}
+
+// execCommandInput runs a command like execCommand with stdin read from input, which is not logged
+func execCommandInput(command string, cmdArgs []string, input []byte) (exitCode int, stdout string, err error) {
 
 	var outb, errb bytes.Buffer
-	var exitCode int
 
 	cmd := exec.Command(command, cmdArgs...)
 
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
 	cmd.Stdout = &outb
 	cmd.Stderr = &errb
 
 	logger.Infof("Running command %s %s", command, strings.Join(cmdArgs, " "))
-	err = cmd.Run()
+	if err = cmd.Start(); err != nil {
+		logger.Errorf("command %s could not be started: %s", command, err.Error())
+		return -1, "", err
+	}
+	runningCmdsMutex.Lock()
+	runningCmds[cmd] = command
+	runningCmdsMutex.Unlock()
 
-	stdout := strings.Split(outb.String(), "\n")
-	stderr := strings.Split(errb.String(), "\n")
+	err = cmd.Wait()
 
-	for l := range stdout {
-		if strings.TrimSpace(stdout[l]) != "" {
-			logger.Infof("command %s stdout: %s", command, stdout[l])
+	runningCmdsMutex.Lock()
+	delete(runningCmds, cmd)
+	runningCmdsMutex.Unlock()
+
+	stdoutLines := strings.Split(outb.String(), "\n")
+	stderrLines := strings.Split(errb.String(), "\n")
+
+	for l := range stdoutLines {
+		if strings.TrimSpace(stdoutLines[l]) != "" {
+			logger.Infof("command %s stdout: %s", command, stdoutLines[l])
 		}
 	}
-	for l := range stderr {
-		if strings.TrimSpace(stderr[l]) != "" {
-			logger.Infof("command %s stderr: %s", command, stderr[l])
+	for l := range stderrLines {
+		if strings.TrimSpace(stderrLines[l]) != "" {
+			logger.Infof("command %s stderr: %s", command, stderrLines[l])
 		}
 	}
 
@@ -95,6 +152,8 @@ func execHelper(command string, cmdArgs []string, validExitCodes []int) (result
 		if exitError, ok := err.(*exec.ExitError); ok {
 			ws := exitError.Sys().(syscall.WaitStatus)
 			exitCode = ws.ExitStatus()
+		} else {
+			exitCode = -1
 		}
 	} else {
 		// success, exitCode should be 0 if go is ok
@@ -102,19 +161,112 @@ func execHelper(command string, cmdArgs []string, validExitCodes []int) (result
 		exitCode = ws.ExitStatus()
 		logger.Infof("command %s exited successfully", command)
 	}
+	return exitCode, outb.String(), err
+}
+
+func execHelper(command string, cmdArgs []string, validExitCodes []int) (result bool) {
+
+	exitCode, _, err := execCommand(command, cmdArgs)
+
+	result = validExitCode(exitCode, validExitCodes)
+	if result == false {
+		if err != nil {
+			logger.Errorf("command %s returned an error: %s", command, err.Error())
+		} else {
+			logger.Errorf("command %s returned exit code %d", command, exitCode)
+		}
+	}
+	return result
+}
 
-	result = false
+func validExitCode(exitCode int, validExitCodes []int) bool {
 	for c := range validExitCodes {
 		if exitCode == validExitCodes[c] {
-			result = true
-			break
+			return true
 		}
 	}
+	return false
+}
 
-	if result == false {
-		logger.Errorf("command %s returned an error: %s", command, err.Error())
+// interruptCommands sends SIGTERM to every command started by execCommand that is still running
+func interruptCommands() {
+	runningCmdsMutex.Lock()
+	defer runningCmdsMutex.Unlock()
+
+	for cmd, command := range runningCmds {
+		logger.Warnf("Interrupting command %s (pid %d)", command, cmd.Process.Pid)
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			logger.Errorf("Error interrupting command %s (pid %d): %s", command, cmd.Process.Pid, err.Error())
+		}
+	}
+}
+
+// mounts frozen by freezeFS, with the watchdog timer that will thaw them
+var frozenMounts = make(map[string]*time.Timer)
+var frozenMountsMutex sync.Mutex
+
+// how soon the watchdog tries again after a thaw failed
+var thawRetryInterval = 30 * time.Second
+
+// freezeFS freezes a mount and starts a watchdog which thaws it again after fsfreezeMax, whatever happens to the caller
+func freezeFS(mount string) bool {
+	frozenMountsMutex.Lock()
+	defer frozenMountsMutex.Unlock()
+
+	if !execHelper("fsfreeze", []string{"-f", mount}, []int{0}) {
+		return false
+	}
+	frozenMounts[mount] = time.AfterFunc(fsfreezeMax, func() {
+		logger.Errorf("Mount %s has been frozen for longer than %s, thawing", mount, fsfreezeMax)
+		thawFS(mount)
+	})
+	return true
+}
+
+// thawFS thaws a mount frozen by freezeFS, it is safe to call more than once
+func thawFS(mount string) bool {
+	frozenMountsMutex.Lock()
+	defer frozenMountsMutex.Unlock()
+
+	t, ok := frozenMounts[mount]
+	if !ok {
+		return true
+	}
+	if !execHelper("fsfreeze", []string{"-u", mount}, []int{0}) {
+		// the watchdog keeps trying until the mount is thawed
+		t.Reset(thawRetryInterval)
+		return false
+	}
+	t.Stop()
+	delete(frozenMounts, mount)
+	return true
+}
+
+// thawAll thaws every mount frozen by freezeFS
+func thawAll() {
+	frozenMountsMutex.Lock()
+	var mounts []string
+	for m := range frozenMounts {
+		mounts = append(mounts, m)
+	}
+	frozenMountsMutex.Unlock()
+
+	for _, m := range mounts {
+		logger.Warnf("Thawing frozen mount %s", m)
+		thawFS(m)
+	}
+}
+
+// thawStaleFreeze thaws a mount that may have been left frozen by a previous cephback that died mid snapshot.
+// fsfreeze exits 1 if the mount was not frozen, which is the normal case.
+func thawStaleFreeze(mount string) {
+	if isMounted, err := mounted(mount); err != nil || !isMounted {
+		return
+	}
+	exitCode, _, _ := execCommand("fsfreeze", []string{"-u", mount})
+	if exitCode == 0 {
+		logger.Warnf("Thawed mount %s which was left frozen", mount)
 	}
-	return result
 }
 
 func mounted(mountpoint string) (bool, error) {
@@ -134,6 +286,65 @@ func mounted(mountpoint string) (bool, error) {
 	return mntpointSt.Dev != parentSt.Dev, nil
 }
 
+// getXattr returns the value of an extended attribute, such as the CephFS ceph.dir.* virtual attributes
+func getXattr(path string, name string) (string, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, len(buf)*2)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("Unable to read %s of %s: %s", name, path, err.Error())
+		}
+		return strings.TrimRight(string(buf[:n]), "\x00"), nil
+	}
+}
+
+// readState reads a JSON state file into v, leaving v untouched if the file does not exist yet
+func readState(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if data, err = unseal(data); err != nil {
+		return fmt.Errorf("Unable to read %s: %s", path, err.Error())
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeState writes v to a JSON state file, replacing the old file atomically so a crash never leaves it half written
+func writeState(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = seal(data); err != nil {
+		return err
+	}
+	// a temp file of its own, so that writers of the same state don't write over each other's
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 func matchSnapName(name string, regex string) bool {
 	match, _ := regexp.MatchString(regex, name)
 	return match
@@ -144,34 +355,54 @@ func getSnapshots(imageName string) (snaps []rbd.SnapInfo) {
 	img.Open()
 	snaps, err := img.GetSnapshotNames()
 	if err != nil {
-		logger.Errorf("Error getting snapshots for image %s: %s", cephfsRbdName, err.Error())
+		logger.Errorf("Error getting snapshots for image %s: %s", imageName, err.Error())
 	}
 	img.Close()
 	return snaps
 }
 
 func checkHealth() {
-	cephfsSnapAgeHealthThreshold := time.Duration(cephfsSnapAgeMin * 120 / 100) // add 20%
-	if !checkSnapshotHealth(cephfsRbdName, cephfsSnapAgeHealthThreshold) {
-		msg := fmt.Sprintf("Snapshot within %s not found for CephFS RBD", cephfsSnapAgeHealthThreshold)
-		health.CephFS = msg
-		logger.Infof(msg)
-	} else {
-		health.CephFS = ""
+	if cephfsPvBackupsEnabled {
+		checkCephFSPvHealth()
+	}
+
+	for _, j := range cephfsJobs {
+		checkCapacityHealth(j)
+		checkGuardHealth(j)
+
+		cephfsSnapAgeHealthThreshold := time.Duration(j.SnapAgeMin * 120 / 100) // add 20%
+		// jobs without an RBD are snapshotted by the job owning it, or keep their history in a repository
+		if j.RbdName != "" && !checkSnapshotHealth(j.RbdName, cephfsSnapAgeHealthThreshold) {
+			msg := fmt.Sprintf("Snapshot within %s not found for CephFS job %s RBD %s", cephfsSnapAgeHealthThreshold, j.Name, j.RbdName)
+			health.Set("cephfs-"+j.Name, msg)
+			logger.Infof(msg)
+		} else {
+			health.Set("cephfs-"+j.Name, "")
+		}
+
+		// Need to add something here to check rsync_success timestamp
+
+		if info, err := lockHolder(j.LockFile); err == nil && info != nil && time.Since(info.Started) > j.RsyncInterval {
+			msg := fmt.Sprintf("CephFS job %s rsync lock held for longer than %s: %s", j.Name, j.RsyncInterval, info)
+			health.Set("cephfs-lock-"+j.Name, msg)
+			logger.Infof(msg)
+		} else {
+			health.Set("cephfs-lock-"+j.Name, "")
+		}
 	}
 
-	// Need to add something here to check rsync_success timestamp
+	if rbdChangeDetect {
+		checkImageChangeHealth()
+	}
 
 	rbdSnapAgeHealthThreshold := time.Duration(rbdSnapAgeMin * 120 / 100) // add 20%
 	healthy, unhealthyImages := checkRbdImagesSnapHealth(rbdSnapAgeHealthThreshold)
 	if healthy {
-		health.RBD = ""
-		metricHealth.Set(0)
+		health.Set("rbd", "")
 	} else {
 		msg := fmt.Sprintf("Snapshots within %s not found for %d RBD images: %s", rbdSnapAgeHealthThreshold, len(unhealthyImages), strings.Join(unhealthyImages, " "))
-		health.RBD = msg
+		health.Set("rbd", msg)
 		logger.Infof(msg)
-		metricHealth.Set(1)
 	}
 }
 
@@ -192,7 +423,9 @@ func checkSnapshotHealth(imageName string, youngerThan time.Duration) bool {
 	return false
 }
 
-func createSnap(imageName string, youngerThan time.Duration, freeze bool) int {
+// createSnap snapshots the image if it has no snapshot younger than youngerThan. If freezeMount is set
+// that filesystem is frozen while the snapshot is taken.
+func createSnap(imageName string, youngerThan time.Duration, freezeMount string) int {
 
 	snaps := getSnapshots(imageName)
 
@@ -214,8 +447,8 @@ func createSnap(imageName string, youngerThan time.Duration, freeze bool) int {
 		snapName := time.Now().Format(layout)
 		logger.Infof("Creating snapshot %s@%s", imageName, snapName)
 
-		if freeze {
-			if !execHelper("fsfreeze", []string{"-f", backupMount}, []int{0}) {
+		if freezeMount != "" {
+			if !freezeFS(freezeMount) {
 				return 0
 			}
 		}
@@ -225,8 +458,8 @@ func createSnap(imageName string, youngerThan time.Duration, freeze bool) int {
 		_, err := img.CreateSnapshot(snapName)
 		defer img.Close()
 
-		if freeze {
-			if !execHelper("fsfreeze", []string{"-u", backupMount}, []int{0}) {
+		if freezeMount != "" {
+			if !thawFS(freezeMount) {
 				return 0
 			}
 		}
@@ -247,8 +480,8 @@ func (m matchSnaps) Len() int           { return len(m) }
 func (m matchSnaps) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
 func (m matchSnaps) Less(i, j int) bool { return m[i].Name < m[j].Name }
 
-// returns number of deleted snapshots
-func deleteSnap(imageName string, olderThan time.Duration, minKeep int) (snapsDeleted int) {
+// returns number of deleted snapshots, deletions are throttled by the pass
+func deleteSnap(imageName string, olderThan time.Duration, minKeep int, p *deletionPass) (snapsDeleted int) {
 
 	snapsDeleted = 0
 	var matchingSnaps matchSnaps
@@ -263,6 +496,12 @@ func deleteSnap(imageName string, olderThan time.Duration, minKeep int) (snapsDe
 	}
 	sort.Sort(matchingSnaps)
 
+	held, err := heldSnaps(imageName)
+	if err != nil {
+		logger.Errorf("Unable to read trash holds, not deleting snapshots of image %s: %s", imageName, err.Error())
+		return snapsDeleted
+	}
+
 	matchingSnapCount := len(matchingSnaps)
 	if len(matchingSnaps) <= minKeep {
 		logger.Debugf("Skipping snapshot delete for image %s since matching snapshot count %d <= than minimum to keep setting %d", imageName, matchingSnapCount, minKeep)
@@ -288,10 +527,19 @@ func deleteSnap(imageName string, olderThan time.Duration, minKeep int) (snapsDe
 					logger.Errorf("Error checking if snapshot is protected %s@%s: %s", imageName, snap.Name, err.Error())
 				}
 				if protected {
-					logger.Errorf("Cannot delete protected snapshot %s@%s", imageName, snap.Name)
+					// pinned by a change rate spike, or the parent of a clone, and kept on purpose
+					logger.Debugf("Skipping protected snapshot %s@%s", imageName, snap.Name)
+				} else if stringInSlice(snap.Name, held) {
+					logger.Debugf("Skipping snapshot %s@%s restored from the trash", imageName, snap.Name)
+				} else if !trashEnabled && !p.allow() {
+					logger.Debugf("Deferring delete of snapshot %s@%s", imageName, snap.Name)
 				} else {
-					logger.Infof("Deleting snapshot %s@%s", imageName, snap.Name)
-					err = s.Remove()
+					if trashEnabled {
+						err = trashSnap(imageName, snap.Name, "retention")
+					} else {
+						logger.Infof("Deleting snapshot %s@%s", imageName, snap.Name)
+						err = s.Remove()
+					}
 					if err == nil {
 						snapsDeleted++
 						matchingSnapCount--
@@ -307,7 +555,17 @@ func deleteSnap(imageName string, olderThan time.Duration, minKeep int) (snapsDe
 	return snapsDeleted
 }
 
-func purgeSnaps(imageName string) (snapsDeleted int) {
+// removeSnap deletes a snapshot of an image
+func removeSnap(imageName string, snapName string) error {
+	img := rbd.GetImage(iocx, imageName)
+	if err := img.Open(); err != nil {
+		return err
+	}
+	defer img.Close()
+	return img.GetSnapshot(snapName).Remove()
+}
+
+func purgeSnaps(imageName string, p *deletionPass) (snapsDeleted int) {
 
 	snapsDeleted = 0
 
@@ -331,6 +589,8 @@ func purgeSnaps(imageName string) (snapsDeleted int) {
 		}
 		if protected {
 			logger.Errorf("Cannot delete protected snapshot %s@%s", imageName, snap.Name)
+		} else if !p.allow() {
+			logger.Debugf("Deferring delete of snapshot %s@%s", imageName, snap.Name)
 		} else {
 			err = s.Remove()
 			if err == nil {
@@ -343,3 +603,12 @@ func purgeSnaps(imageName string) (snapsDeleted int) {
 	}
 	return snapsDeleted
 }
+
+func stringInSlice(s string, list []string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}